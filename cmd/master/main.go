@@ -2,51 +2,286 @@ package main
 
 import (
 	"flag"
-	"log"
+	"log/slog"
 	"net/http"
-
+	"os"
 	"strings"
+	"time"
 
 	"github.com/afonp/microvault/internal/api"
+	"github.com/afonp/microvault/internal/auth"
+	"github.com/afonp/microvault/internal/cluster"
 	"github.com/afonp/microvault/internal/db"
 	"github.com/afonp/microvault/internal/hashing"
+	"github.com/afonp/microvault/internal/hashlock"
+	"github.com/afonp/microvault/internal/logging"
+	"github.com/afonp/microvault/internal/metrics"
+	"github.com/afonp/microvault/internal/repair"
+	"github.com/afonp/microvault/internal/s3"
+	"github.com/afonp/microvault/internal/tlsutil"
+	"github.com/afonp/microvault/internal/trace"
 )
 
 func main() {
 	port := flag.String("port", "8080", "port to listen on")
 	dbPath := flag.String("db", "metadata.db", "path to metadata database")
-	volumes := flag.String("volumes", "http://localhost:8081", "comma-separated list of volume servers")
+	volumes := flag.String("volumes", "", "comma-separated list of static volume servers, in addition to registered ones")
 	replicas := flag.Int("replicas", 3, "number of replicas")
+	placement := flag.String("placement", hashing.StrategyRing, "how keys are placed on volumes: "+strings.Join(hashing.Strategies, ", "))
+	vnodes := flag.Int("vnodes", hashing.DefaultVNodes, "points per unit of volume weight on the ring, for -placement ring and crc32")
+	weightBy := flag.String("weight-by", cluster.WeightNone, "weigh volumes that don't set -weight by the size of their disk (total), their free space (free), or not at all (none)")
+	minFree := flag.Float64("min-free", 0.05, "make volumes read-only when less than this fraction of their disk is free, until twice as much is (0 to never)")
+	writeQuorum := flag.Int("write-quorum", 0, "replicas that must take a write for it to succeed (0 for all)")
+	uploadTTL := flag.Duration("upload-ttl", 7*24*time.Hour, "abort multipart uploads that haven't completed this long after they started (0 to keep them)")
+	volumeTimeout := flag.Duration("volume-timeout", 30*time.Second, "take a volume out of the ring after this long without a heartbeat")
+	probeInterval := flag.Duration("probe-interval", 5*time.Second, "how often to health check volumes")
+	repairWorkers := flag.Int("repair-workers", 2, "blobs to re-replicate at once")
+	repairRate := flag.Int64("repair-rate", 50, "max MB/s to copy while re-replicating (0 for no limit)")
+	repairInterval := flag.Duration("repair-interval", time.Minute, "how often to scan for under-replicated blobs (0 to disable)")
+	authKeys := flag.String("auth-keys", "", "json file of client keys and their policies (empty to allow anonymous access to everything)")
+	volumeSecret := flag.String("volume-secret", os.Getenv("MV_VOLUME_SECRET"), "secret shared with the volumes, to sign requests to them and check their heartbeats")
+	urlSecret := flag.String("url-secret", os.Getenv("MV_URL_SECRET"), "secret shared with the volumes to sign the blob urls reads are redirected to (empty for plain urls)")
+	urlExpiry := flag.Duration("url-expiry", 5*time.Minute, "how long signed blob urls stay valid")
+	s3Port := flag.String("s3-port", "", "port to serve the s3 api on (empty to disable)")
+	s3AccessKey := flag.String("s3-access-key", "", "access key id s3 requests are signed with")
+	s3SecretKey := flag.String("s3-secret-key", "", "secret key s3 requests are signed with")
+	tlsOpts := tlsutil.Flags()
+	logOpts := logging.Flags()
+	traceOpts := trace.Flags()
 	flag.Parse()
 
+	if err := logging.Setup(logOpts); err != nil {
+		logging.Fatal("invalid logging flags", "err", err)
+	}
+	stopTracing, err := trace.Setup(traceOpts, "master")
+	if err != nil {
+		logging.Fatal("failed to start tracing", "err", err)
+	}
+	trace.StopOnSignal(stopTracing)
+
+	// before anything builds a client to talk to the volumes with
+	tlsLoader, err := tlsutil.Load(tlsOpts)
+	if err != nil {
+		logging.Fatal("failed to load tls certificates", "err", err)
+	}
+	tlsLoader.SetDefaultTransport()
+
 	store, err := db.NewStore(*dbPath)
 	if err != nil {
-		log.Fatalf("failed to open database: %v", err)
+		logging.Fatal("failed to open database", "err", err)
 	}
 	defer store.Close()
 
-	ring := hashing.NewRing(*replicas) // replicas for virtual nodes
+	var keys *auth.Keys
+	if *authKeys != "" {
+		if keys, err = auth.Load(*authKeys); err != nil {
+			logging.Fatal("failed to load keys", "err", err)
+		}
+	}
+
+	registry, err := cluster.NewRegistry(store, cluster.Options{
+		Placement: hashing.Options{Strategy: *placement, VNodes: *vnodes},
+		Timeout:   *volumeTimeout,
+		WeightBy:  *weightBy,
+		MinFree:   *minFree,
+	})
+	if err != nil {
+		logging.Fatal("failed to load volume registry", "err", err)
+	}
 	for _, v := range strings.Split(*volumes, ",") {
-		ring.AddNode(strings.TrimSpace(v))
+		if v = strings.TrimSpace(v); v != "" {
+			registry.AddStatic(v)
+		}
 	}
+	go registry.Run()
+	go registry.Probe(*probeInterval)
 
-	handler := api.NewHandler(store, ring, *replicas)
+	// the api and the repairer take the same locks on content
+	locks := &hashlock.Locks{}
+	repairer := repair.New(store, registry, *replicas, repair.Options{
+		Workers:      *repairWorkers,
+		Rate:         *repairRate << 20,
+		Interval:     *repairInterval,
+		VolumeSecret: *volumeSecret,
+		URLSecret:    *urlSecret,
+		HashLocks:    locks,
+	})
+	go repairer.Run()
 
-	http.HandleFunc("/blob/", func(w http.ResponseWriter, r *http.Request) {
+	handler := api.NewHandler(store, registry, repairer, api.Options{
+		Replicas:     *replicas,
+		WriteQuorum:  *writeQuorum,
+		VolumeSecret: *volumeSecret,
+		URLSecret:    *urlSecret,
+		URLExpiry:    *urlExpiry,
+		HashLocks:    locks,
+	})
+	if *uploadTTL > 0 {
+		go handler.ExpireUploads(*uploadTTL)
+	}
+
+	http.HandleFunc("/_repair", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if keys.Check(w, r, auth.Admin, "") {
+			handler.RepairStatus(w, r)
+		}
+	})
+
+	http.HandleFunc("/hash/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead && r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// it tells whether anyone stored some content, so it's for admins.
+		// writers just send the hash along with an empty body.
+		if keys.Check(w, r, auth.Admin, "") {
+			handler.HeadHash(w, r)
+		}
+	})
+
+	http.HandleFunc("/_presign", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		keys.ServePresign(w, r)
+	})
+
+	registry.RegisterMetrics(metrics.Default)
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if keys.Check(w, r, auth.Admin, "") {
+			metrics.Handler().ServeHTTP(w, r)
+		}
+	})
+
+	http.HandleFunc("/_volumes", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if keys.Check(w, r, auth.Admin, "") {
+			handler.ListVolumes(w, r)
+		}
+	})
+
+	http.HandleFunc("/_volumes/{id}/drain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !keys.Check(w, r, auth.Admin, "") {
+			return
+		}
 		switch r.Method {
-		case http.MethodGet, http.MethodHead:
-			handler.ServeBlob(w, r)
-		case http.MethodPut:
-			handler.PutBlob(w, r)
+		case http.MethodGet:
+			handler.DrainStatus(w, r)
+		case http.MethodPost:
+			handler.StartDrain(w, r)
 		case http.MethodDelete:
-			handler.DeleteBlob(w, r)
+			handler.CancelDrain(w, r)
+		}
+	})
+
+	http.HandleFunc("/_volumes/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if tlsLoader.ClientAuth() && !tlsutil.Verified(r) {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+		handler.Heartbeat(w, r)
+	})
+
+	http.HandleFunc("/blob/", func(w http.ResponseWriter, r *http.Request) {
+		// multipart uploads are told apart by their query string
+		q := r.URL.Query()
+		upload := q.Has("uploadId")
+		key := strings.TrimPrefix(r.URL.Path, "/blob/")
+
+		// each case checks the request may do what it asks first
+		switch {
+		case r.Method == http.MethodGet && upload:
+			if keys.Check(w, r, auth.Write, key) {
+				handler.ListParts(w, r)
+			}
+		case r.Method == http.MethodGet && r.URL.Path == "/blob/":
+			if keys.Check(w, r, auth.Read, q.Get("prefix")) {
+				handler.ListBlobs(w, r)
+			}
+		case r.Method == http.MethodGet, r.Method == http.MethodHead:
+			if keys.Check(w, r, auth.Read, key) {
+				handler.ServeBlob(w, r)
+			}
+		case r.Method == http.MethodPut && upload:
+			if keys.Check(w, r, auth.Write, key) {
+				handler.UploadPart(w, r)
+			}
+		case r.Method == http.MethodPut:
+			// put_blob links stored content by who asked
+			if r, ok := keys.Authorize(w, r, auth.Write, key); ok {
+				handler.PutBlob(w, r)
+			}
+		case r.Method == http.MethodPost && q.Has("uploads"):
+			if keys.Check(w, r, auth.Write, key) {
+				handler.CreateUpload(w, r)
+			}
+		case r.Method == http.MethodPost && upload:
+			if keys.Check(w, r, auth.Write, key) {
+				handler.CompleteUpload(w, r)
+			}
+		case r.Method == http.MethodDelete && upload:
+			if keys.Check(w, r, auth.Write, key) {
+				handler.AbortUpload(w, r)
+			}
+		case r.Method == http.MethodDelete:
+			if keys.Check(w, r, auth.Delete, key) {
+				handler.DeleteBlob(w, r)
+			}
 		default:
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		}
 	})
 
-	log.Printf("master server listening on :%s", *port)
-	if err := http.ListenAndServe(":"+*port, nil); err != nil {
-		log.Fatalf("server failed: %v", err)
+	if *s3Port != "" {
+		// the gateway takes the same keys, plus one that may do anything.
+		// that one is the gateway's alone, so it gets a copy of the keys.
+		s3Keys := keys.Clone()
+		if *s3AccessKey != "" {
+			if s3Keys == nil {
+				s3Keys, _ = auth.New(auth.Config{})
+			}
+			err := s3Keys.Add(auth.Key{
+				ID:       *s3AccessKey,
+				Secret:   *s3SecretKey,
+				Policies: []auth.Policy{{Permissions: []auth.Permission{auth.Read, auth.Write, auth.Delete}}},
+			})
+			if err != nil {
+				logging.Fatal("invalid s3 key", "err", err)
+			}
+		}
+		if s3Keys == nil {
+			logging.Fatal("-s3-port needs -auth-keys or -s3-access-key and -s3-secret-key")
+		}
+		gateway := s3.New(handler, store, s3Keys)
+		go func() {
+			slog.Info("s3 gateway listening", "port", *s3Port)
+			if err := tlsLoader.ListenAndServe(":"+*s3Port, logging.Middleware(metrics.Instrument("s3", gateway))); err != nil {
+				logging.Fatal("s3 gateway failed", "err", err)
+			}
+		}()
+	}
+
+	slog.Info("master server listening", "port", *port)
+	if err := tlsLoader.ListenAndServe(":"+*port, logging.Middleware(metrics.Instrument("", http.DefaultServeMux))); err != nil {
+		logging.Fatal("server failed", "err", err)
 	}
 }
@@ -3,21 +3,58 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/afonp/microvault/internal/hashing"
+	"github.com/afonp/microvault/internal/logging"
+	"github.com/afonp/microvault/internal/tlsutil"
 	"github.com/afonp/microvault/internal/tools"
+	"github.com/afonp/microvault/internal/volume"
 )
 
 func main() {
 	// global flags
 	dbPath := flag.String("db", "metadata.db", "path to metadata database")
-	volumes := flag.String("volumes", "http://localhost:8081", "comma-separated list of volume servers")
+	volumes := flag.String("volumes", "", "comma-separated list of volume servers (default: the volumes registered with the master)")
 	replicas := flag.Int("replicas", 3, "number of replicas")
+	placement := flag.String("placement", hashing.StrategyRing, "how keys are placed on volumes, as on the master: "+strings.Join(hashing.Strategies, ", "))
+	vnodes := flag.Int("vnodes", hashing.DefaultVNodes, "points per volume on the ring, as on the master")
+	urlSecret := flag.String("url-secret", os.Getenv("MV_URL_SECRET"), "secret shared with the volumes, to sign blob urls")
+	volumeSecret := flag.String("volume-secret", os.Getenv("MV_VOLUME_SECRET"), "secret shared with the volumes, to sign requests to them")
+	master := flag.String("master", "http://localhost:8080", "url of the master, for commands it runs")
+	key := flag.String("key", os.Getenv("MV_KEY"), "admin key to sign requests to the master with, as id:secret")
+	textfileDir := flag.String("textfile-dir", "", "write the results to mkv_{command}.prom in this directory, for node_exporter's textfile collector")
+	tlsOpts := tlsutil.ClientFlags()
+	logOpts := logging.Flags()
+
+	// command flags
+	verifyFlags := flag.NewFlagSet("verify", flag.ExitOnError)
+	deep := verifyFlags.Bool("deep", false, "have volumes re-hash every blob instead of only checking it exists")
+	scrubRate := verifyFlags.Int("rate", 0, "max MB/s each volume reads during -deep (0 for the volume's own limit)")
+	placementFlags := flag.NewFlagSet("placement", flag.ExitOnError)
+	reportVolumes := placementFlags.Int("volumes", 10, "number of volumes to simulate")
+	reportKeys := placementFlags.Int("keys", 100000, "number of keys to place")
+	reportStrategies := placementFlags.String("strategies", strings.Join(hashing.Strategies, ","), "comma-separated strategies to compare")
+	reportWeights := placementFlags.String("weights", "1", "comma-separated weights, given to the volumes in turn")
+	reportZones := placementFlags.Int("zones", 1, "number of zones to put the volumes in, in turn")
+	drainFlags := flag.NewFlagSet("drain", flag.ExitOnError)
+	detach := drainFlags.Bool("detach", false, "return once the drain has started instead of waiting for it")
+	cancelDrain := drainFlags.Bool("cancel", false, "call off draining the volume and put it back in the ring")
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: mkv [options] <command>\n")
-		fmt.Fprintf(os.Stderr, "Commands: rebuild, rebalance, verify, compact\n")
+		fmt.Fprintf(os.Stderr, "Usage: mkv [options] <command> [command options]\n")
+		fmt.Fprintf(os.Stderr, "Commands: rebuild, rebalance, verify, compact, placement, drain <volume>\n")
 		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "verify options:\n")
+		verifyFlags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "placement options:\n")
+		placementFlags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "drain options:\n")
+		drainFlags.PrintDefaults()
 	}
 
 	flag.Parse()
@@ -29,30 +66,76 @@ func main() {
 
 	cmd := flag.Arg(0)
 
+	if err := logging.Setup(logOpts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// every tool talks to the volumes through the default client
+	tlsLoader, err := tlsutil.Load(tlsOpts)
+	if err != nil {
+		logging.Fatal("failed to load tls certificates", "err", err)
+	}
+	tlsLoader.SetDefaultTransport()
+	http.DefaultClient.Transport = volume.NewTransport(*volumeSecret, nil)
+
 	// initialize tools ctx
 	ctx := &tools.Context{
-		DBPath:   *dbPath,
-		Volumes:  *volumes,
-		Replicas: *replicas,
+		DBPath:    *dbPath,
+		Volumes:   *volumes,
+		Replicas:  *replicas,
+		Placement: hashing.Options{Strategy: *placement, VNodes: *vnodes},
+		URLSecret: *urlSecret,
 	}
 
-	var err error
+	start := time.Now()
 	switch cmd {
 	case "rebuild":
 		err = tools.Rebuild(ctx)
 	case "rebalance":
 		err = tools.Rebalance(ctx)
 	case "verify":
-		err = tools.Verify(ctx)
+		verifyFlags.Parse(flag.Args()[1:])
+		err = tools.Verify(ctx, tools.VerifyOptions{Deep: *deep, Rate: *scrubRate})
 	case "compact":
 		err = tools.Compact(ctx)
+	case "placement":
+		placementFlags.Parse(flag.Args()[1:])
+		var weights []float64
+		if weights, err = tools.ParseWeights(*reportWeights); err == nil {
+			err = tools.PlacementReport(ctx, tools.PlacementOptions{
+				Volumes:    *reportVolumes,
+				Keys:       *reportKeys,
+				Strategies: tools.ParseStrategies(*reportStrategies),
+				Weights:    weights,
+				Zones:      *reportZones,
+			}, os.Stdout)
+		}
+	case "drain":
+		drainFlags.Parse(flag.Args()[1:])
+		if drainFlags.NArg() != 1 {
+			fmt.Fprintf(os.Stderr, "Usage: mkv drain [-detach] [-cancel] <volume id or url>\n")
+			os.Exit(1)
+		}
+		err = tools.Drain(ctx, tools.DrainOptions{
+			Master: *master,
+			Key:    *key,
+			Volume: drainFlags.Arg(0),
+			Detach: *detach,
+			Cancel: *cancelDrain,
+		})
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", cmd)
 		os.Exit(1)
 	}
 
+	if *textfileDir != "" {
+		if werr := ctx.WriteTextfile(*textfileDir, cmd, start, err); werr != nil {
+			slog.Error("failed to write metrics", "err", werr)
+		}
+	}
+
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		logging.Fatal(cmd+" failed", "err", err)
 	}
 }
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// disk_usage isn't implemented here, so volumes report no capacity
+func disk_usage(path string) (uint64, uint64, error) {
+	return 0, 0, nil
+}
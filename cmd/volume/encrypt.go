@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/afonp/microvault/internal/crypt"
+)
+
+// with a key provider, blobs and upload parts are encrypted on their way to
+// disk and decrypted on their way out. blobs written before encryption was
+// turned on are still read as they are.
+
+// seal_writer returns a writer that stores what is written to f, encrypted
+// if keys is set. closing it doesn't close f.
+func seal_writer(f *os.File, keys crypt.KeyProvider) (io.WriteCloser, error) {
+	if keys == nil {
+		return nopCloser{f}, nil
+	}
+	return crypt.NewWriter(f, keys)
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// blob_reader returns a reader over the content of an open blob file,
+// decrypting it if it is encrypted
+func blob_reader(f *os.File, keys crypt.KeyProvider) (io.ReadSeeker, error) {
+	if !crypt.IsEncrypted(f) {
+		return f, nil
+	}
+	if keys == nil {
+		return nil, errors.New("blob is encrypted and no master key is configured")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return crypt.NewReader(f, info.Size(), keys)
+}
+
+// load_keys returns the key provider the flags ask for, if any
+func load_keys(keyfile, command string) (crypt.KeyProvider, error) {
+	switch {
+	case keyfile != "" && command != "":
+		return nil, errors.New("-encryption-keyfile and -encryption-command can't both be set")
+	case keyfile != "":
+		return crypt.LoadKeyfile(keyfile)
+	case command != "":
+		return crypt.NewCommand(command), nil
+	}
+	return nil, nil
+}
@@ -7,21 +7,117 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/afonp/microvault/internal/crypt"
+	"github.com/afonp/microvault/internal/journal"
+	"github.com/afonp/microvault/internal/logging"
+	"github.com/afonp/microvault/internal/metrics"
+	"github.com/afonp/microvault/internal/tlsutil"
+	"github.com/afonp/microvault/internal/trace"
+	"github.com/afonp/microvault/internal/volume"
+)
+
+const (
+	// journal of key -> hash records, relative to the root
+	journalFile = "journal.log"
+
+	// header the master uses to tell us which user key a blob belongs to.
+	// the value is path-escaped.
+	keyHeader = "X-Mv-Key"
 )
 
 func main() {
 	port := flag.String("port", "8081", "port to listen on")
 	rootDir := flag.String("root", "./data", "root directory for blob storage")
+	master := flag.String("master", "", "master to register with, e.g. http://localhost:8080")
+	publicURL := flag.String("url", "", "url the master and clients reach this volume at (default http://{hostname}:{port})")
+	heartbeat := flag.Duration("heartbeat", 10*time.Second, "how often to report to the master")
+	weight := flag.Float64("weight", 0, "this volume's share of new keys relative to the others, e.g. its size in TB (0 to let the master weigh it by -weight-by)")
+	zone := flag.String("zone", "", "zone this volume is in; copies of a blob are kept in different zones where possible")
+	rack := flag.String("rack", "", "rack this volume is in, within its zone")
+	hostname, _ := os.Hostname()
+	host := flag.String("host", hostname, "host this volume is on, within its rack")
+	scrubInterval := flag.Duration("scrub-interval", 24*time.Hour, "how often to re-hash every blob and quarantine corrupt ones (0 to disable)")
+	scrubRate := flag.Int64("scrub-rate", 20, "max MB/s to read while scrubbing (0 for no limit)")
+	uploadTTL := flag.Duration("upload-ttl", 14*24*time.Hour, "delete the parts of uploads nothing was written to for this long, for uploads the master lost track of; keep it above the master's -upload-ttl (0 to keep them)")
+	urlSecret := flag.String("url-secret", os.Getenv("MV_URL_SECRET"), "secret shared with the master; blob reads must use urls it signed with it")
+	secret := flag.String("volume-secret", os.Getenv("MV_VOLUME_SECRET"), "secret shared with the master; requests that change the volume must be signed with it")
+	keyfile := flag.String("encryption-keyfile", "", "file of master keys to encrypt blobs at rest with")
+	keyCommand := flag.String("encryption-command", "", "program that wraps and unwraps data keys with a master key held elsewhere (see internal/crypt)")
+	tlsOpts := tlsutil.Flags()
+	logOpts := logging.Flags()
+	traceOpts := trace.Flags()
 	flag.Parse()
 
+	if err := logging.Setup(logOpts); err != nil {
+		logging.Fatal("invalid logging flags", "err", err)
+	}
+	stopTracing, err := trace.Setup(traceOpts, "volume")
+	if err != nil {
+		logging.Fatal("failed to start tracing", "err", err)
+	}
+	trace.StopOnSignal(stopTracing)
+
+	tlsLoader, err := tlsutil.Load(tlsOpts)
+	if err != nil {
+		logging.Fatal("failed to load tls certificates", "err", err)
+	}
+	tlsLoader.SetDefaultTransport()
+
+	keys, err := load_keys(*keyfile, *keyCommand)
+	if err != nil {
+		logging.Fatal("failed to load encryption keys", "err", err)
+	}
+
 	if err := os.MkdirAll(*rootDir, 0755); err != nil {
-		log.Fatalf("failed to create root dir: %v", err)
+		logging.Fatal("failed to create root dir", "err", err)
+	}
+
+	jrnl, err := journal.Open(filepath.Join(*rootDir, journalFile))
+	if err != nil {
+		logging.Fatal("failed to open journal", "err", err)
 	}
+	defer jrnl.Close()
+
+	scrub := &scrubber{root: *rootDir, rate: *scrubRate << 20, keys: keys}
+	if *scrubInterval > 0 {
+		go scrub.run(*scrubInterval)
+	}
+	if *uploadTTL > 0 {
+		go expire_uploads(*rootDir, *uploadTTL)
+	}
+
+	if *master != "" {
+		id, err := load_volume_id(*rootDir)
+		if err != nil {
+			logging.Fatal("failed to load volume id", "err", err)
+		}
+		if *publicURL == "" {
+			scheme := "http"
+			if tlsLoader.ServerConfig() != nil {
+				scheme = "https"
+			}
+			*publicURL = fmt.Sprintf("%s://%s:%s", scheme, hostname, *port)
+		}
+		hb := volume.Heartbeat{
+			ID:     id,
+			URL:    *publicURL,
+			Weight: *weight,
+			Zone:   *zone,
+			Rack:   *rack,
+			Host:   *host,
+		}
+		go heartbeat_loop(*master, hb, *rootDir, *heartbeat, scrub, *secret)
+	}
+
+	register_metrics(*rootDir)
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		// path may come in as /blob/{key} or /{key}, depending on nginx.
@@ -31,34 +127,100 @@ func main() {
 
 		key := strings.TrimPrefix(r.URL.Path, "/")
 
+		if r.URL.Path == "/_health" {
+			// the master probes this to decide where to send reads
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if r.URL.Path == "/metrics" && r.Method == http.MethodGet {
+			metrics.Handler().ServeHTTP(w, r)
+			return
+		}
+
+		// with client certificates on, only peers holding one may change
+		// anything
+		if tlsLoader.ClientAuth() && needs_auth(r, key) && !tlsutil.Verified(r) {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+
+		if *secret != "" && needs_auth(r, key) {
+			if err := volume.Verify(r, *secret); err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+		}
+
 		if r.URL.Path == "/_list" && r.Method == http.MethodGet {
 			handle_list(w, *rootDir)
 			return
 		}
 
+		if r.URL.Path == "/_scrub" && r.Method == http.MethodGet {
+			handle_scrub(w, r, *rootDir, scrub.rate, keys)
+			return
+		}
+
+		if r.URL.Path == "/_journal" {
+			switch r.Method {
+			case http.MethodGet:
+				http.ServeFile(w, r, filepath.Join(*rootDir, journalFile))
+			case http.MethodPost:
+				handle_journal(w, r, *rootDir, jrnl)
+			default:
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			}
+			return
+		}
+
+		if strings.HasPrefix(key, uploadsDir+"/") {
+			handle_upload(w, r, *rootDir, jrnl, keys, strings.TrimPrefix(key, uploadsDir+"/"))
+			return
+		}
+
 		switch r.Method {
 		case http.MethodPut:
-			handle_put(w, r, *rootDir, key)
+			handle_put(w, r, *rootDir, jrnl, keys)
 		case http.MethodDelete:
 			if key == "" {
 				http.Error(w, "missing key", http.StatusBadRequest)
 				return
 			}
-			handle_delete(w, r, *rootDir, key)
-		case http.MethodHead:
-			handle_head(w, r, *rootDir, key)
+			handle_delete(w, r, *rootDir, jrnl, key)
+		case http.MethodGet, http.MethodHead:
+			if *urlSecret != "" {
+				if err := volume.VerifyURL(r, *urlSecret); err != nil {
+					status := http.StatusForbidden
+					if err == volume.ErrLinkExpired {
+						status = http.StatusGone
+					}
+					http.Error(w, err.Error(), status)
+					return
+				}
+			}
+			handle_get(w, r, *rootDir, keys, key)
 		default:
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		}
 	})
 
-	log.Printf("volume wrapper listening on :%s", *port)
-	if err := http.ListenAndServe(":"+*port, nil); err != nil {
-		log.Fatalf("server failed: %v", err)
+	slog.Info("volume wrapper listening", "port", *port)
+	if err := tlsLoader.ListenAndServe(":"+*port, logging.Middleware(metrics.Instrument("", http.DefaultServeMux))); err != nil {
+		logging.Fatal("server failed", "err", err)
+	}
+}
+
+// needs_auth reports whether r must be signed by the master. reads of
+// blobs are checked against their signed url instead, if at all.
+func needs_auth(r *http.Request, key string) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return true
 	}
+	return strings.HasPrefix(key, "_")
 }
 
-func handle_put(w http.ResponseWriter, r *http.Request, root, key string) {
+func handle_put(w http.ResponseWriter, r *http.Request, root string, jrnl *journal.Journal, keys crypt.KeyProvider) {
 	// we want to store by content hash, but the key is user provided?
 	// "Files named by content hash".
 	// "Optional user-defined keys map to content hashes".
@@ -120,29 +282,35 @@ func handle_put(w http.ResponseWriter, r *http.Request, root, key string) {
 	}
 	defer os.Remove(tempFile.Name()) // cleanup if not renamed
 
+	// the name is the hash of the content as sent, encrypted or not
+	sealed, err := seal_writer(tempFile, keys)
+	if err != nil {
+		tempFile.Close()
+		http.Error(w, "failed to encrypt data", http.StatusInternalServerError)
+		return
+	}
 	hasher := sha256.New()
-	writer := io.MultiWriter(tempFile, hasher)
+	writer := io.MultiWriter(sealed, hasher)
 
-	if _, err := io.Copy(writer, r.Body); err != nil {
+	size, err := io.Copy(writer, r.Body)
+	if err == nil {
+		err = sealed.Close()
+	}
+	tempFile.Close()
+	if err != nil {
 		http.Error(w, "failed to write data", http.StatusInternalServerError)
 		return
 	}
-	tempFile.Close()
 
 	hash := hex.EncodeToString(hasher.Sum(nil))
 
-	// create directory structure /ab/cd/
-	dir := filepath.Join(root, hash[:2], hash[2:4])
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		http.Error(w, "failed to create directory", http.StatusInternalServerError)
+	if err := commit_blob(root, tempFile.Name(), hash); err != nil {
+		http.Error(w, "failed to save file", http.StatusInternalServerError)
 		return
 	}
 
-	finalPath := filepath.Join(dir, hash)
-	if err := os.Rename(tempFile.Name(), finalPath); err != nil {
-		// if rename fails (e.g. cross-device), copy and delete
-		// for now assume same filesystem
-		http.Error(w, "failed to save file", http.StatusInternalServerError)
+	if err := journal_put(jrnl, r, hash, size, r.Header.Get("Content-Type")); err != nil {
+		http.Error(w, "failed to write journal", http.StatusInternalServerError)
 		return
 	}
 
@@ -152,7 +320,20 @@ func handle_put(w http.ResponseWriter, r *http.Request, root, key string) {
 	fmt.Fprint(w, hash)
 }
 
-func handle_delete(w http.ResponseWriter, r *http.Request, root, key string) {
+// commit_blob moves a fully written temp file to its content-addressed path
+func commit_blob(root, tempPath, hash string) error {
+	// create directory structure /ab/cd/
+	dir := filepath.Join(root, hash[:2], hash[2:4])
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// if rename fails (e.g. cross-device), copy and delete
+	// for now assume same filesystem
+	return os.Rename(tempPath, filepath.Join(dir, hash))
+}
+
+func handle_delete(w http.ResponseWriter, r *http.Request, root string, jrnl *journal.Journal, key string) {
 	// extract hash from path (e.g. ab/cd/hash -> hash)
 	hash := filepath.Base(key)
 
@@ -171,40 +352,117 @@ func handle_delete(w http.ResponseWriter, r *http.Request, root, key string) {
 		http.Error(w, "failed to delete", http.StatusInternalServerError)
 		return
 	}
+
+	if userKey, ok := blob_key(r); ok {
+		jrnl.Append(journal.Record{Op: journal.OpDelete, Key: userKey, Hash: hash})
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// journal_put records which user key a freshly stored blob belongs to. the
+// master names the key in a header; writes without one (e.g. from mkv
+// rebalance) aren't journaled.
+func journal_put(jrnl *journal.Journal, r *http.Request, hash string, size int64, contentType string) error {
+	key, ok := blob_key(r)
+	if !ok {
+		return nil
+	}
+	return jrnl.Append(journal.Record{
+		Op:          journal.OpPut,
+		Key:         key,
+		Hash:        hash,
+		Size:        size,
+		ContentType: contentType,
+		Meta:        volume.Meta(r.Header),
+	})
+}
+
+// handle_journal appends a record sent by the master. it is used when a
+// key starts or stops pointing at a blob without the blob itself being
+// written or deleted, which happens when content is shared by keys.
+func handle_journal(w http.ResponseWriter, r *http.Request, root string, jrnl *journal.Journal) {
+	var rec journal.Record
+	if err := json.NewDecoder(r.Body).Decode(&rec); err != nil {
+		http.Error(w, "invalid record", http.StatusBadRequest)
+		return
+	}
+	if rec.Key == "" || len(rec.Hash) != 64 || (rec.Op != journal.OpPut && rec.Op != journal.OpDelete) {
+		http.Error(w, "invalid record", http.StatusBadRequest)
+		return
+	}
+
+	if rec.Op == journal.OpPut {
+		// a key can only point at something we have
+		path := filepath.Join(root, rec.Hash[:2], rec.Hash[2:4], rec.Hash)
+		if _, err := os.Stat(path); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	rec.Time = time.Time{} // stamped on append
+	if err := jrnl.Append(rec); err != nil {
+		http.Error(w, "failed to write journal", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// blob_key returns the user key the master sent along with a request
+func blob_key(r *http.Request) (string, bool) {
+	key, err := url.PathUnescape(r.Header.Get(keyHeader))
+	if err != nil || key == "" {
+		return "", false
+	}
+	return key, true
+}
+
 func handle_list(w http.ResponseWriter, root string) {
 	var blobs []string
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+	err := walk_blobs(root, func(hash, path string) error {
+		blobs = append(blobs, hash)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "failed to walk dir", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blobs)
+}
+
+// walk_blobs calls fn for every stored blob. directories starting with _
+// (uploads, quarantine) hold files that aren't blobs and are skipped.
+func walk_blobs(root string, fn func(hash, path string) error) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if info.IsDir() && path != root && strings.HasPrefix(info.Name(), "_") {
+			return filepath.SkipDir
+		}
 		if !info.IsDir() {
 			// check if it looks like a hash (64 chars)
 			if len(info.Name()) == 64 {
-				blobs = append(blobs, info.Name())
+				return fn(info.Name(), path)
 			}
 		}
 		return nil
 	})
-	if err != nil {
-		http.Error(w, "failed to walk dir", http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(blobs)
 }
 
-func handle_head(w http.ResponseWriter, r *http.Request, root, key string) {
+// handle_get serves GET and HEAD for a blob, with ranges and conditional
+// requests. in production nginx answers these from the files directly,
+// unless blobs are encrypted; both send the hash as a strong etag.
+func handle_get(w http.ResponseWriter, r *http.Request, root string, keys crypt.KeyProvider, key string) {
 	hash := filepath.Base(key)
-	if len(hash) != 64 {
+	if !volume.ValidHash(hash) || key != volume.Path(hash) {
 		http.Error(w, "invalid hash", http.StatusBadRequest)
 		return
 	}
-	path := filepath.Join(root, hash[:2], hash[2:4], hash)
-	if _, err := os.Stat(path); err != nil {
+	f, err := os.Open(filepath.Join(root, hash[:2], hash[2:4], hash))
+	if err != nil {
 		if os.IsNotExist(err) {
 			http.NotFound(w, r)
 			return
@@ -212,5 +470,27 @@ func handle_head(w http.ResponseWriter, r *http.Request, root, key string) {
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	content, err := blob_reader(f, keys)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to open blob", "hash", hash, "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// blobs don't know their content type, the key does. the master puts
+	// it in the url it redirects to.
+	contentType := volume.ContentType(r)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("ETag", `"`+hash+`"`)
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, "", info.ModTime(), content)
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/afonp/microvault/internal/metrics"
+)
+
+// how long a count of the blobs on disk is reused. counting walks the whole
+// root, so scrapes in between get the last count.
+const blobCountTTL = time.Minute
+
+// blob_counter counts the blobs under root, at most once per blobCountTTL
+type blob_counter struct {
+	root string
+
+	mu      sync.Mutex
+	counted time.Time
+	files   int
+	bytes   int64
+}
+
+func (c *blob_counter) count() (int, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.counted) < blobCountTTL {
+		return c.files, c.bytes
+	}
+	files, bytes := 0, int64(0)
+	err := walk_blobs(c.root, func(hash, path string) error {
+		if info, err := os.Stat(path); err == nil {
+			files++
+			bytes += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("metrics: failed to count blobs", "err", err)
+		return c.files, c.bytes
+	}
+	c.counted, c.files, c.bytes = time.Now(), files, bytes
+	return files, bytes
+}
+
+// register_metrics exports the volume's disk usage and blob counts
+func register_metrics(root string) {
+	metrics.NewGaugeFunc("mv_disk_total_bytes", "size of the filesystem holding the volume", nil,
+		func(set func(float64, ...string)) {
+			if total, _, err := disk_usage(root); err == nil && total > 0 {
+				set(float64(total))
+			}
+		})
+	metrics.NewGaugeFunc("mv_disk_free_bytes", "free space on the filesystem holding the volume", nil,
+		func(set func(float64, ...string)) {
+			if total, free, err := disk_usage(root); err == nil && total > 0 {
+				set(float64(free))
+			}
+		})
+
+	blobs := &blob_counter{root: root}
+	metrics.NewGaugeFunc("mv_blobs", "blobs stored on the volume", nil,
+		func(set func(float64, ...string)) {
+			files, _ := blobs.count()
+			set(float64(files))
+		})
+	metrics.NewGaugeFunc("mv_blob_bytes", "bytes of blobs stored on the volume, as on disk", nil,
+		func(set func(float64, ...string)) {
+			_, bytes := blobs.count()
+			set(float64(bytes))
+		})
+}
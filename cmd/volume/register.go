@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/afonp/microvault/internal/volume"
+)
+
+// file in the root holding the volume's id
+const idFile = "volume.id"
+
+// load_volume_id reads the volume's id from its root, creating one the
+// first time the root is used
+func load_volume_id(root string) (string, error) {
+	path := filepath.Join(root, idFile)
+
+	b, err := os.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(b)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(buf)
+	if err := os.WriteFile(path, []byte(id+"\n"), 0644); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// heartbeat_loop registers with the master and then keeps reporting in
+// every interval, sending hb with the disk usage of root and what the
+// scrubber found. it never returns.
+func heartbeat_loop(master string, hb volume.Heartbeat, root string, interval time.Duration, scrub *scrubber, secret string) {
+	client := &http.Client{Timeout: 5 * time.Second, Transport: volume.NewTransport(secret, nil)}
+	registered := false
+
+	for {
+		quarantined := scrub.take_quarantined()
+		hb.Quarantined = quarantined
+		err := send_heartbeat(client, master, hb, root)
+		if err != nil {
+			scrub.return_quarantined(quarantined)
+		}
+		switch {
+		case err != nil:
+			slog.Warn("heartbeat failed", "master", master, "err", err)
+			registered = false
+		case !registered:
+			slog.Info("registered with master", "master", master, "id", hb.ID)
+			registered = true
+		}
+		time.Sleep(interval)
+	}
+}
+
+func send_heartbeat(client *http.Client, master string, hb volume.Heartbeat, root string) error {
+	var err error
+	if hb.Total, hb.Free, err = disk_usage(root); err != nil {
+		slog.Warn("failed to read disk usage", "err", err)
+	}
+
+	body, err := json.Marshal(hb)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(strings.TrimRight(master, "/")+"/_volumes/heartbeat", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/afonp/microvault/internal/crypt"
+	"github.com/afonp/microvault/internal/logging"
+	"github.com/afonp/microvault/internal/ratelimit"
+	"github.com/afonp/microvault/internal/volume"
+)
+
+// scrubbing re-hashes stored blobs to catch bit rot and truncation. blobs
+// are named by their sha256, so a file whose content no longer hashes to
+// its name is corrupt. the background scrubber moves those to
+// {root}/_quarantine so they are never served again.
+
+const quarantineDir = "_quarantine"
+
+// scrubber runs the background scrub and remembers what it quarantined
+type scrubber struct {
+	root string
+	rate int64 // bytes per second
+	keys crypt.KeyProvider
+
+	mu          sync.Mutex
+	quarantined []string
+}
+
+// run scrubs every interval. it never returns.
+func (s *scrubber) run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		start := time.Now()
+		var checked, corrupt int
+		limiter := ratelimit.New(s.rate)
+		err := walk_blobs(s.root, func(hash, path string) error {
+			checked++
+			res := scrub_file(hash, path, s.keys, limiter)
+			if res.OK {
+				return nil
+			}
+			if res.Skipped {
+				slog.Warn("scrub: skipped blob", "hash", hash, "reason", res.Error)
+				return nil
+			}
+			corrupt++
+			slog.Error("scrub: blob is corrupt", "hash", hash, "actual", res.Actual, "reason", res.Error)
+			if err := s.quarantine(hash, path); err != nil {
+				slog.Error("scrub: failed to quarantine", "hash", hash, "err", err)
+			}
+			return nil
+		})
+		if err != nil {
+			slog.Error("scrub failed", "err", err)
+			continue
+		}
+		slog.Info("scrub: done", "checked", checked, "corrupt", corrupt, "duration", time.Since(start).Round(time.Second))
+	}
+}
+
+// quarantine moves a corrupt blob out of the blob tree
+func (s *scrubber) quarantine(hash, path string) error {
+	dir := filepath.Join(s.root, quarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(path, filepath.Join(dir, hash)); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.quarantined = append(s.quarantined, hash)
+	s.mu.Unlock()
+	return nil
+}
+
+// take_quarantined returns and forgets the blobs quarantined so far
+func (s *scrubber) take_quarantined() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.quarantined
+	s.quarantined = nil
+	return q
+}
+
+// return_quarantined puts back blobs that couldn't be reported
+func (s *scrubber) return_quarantined(q []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quarantined = append(q, s.quarantined...)
+}
+
+// handle_scrub streams a scrub of every blob as JSON lines. the rate query
+// parameter (MB/s) can lower the rate, but not raise it past maxRate.
+func handle_scrub(w http.ResponseWriter, r *http.Request, root string, maxRate int64, keys crypt.KeyProvider) {
+	rate := maxRate
+	if mbps, err := strconv.ParseInt(r.URL.Query().Get("rate"), 10, 64); err == nil && mbps > 0 {
+		if requested := mbps << 20; maxRate <= 0 || requested < maxRate {
+			rate = requested
+		}
+	}
+	limiter := ratelimit.New(rate)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	err := walk_blobs(root, func(hash, path string) error {
+		// a dead client stops the scrub
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		if err := enc.Encode(scrub_file(hash, path, keys, limiter)); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("scrub request ended early", "err", err)
+	}
+}
+
+// scrub_file re-hashes a single blob. encrypted blobs are decrypted first,
+// which also checks every chunk's tag.
+func scrub_file(hash, path string, keys crypt.KeyProvider, limiter *ratelimit.Limiter) volume.ScrubResult {
+	res := volume.ScrubResult{Hash: hash}
+
+	f, err := os.Open(path)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer f.Close()
+
+	content, err := blob_reader(f, keys)
+	if err != nil {
+		res.Error = err.Error()
+		// no key to check it with says nothing about the blob
+		res.Skipped = err != crypt.ErrCorrupt
+		return res
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, ratelimit.Reader(content, limiter)); err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	res.Actual = hex.EncodeToString(hasher.Sum(nil))
+	res.OK = res.Actual == hash
+	return res
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/afonp/microvault/internal/crypt"
+	"github.com/afonp/microvault/internal/journal"
+	"github.com/afonp/microvault/internal/volume"
+)
+
+// parts of multipart uploads are kept under {root}/_uploads/{upload_id}/{n}
+// until the master deletes the upload, once it has recorded the stitched
+// blob or the upload was aborted. completing is idempotent, so the master
+// can retry it.
+const uploadsDir = "_uploads"
+
+// handle_upload dispatches /_uploads/{id} and /_uploads/{id}/{n}
+func handle_upload(w http.ResponseWriter, r *http.Request, root string, jrnl *journal.Journal, keys crypt.KeyProvider, path string) {
+	id, part, _ := strings.Cut(path, "/")
+	if !valid_upload_id(id) {
+		http.Error(w, "invalid upload id", http.StatusBadRequest)
+		return
+	}
+	dir := filepath.Join(root, uploadsDir, id)
+
+	switch {
+	case r.Method == http.MethodPut && part != "":
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid part number", http.StatusBadRequest)
+			return
+		}
+		handle_put_part(w, r, dir, keys, n)
+	case r.Method == http.MethodPost && part == "":
+		handle_complete_upload(w, r, root, jrnl, keys, dir)
+	case r.Method == http.MethodDelete && part == "":
+		if err := os.RemoveAll(dir); err != nil {
+			http.Error(w, "failed to delete", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handle_put_part stores one part and returns its hash. a part only shows
+// up under its number once it is fully written, so a retried part never
+// leaves a truncated file behind. parts are encrypted like blobs.
+func handle_put_part(w http.ResponseWriter, r *http.Request, dir string, keys crypt.KeyProvider, n int) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		http.Error(w, "failed to create directory", http.StatusInternalServerError)
+		return
+	}
+
+	tempFile, err := os.CreateTemp(dir, "part-*")
+	if err != nil {
+		http.Error(w, "failed to create temp file", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tempFile.Name()) // cleanup if not renamed
+
+	sealed, err := seal_writer(tempFile, keys)
+	if err != nil {
+		tempFile.Close()
+		http.Error(w, "failed to encrypt data", http.StatusInternalServerError)
+		return
+	}
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(sealed, hasher), r.Body)
+	if err == nil {
+		err = sealed.Close()
+	}
+	tempFile.Close()
+	if err != nil {
+		http.Error(w, "failed to write data", http.StatusInternalServerError)
+		return
+	}
+
+	if err := os.Rename(tempFile.Name(), filepath.Join(dir, strconv.Itoa(n))); err != nil {
+		http.Error(w, "failed to save part", http.StatusInternalServerError)
+		return
+	}
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	w.Header().Set("X-Content-Hash", hash)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, hash)
+}
+
+// handle_complete_upload concatenates the parts listed in the body (or all
+// of them) into a single blob and returns its hash
+func handle_complete_upload(w http.ResponseWriter, r *http.Request, root string, jrnl *journal.Journal, keys crypt.KeyProvider, dir string) {
+	var parts []int
+	if err := json.NewDecoder(r.Body).Decode(&parts); err != nil && err != io.EOF {
+		http.Error(w, "invalid part list", http.StatusBadRequest)
+		return
+	}
+	if len(parts) == 0 {
+		var err error
+		if parts, err = list_parts(dir); err != nil {
+			http.Error(w, "no such upload", http.StatusNotFound)
+			return
+		}
+	}
+	if len(parts) == 0 {
+		http.Error(w, "no parts uploaded", http.StatusBadRequest)
+		return
+	}
+
+	tempFile, err := os.CreateTemp(root, "upload-*")
+	if err != nil {
+		http.Error(w, "failed to create temp file", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tempFile.Name()) // cleanup if not renamed
+
+	sealed, err := seal_writer(tempFile, keys)
+	if err != nil {
+		tempFile.Close()
+		http.Error(w, "failed to encrypt data", http.StatusInternalServerError)
+		return
+	}
+	hasher := sha256.New()
+	writer := io.MultiWriter(sealed, hasher)
+
+	var size int64
+	for _, n := range parts {
+		f, err := os.Open(filepath.Join(dir, strconv.Itoa(n)))
+		if err != nil {
+			tempFile.Close()
+			http.Error(w, fmt.Sprintf("missing part %d", n), http.StatusBadRequest)
+			return
+		}
+		content, err := blob_reader(f, keys)
+		if err != nil {
+			f.Close()
+			tempFile.Close()
+			http.Error(w, fmt.Sprintf("failed to read part %d", n), http.StatusInternalServerError)
+			return
+		}
+		written, err := io.Copy(writer, content)
+		size += written
+		f.Close()
+		if err != nil {
+			tempFile.Close()
+			http.Error(w, "failed to write data", http.StatusInternalServerError)
+			return
+		}
+	}
+	err = sealed.Close()
+	tempFile.Close()
+	if err != nil {
+		http.Error(w, "failed to write data", http.StatusInternalServerError)
+		return
+	}
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	if err := commit_blob(root, tempFile.Name(), hash); err != nil {
+		http.Error(w, "failed to save file", http.StatusInternalServerError)
+		return
+	}
+
+	// the body here is the part list, so the blob's content type comes in
+	// its own header
+	if err := journal_put(jrnl, r, hash, size, r.Header.Get(volume.ContentTypeHeader)); err != nil {
+		http.Error(w, "failed to write journal", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("X-Content-Hash", hash)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, hash)
+}
+
+// expire_uploads deletes the parts of uploads nothing was written to for
+// ttl. the master drops parts itself, so this only catches the uploads it
+// couldn't tell us about, e.g. because we were down.
+func expire_uploads(root string, ttl time.Duration) {
+	dir := filepath.Join(root, uploadsDir)
+	for {
+		time.Sleep(min(ttl, time.Hour))
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				slog.Error("failed to list uploads", "err", err)
+			}
+			continue
+		}
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil || time.Since(info.ModTime()) < ttl {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				slog.Error("failed to expire upload", "upload", e.Name(), "err", err)
+				continue
+			}
+			slog.Info("expired upload", "upload", e.Name())
+		}
+	}
+}
+
+// list_parts returns the part numbers present in an upload dir, in order
+func list_parts(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []int
+	for _, e := range entries {
+		// skip in-flight temp files
+		if n, err := strconv.Atoi(e.Name()); err == nil {
+			parts = append(parts, n)
+		}
+	}
+	sort.Ints(parts)
+	return parts, nil
+}
+
+// valid_upload_id keeps upload ids from escaping the uploads dir
+func valid_upload_id(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/afonp/microvault/internal/db"
+)
+
+// a blob's etag is its sha256, which every replica agrees on, so the
+// master can answer conditional reads itself instead of redirecting. the
+// volumes send the same etag, so If-Range and revalidation work against
+// them too.
+
+// etag returns the strong etag of a blob
+func etag(blob *db.Blob) string {
+	return `"` + blob.Hash + `"`
+}
+
+// not_modified reports whether a GET or HEAD with r's conditional headers
+// can be answered with 304. If-None-Match wins over If-Modified-Since, as
+// in rfc 9110.
+func notModified(r *http.Request, blob *db.Blob) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, etag(blob))
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	// http dates have second precision
+	return !blob.UpdatedAt.Truncate(time.Second).After(ims)
+}
+
+// etag_matches reports whether a list of etags from If-None-Match has tag,
+// using the weak comparison the header calls for
+func etagMatches(list, tag string) bool {
+	for _, t := range strings.Split(list, ",") {
+		t = textproto.TrimString(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
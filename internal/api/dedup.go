@@ -0,0 +1,201 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/afonp/microvault/internal/auth"
+	"github.com/afonp/microvault/internal/db"
+	"github.com/afonp/microvault/internal/journal"
+	"github.com/afonp/microvault/internal/logging"
+	"github.com/afonp/microvault/internal/volume"
+)
+
+// content is stored once per volume no matter how many keys point at it.
+// a client that already knows the sha256 of what it is about to upload can
+// send it in contentHashHeader; if the cluster has that content, the key
+// is linked to the existing replicas and no bytes move. knowing a hash
+// isn't knowing the content, so only callers that may read some key
+// holding it get linked. everyone else sends the body.
+
+const contentHashHeader = "X-Mv-Content-Sha256"
+
+// sha256 of the empty body, which a link attempt without a body can't be
+// confused with
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// head_hash handles HEAD /hash/{sha256}
+// answers 200 if the content is stored. it's for admins, since it tells
+// what others stored.
+func (h *Handler) HeadHash(w http.ResponseWriter, r *http.Request) {
+	hash := strings.TrimPrefix(r.URL.Path, "/hash/")
+	if !volume.ValidHash(hash) {
+		http.Error(w, "invalid hash", http.StatusBadRequest)
+		return
+	}
+
+	existing, replicas, err := h.lookupHash(hash)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if existing == nil || len(replicas) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Length", fmt.Sprint(existing.Size))
+	w.WriteHeader(http.StatusOK)
+}
+
+// link_blob points blob.key at already stored content blob.hash. it
+// reports false if the content isn't stored, and returns the content the
+// key pointed at before, for release. callers hold the hash's lock.
+func (h *Handler) linkBlob(ctx context.Context, blob db.Blob) (bool, string, error) {
+	existing, replicas, err := h.lookupHash(blob.Hash)
+	if err != nil || existing == nil || len(replicas) == 0 {
+		return false, "", err
+	}
+	if ok, err := h.mayRead(ctx, blob.Hash); !ok {
+		return false, "", err
+	}
+
+	blob.Size = existing.Size
+	replaced, err := h.store.PutBlob(blob, nil)
+	if err != nil {
+		return false, "", err
+	}
+
+	// the volumes never saw this key, so tell them for the sake of rebuild
+	h.appendJournal(ctx, replicas, journal.Record{
+		Op:          journal.OpPut,
+		Key:         blob.Key,
+		Hash:        blob.Hash,
+		Size:        blob.Size,
+		ContentType: blob.ContentType,
+		Meta:        blob.Meta,
+	})
+	return true, replaced, nil
+}
+
+// lookup_hash returns some blob with content hash and its usable replicas
+func (h *Handler) lookupHash(hash string) (*db.Blob, []db.Replica, error) {
+	existing, err := h.store.FindHash(hash)
+	if err != nil || existing == nil {
+		return nil, nil, err
+	}
+	replicas, err := h.store.GetReplicas(hash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ok []db.Replica
+	for _, rep := range replicas {
+		if rep.State == db.ReplicaOK {
+			ok = append(ok, rep)
+		}
+	}
+	return existing, ok, nil
+}
+
+// append_journal records rec on every replica's volume. it's best effort:
+// a volume that misses a record only matters if the index is lost too.
+func (h *Handler) appendJournal(ctx context.Context, replicas []db.Replica, rec journal.Record) {
+	body, _ := json.Marshal(rec)
+
+	var wg sync.WaitGroup
+	for _, rep := range replicas {
+		wg.Add(1)
+		go func(vol string) {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.cluster.URL(vol)+"/_journal", bytes.NewReader(body))
+			if err != nil {
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := h.client.Do(req)
+			if err != nil {
+				logging.FromContext(ctx).Warn("failed to journal", "key", rec.Key, "volume", vol, "err", err)
+				h.volumeFailed(vol, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				logging.FromContext(ctx).Warn("failed to journal", "key", rec.Key, "volume", vol, "status", resp.StatusCode)
+			}
+		}(rep.VolumeID)
+	}
+	wg.Wait()
+}
+
+// may_read reports whether the caller in ctx may read some key pointing at
+// hash
+func (h *Handler) mayRead(ctx context.Context, hash string) (bool, error) {
+	keys, err := h.store.HashKeys(hash)
+	if err != nil {
+		return false, err
+	}
+	for _, key := range keys {
+		if auth.May(ctx, auth.Read, key) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// release deletes content key pointed at before it was overwritten, once no
+// other key points at it. callers hold no hash lock.
+func (h *Handler) release(ctx context.Context, key, hash string) {
+	if hash == "" {
+		return
+	}
+	unlock := h.hashLocks.Lock(hash)
+	defer unlock()
+
+	replicas, err := h.store.DropUnreferenced(hash)
+	if err != nil {
+		// the copies stay until compact finds them
+		logging.FromContext(ctx).Warn("failed to drop overwritten content", "key", key, "hash", hash, "err", err)
+		return
+	}
+	if len(replicas) == 0 {
+		return
+	}
+	vols := make([]string, len(replicas))
+	for i, rep := range replicas {
+		vols[i] = rep.VolumeID
+	}
+	h.purge(ctx, key, hash, vols)
+}
+
+// purge deletes content no key points at any more from vols. key is the
+// last key that did, for the volumes' journals. callers hold the hash's
+// lock.
+func (h *Handler) purge(ctx context.Context, key, hash string, vols []string) {
+	defer h.hashLocks.Purged()
+
+	var wg sync.WaitGroup
+	for _, vol := range vols {
+		wg.Add(1)
+		go func(vol string) {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, http.MethodDelete, volume.URL(h.cluster.URL(vol), hash), nil)
+			if err != nil {
+				return
+			}
+			req.Header = blobHeader(key)
+			resp, err := h.client.Do(req)
+			if err != nil {
+				h.volumeFailed(vol, err)
+				return
+			}
+			resp.Body.Close()
+		}(vol)
+	}
+	wg.Wait()
+}
@@ -1,36 +1,94 @@
 package api
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"math/rand"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/afonp/microvault/internal/cluster"
 	"github.com/afonp/microvault/internal/db"
-	"github.com/afonp/microvault/internal/hashing"
+	"github.com/afonp/microvault/internal/hashlock"
+	"github.com/afonp/microvault/internal/journal"
+	"github.com/afonp/microvault/internal/logging"
+	"github.com/afonp/microvault/internal/repair"
+	"github.com/afonp/microvault/internal/trace"
+	"github.com/afonp/microvault/internal/volume"
 )
 
+// header naming the user key on requests to volumes
+const keyHeader = "X-Mv-Key"
+
+// options configure the api
+type Options struct {
+	Replicas int
+	// write_quorum is how many replicas a put needs to succeed. outside
+	// 1..replicas every replica has to take a write.
+	WriteQuorum int
+	// volume_secret signs requests to volumes and checks their heartbeats,
+	// unless empty
+	VolumeSecret string
+	// url_secret signs the blob urls reads are redirected to, unless
+	// empty. they are good for url_expiry.
+	URLSecret string
+	URLExpiry time.Duration
+	// hash_locks are shared with the repairer. nil gets a set of its own.
+	HashLocks *hashlock.Locks
+}
+
 type Handler struct {
-	store    *db.Store
-	ring     *hashing.Ring
-	client   *http.Client
-	replicas int
+	store   *db.Store
+	cluster *cluster.Registry
+	repair  *repair.Repairer
+	opts    Options
+	client  *http.Client
+	// stream_client carries blob bodies. it has no overall timeout since
+	// uploads can take as long as the body does.
+	streamClient *http.Client
+	// stitch_client asks volumes to stitch uploads. they answer once they
+	// have re-read every part, so it has no timeout at all.
+	stitchClient *http.Client
+	hashLocks    *hashlock.Locks
 }
 
-func NewHandler(store *db.Store, ring *hashing.Ring, replicas int) *Handler {
+// new_handler builds the api
+func NewHandler(store *db.Store, registry *cluster.Registry, repairer *repair.Repairer, opts Options) *Handler {
+	if opts.WriteQuorum < 1 || opts.WriteQuorum > opts.Replicas {
+		opts.WriteQuorum = opts.Replicas
+	}
+	if opts.HashLocks == nil {
+		opts.HashLocks = &hashlock.Locks{}
+	}
 	return &Handler{
-		store:    store,
-		ring:     ring,
-		client:   &http.Client{Timeout: 5 * time.Second},
-		replicas: replicas,
+		store:        store,
+		cluster:      registry,
+		repair:       repairer,
+		opts:         opts,
+		client:       &http.Client{Timeout: 5 * time.Second, Transport: volume.NewTransport(opts.VolumeSecret, logging.NewTransport(nil))},
+		streamClient: &http.Client{Transport: volume.NewTransport(opts.VolumeSecret, logging.NewTransport(streamTransport()))},
+		stitchClient: &http.Client{Transport: volume.NewTransport(opts.VolumeSecret, logging.NewTransport(nil))},
+		hashLocks:    opts.HashLocks,
 	}
 }
 
-// serve_blob handles GET requests
-// redirects to one of the volume servers
+// stream_transport is the default transport with a bound on how long a
+// volume may sit on a fully-sent body before answering
+func streamTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ResponseHeaderTimeout = 30 * time.Second
+	return t
+}
+
+// serve_blob handles GET and HEAD requests
+// redirects to one of the volume servers, or answers 304 if the client's
+// copy is current. HEAD is answered from the index.
 func (h *Handler) ServeBlob(w http.ResponseWriter, r *http.Request) {
 	key := strings.TrimPrefix(r.URL.Path, "/blob/")
 	if key == "" {
@@ -38,23 +96,80 @@ func (h *Handler) ServeBlob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	volumeIDs, err := h.store.GetBlob(key)
+	blob, all, err := h.lookup(key)
 	if err != nil {
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
-	if len(volumeIDs) == 0 {
+	if blob == nil {
 		http.NotFound(w, r)
 		return
 	}
 
-	// redirect to a random replica for load balancing
-	target := volumeIDs[rand.Intn(len(volumeIDs))]
-	http.Redirect(w, r, target, http.StatusFound)
+	w.Header().Set("ETag", etag(blob))
+	w.Header().Set("Last-Modified", blob.UpdatedAt.UTC().Format(http.TimeFormat))
+	writeMeta(w.Header(), blob)
+	if notModified(r, blob) {
+		// no need to send the client to a volume for this
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if r.Method == http.MethodHead {
+		// everything a HEAD answers is in the index
+		w.Header().Set("Content-Length", fmt.Sprint(blob.Size))
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var ok []db.Replica
+	var ids []string
+	for _, rep := range all {
+		if rep.State == db.ReplicaOK {
+			ok = append(ok, rep)
+			ids = append(ids, rep.VolumeID)
+		}
+	}
+	if len(ids) < len(all) {
+		h.repair.Enqueue(blob.Hash)
+	}
+	if len(ids) == 0 {
+		// the key is there, its content just can't be read until repair
+		// brings a copy back
+		http.Error(w, h.unavailable(all), http.StatusServiceUnavailable)
+		return
+	}
+
+	target := h.cluster.Pick(ids)
+	if target == "" {
+		http.Error(w, h.unavailable(ok), http.StatusServiceUnavailable)
+		return
+	}
+	// the request id goes along so the volume logs the read under it
+	loc := volume.URL(h.cluster.URL(target), blob.Hash)
+	loc = volume.SignURL(volume.WithType(loc, blob.ContentType), h.opts.URLSecret, h.opts.URLExpiry)
+	http.Redirect(w, r, logging.WithRequestParam(r.Context(), loc), http.StatusFound)
+}
+
+// unavailable describes why none of the replicas can serve a read
+func (h *Handler) unavailable(replicas []db.Replica) string {
+	var b strings.Builder
+	b.WriteString("no healthy replica:")
+	for _, rep := range replicas {
+		reason := "replica is " + rep.State
+		if rep.State == db.ReplicaOK {
+			reason = h.cluster.Health(rep.VolumeID).LastError
+		}
+		if reason == "" {
+			reason = "down"
+		}
+		fmt.Fprintf(&b, "\n  volume %s at %s: %s", rep.VolumeID, h.cluster.URL(rep.VolumeID), reason)
+	}
+	return b.String()
 }
 
 // put_blob handles PUT requests
-// proxies data to the volume servers (N replicas) and updates metadata
+// streams data to the volume servers (N replicas) and updates metadata
 func (h *Handler) PutBlob(w http.ResponseWriter, r *http.Request) {
 	key := strings.TrimPrefix(r.URL.Path, "/blob/")
 	if key == "" {
@@ -62,94 +177,223 @@ func (h *Handler) PutBlob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// read body once so we can replay it
-	bodyBytes, err := io.ReadAll(r.Body)
+	// use consistent hashing to pick volumes
+	targetVolumes := h.cluster.Ring().GetNodes(key, h.opts.Replicas)
+	if len(targetVolumes) < h.opts.WriteQuorum {
+		http.Error(w, "not enough volumes available", http.StatusServiceUnavailable)
+		return
+	}
+
+	contentType, meta, err := requestMeta(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
+
+	// skip the upload if we already have the content. content the client
+	// names is locked for the whole write, so a delete of its last other
+	// key can't take our copies before they are recorded.
+	claimed := r.Header.Get(contentHashHeader)
+	var unlock func()
+	if claimed != "" {
+		if !volume.ValidHash(claimed) {
+			http.Error(w, "invalid "+contentHashHeader, http.StatusBadRequest)
+			return
+		}
+		unlock = h.hashLocks.Lock(claimed)
+		blob := db.Blob{Key: key, Hash: claimed, ContentType: contentType, Meta: meta}
+		linked, replaced, err := h.linkBlob(r.Context(), blob)
+		if err != nil {
+			unlock()
+			http.Error(w, "failed to update index", http.StatusInternalServerError)
+			return
+		}
+		if linked {
+			unlock()
+			h.release(r.Context(), key, replaced)
+			w.Header().Set("ETag", etag(&blob))
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		if r.ContentLength == 0 && claimed != emptyHash {
+			// the client hoped to link and sent no body
+			unlock()
+			http.Error(w, "content not stored, send the body", http.StatusPreconditionFailed)
+			return
+		}
+	}
+
+	since := h.hashLocks.Generation()
+	hashes, sent, size, err := h.fanOut(r.Context(), targetVolumes, "", metaHeader(key, contentType, meta), r.Body, r.ContentLength)
 	if err != nil {
+		h.discard(r.Context(), key, claimed, targetVolumes, hashes, unlock)
 		http.Error(w, "failed to read body", http.StatusInternalServerError)
 		return
 	}
 
-	// use consistent hashing to pick volumes
-	targetVolumes := h.ring.GetNodes(key, h.replicas)
-	if len(targetVolumes) == 0 {
-		http.Error(w, "no volumes available", http.StatusServiceUnavailable)
+	// every volume hashes what it got. the ones that stored what we sent
+	// count towards the quorum.
+	blob := db.Blob{Key: key, Hash: claimed, Size: size, ContentType: contentType, Meta: meta}
+	if err := h.commit(r.Context(), &blob, targetVolumes, hashes, sent, since, unlock); err != nil {
+		var we *writeError
+		errors.As(err, &we)
+		http.Error(w, we.msg, we.status)
 		return
 	}
+	w.Header().Set("ETag", etag(&blob))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// blob_header names the user key a volume request is for, so the volume can
+// journal it
+func blobHeader(key string) http.Header {
+	header := make(http.Header)
+	header.Set(keyHeader, url.PathEscape(key))
+	return header
+}
 
-	var blobURLs []string
-	var mu sync.Mutex
+// fan_out streams body to {volume url}{path} on every volume in parallel.
+// it returns each volume's response body in volume order, with "" for the
+// ones that failed, the sha256 of body and the number of bytes read from
+// it. the volumes answer with the hash of what they stored, which only
+// counts if it is the hash of what we sent. the error is only set if
+// reading body itself failed.
+func (h *Handler) fanOut(ctx context.Context, volumes []string, path string, header http.Header, body io.Reader, size int64) ([]string, string, int64, error) {
+	results := make([]string, len(volumes))
 	var wg sync.WaitGroup
-	errChan := make(chan error, len(targetVolumes))
 
-	// write to all replicas in parallel
-	for _, vol := range targetVolumes {
+	// each replica reads from its own pipe. the pipes are unbuffered, so a
+	// write only returns once every replica has consumed the chunk. a slow
+	// volume slows the upload down instead of making us buffer the body.
+	pipes := make([]*io.PipeWriter, len(volumes))
+	writers := make([]io.Writer, len(volumes))
+
+	errs := make([]error, len(volumes))
+
+	for i, vol := range volumes {
+		pr, pw := io.Pipe()
+		pipes[i] = pw
+		writers[i] = pw
+
 		wg.Add(1)
-		go func(v string) {
+		go func(i int, vol, u string, body *io.PipeReader) {
 			defer wg.Done()
 
-			// we PUT to the volume root, and it returns the hash
-			req, err := http.NewRequest(http.MethodPut, v, strings.NewReader(string(bodyBytes)))
-			if err != nil {
-				errChan <- err
-				return
-			}
-			req.ContentLength = int64(len(bodyBytes))
-
-			resp, err := h.client.Do(req)
+			ctx, span := trace.Start(ctx, "write replica", trace.KindInternal)
+			span.Set("volume", vol)
+			start := time.Now()
+			res, err := h.putStream(ctx, u, header, body, size)
+			observeReplicaWrite(vol, start, err)
+			span.Fail(err)
+			span.End()
 			if err != nil {
-				errChan <- err
+				// unblock the writer side so the fan-out fails fast
+				body.CloseWithError(err)
+				errs[i] = err
 				return
 			}
-			defer resp.Body.Close()
+			// drain whatever the volume didn't read so the other
+			// replicas aren't stalled behind us
+			io.Copy(io.Discard, body)
+			results[i] = res
+		}(i, vol, h.cluster.URL(vol)+path, pr)
+	}
 
-			if resp.StatusCode >= 300 {
-				errChan <- fmt.Errorf("upstream error: %d", resp.StatusCode)
-				return
-			}
+	sum := sha256.New()
+	n, copyErr := io.Copy(&fanWriter{writers: writers}, io.TeeReader(body, sum))
+	if copyErr == errAllReplicasFailed {
+		// nothing wrong with the body, the replicas report their own errors
+		copyErr = nil
+	}
+	for _, pw := range pipes {
+		if copyErr != nil {
+			pw.CloseWithError(copyErr)
+		} else {
+			pw.Close()
+		}
+	}
+	wg.Wait()
 
-			// read hash from response body
-			hashBytes, err := io.ReadAll(resp.Body)
+	if copyErr == nil {
+		// the body was fine, so the failures are the volumes' own
+		for i, err := range errs {
 			if err != nil {
-				errChan <- err
-				return
-			}
-			hash := string(hashBytes)
-			if len(hash) < 4 {
-				errChan <- fmt.Errorf("invalid hash")
-				return
+				h.volumeFailed(volumes[i], err)
 			}
+		}
+	}
 
-			// construct blob URL
-			// volume stores as /ab/cd/hash
-			u := fmt.Sprintf("%s/%s/%s/%s", v, hash[:2], hash[2:4], hash)
+	return results, hex.EncodeToString(sum.Sum(nil)), n, copyErr
+}
 
-			mu.Lock()
-			blobURLs = append(blobURLs, u)
-			mu.Unlock()
-		}(vol)
+// volume_failed tells the registry about a failed request to a volume.
+// volumes that answered with a client error are still reachable.
+func (h *Handler) volumeFailed(vol string, err error) {
+	var se *statusError
+	if errors.As(err, &se) && se.code < 500 {
+		return
 	}
+	h.cluster.Fail(vol, err)
+}
 
-	wg.Wait()
-	close(errChan)
+// status_error is a volume answering with an error status
+type statusError struct {
+	code int
+}
 
-	// check for errors
-	// for strict consistency, if any fail, we might want to fail the whole thing.
-	// but for now, let's say if we wrote to at least 1, we are okay?
+func (e *statusError) Error() string {
+	return fmt.Sprintf("upstream error: %d", e.code)
+}
 
-	if len(blobURLs) != len(targetVolumes) {
-		// some failed
-		// rollback in the future
-		http.Error(w, "failed to write to all replicas", http.StatusBadGateway)
-		return
+var errAllReplicasFailed = errors.New("all replicas failed")
+
+// fan_writer writes to every writer, dropping the ones that fail so one
+// dead replica doesn't stop the others
+type fanWriter struct {
+	writers []io.Writer
+}
+
+func (f *fanWriter) Write(p []byte) (int, error) {
+	live := f.writers[:0]
+	for _, w := range f.writers {
+		if _, err := w.Write(p); err == nil {
+			live = append(live, w)
+		}
+	}
+	f.writers = live
+	if len(live) == 0 {
+		return 0, errAllReplicasFailed
 	}
+	return len(p), nil
+}
 
-	// success, update db
-	if err := h.store.PutBlob(key, blobURLs); err != nil {
-		http.Error(w, "failed to update index", http.StatusInternalServerError)
-		return
+// put_stream PUTs body to url and returns the response body
+func (h *Handler) putStream(ctx context.Context, url string, header http.Header, body io.Reader, size int64) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, body)
+	if err != nil {
+		return "", err
+	}
+	req.Header = header.Clone()
+	if size > 0 {
+		req.ContentLength = size
 	}
 
-	w.WriteHeader(http.StatusCreated)
+	resp, err := h.streamClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return "", &statusError{resp.StatusCode}
+	}
+
+	// volumes answer with the hash of what they stored
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
 }
 
 // delete_blob handles DELETE requests
@@ -160,33 +404,72 @@ func (h *Handler) DeleteBlob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	volumeIDs, err := h.store.GetBlob(key)
+	blob, replicas, unlock, err := h.lockedLookup(key)
 	if err != nil {
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
-	if len(volumeIDs) == 0 {
+	if blob == nil {
 		http.NotFound(w, r)
 		return
 	}
-
-	// delete from all replicas
-	var wg sync.WaitGroup
-	for _, url := range volumeIDs {
-		wg.Add(1)
-		go func(u string) {
-			defer wg.Done()
-			req, _ := http.NewRequest(http.MethodDelete, u, nil)
-			h.client.Do(req)
-		}(url)
-	}
-	wg.Wait()
+	defer unlock()
 
 	// remove from db
-	if err := h.store.DeleteBlob(key); err != nil {
+	remaining, err := h.store.DeleteBlob(key)
+	if err != nil {
 		http.Error(w, "failed to update index", http.StatusInternalServerError)
 		return
 	}
 
+	if remaining > 0 {
+		// other keys still point at the content, so it stays. the
+		// volumes only need to know this key is gone.
+		h.appendJournal(r.Context(), replicas, journal.Record{Op: journal.OpDelete, Key: key, Hash: blob.Hash})
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// last reference, delete from all replicas
+	vols := make([]string, len(replicas))
+	for i, rep := range replicas {
+		vols[i] = rep.VolumeID
+	}
+	h.purge(r.Context(), key, blob.Hash, vols)
+
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// locked_lookup is lookup under the lock of the content key points at. a
+// write may move key to other content before the lock is taken, so it
+// looks again until key stays put. unlock is nil if key isn't there.
+func (h *Handler) lockedLookup(key string) (*db.Blob, []db.Replica, func(), error) {
+	for {
+		blob, err := h.store.GetBlob(key)
+		if err != nil || blob == nil {
+			return nil, nil, nil, err
+		}
+		unlock := h.hashLocks.Lock(blob.Hash)
+		again, replicas, err := h.lookup(key)
+		if err == nil && again != nil && again.Hash == blob.Hash {
+			return again, replicas, unlock, nil
+		}
+		unlock()
+		if err != nil || again == nil {
+			return nil, nil, nil, err
+		}
+	}
+}
+
+// lookup returns what key points at and where its content lives
+func (h *Handler) lookup(key string) (*db.Blob, []db.Replica, error) {
+	blob, err := h.store.GetBlob(key)
+	if err != nil || blob == nil {
+		return nil, nil, err
+	}
+	replicas, err := h.store.GetReplicas(blob.Hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	return blob, replicas, nil
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/afonp/microvault/internal/db"
+)
+
+// keys per page unless the client asks for fewer
+const maxListLimit = 1000
+
+type listResponse struct {
+	Prefix    string        `json:"prefix,omitempty"`
+	Delimiter string        `json:"delimiter,omitempty"`
+	Keys      []keyResponse `json:"keys"`
+	// common_prefixes are the rolled up keys when a delimiter is given
+	CommonPrefixes []string `json:"common_prefixes,omitempty"`
+	Truncated      bool     `json:"truncated"`
+	// next_start_after continues a truncated listing
+	NextStartAfter string `json:"next_start_after,omitempty"`
+}
+
+type keyResponse struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	Hash         string    `json:"hash"`
+	ContentType  string    `json:"content_type,omitempty"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// list_blobs handles GET /blob/?prefix=&start_after=&limit=&delimiter=
+// lists keys in order, a page at a time
+func (h *Handler) ListBlobs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	opts := db.ListOptions{
+		Prefix:     q.Get("prefix"),
+		StartAfter: q.Get("start_after"),
+		Delimiter:  q.Get("delimiter"),
+		Limit:      maxListLimit,
+	}
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		opts.Limit = min(n, maxListLimit)
+	}
+
+	l, err := h.store.List(opts)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := listResponse{
+		Prefix:         opts.Prefix,
+		Delimiter:      opts.Delimiter,
+		Keys:           []keyResponse{},
+		CommonPrefixes: l.Prefixes,
+		Truncated:      l.Next != "",
+		NextStartAfter: l.Next,
+	}
+	for _, b := range l.Blobs {
+		resp.Keys = append(resp.Keys, keyResponse{
+			Key:          b.Key,
+			Size:         b.Size,
+			Hash:         b.Hash,
+			ContentType:  b.ContentType,
+			LastModified: b.UpdatedAt.UTC(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/afonp/microvault/internal/db"
+	"github.com/afonp/microvault/internal/volume"
+)
+
+// the content type and the headers volume.Meta picks out are stored with a
+// key when it is written and sent back on reads: on the redirect, and in
+// full on HEAD, which the master answers itself.
+
+// request_meta returns the content type and metadata a write stores
+func requestMeta(r *http.Request) (string, map[string]string, error) {
+	meta := volume.Meta(r.Header)
+	if volume.MetaSize(meta) > volume.MaxMetaSize {
+		return "", nil, fmt.Errorf("metadata larger than %d bytes", volume.MaxMetaSize)
+	}
+	return r.Header.Get("Content-Type"), meta, nil
+}
+
+// meta_header is what volumes get told about a blob being written, so
+// their journals can restore it
+func metaHeader(key, contentType string, meta map[string]string) http.Header {
+	header := blobHeader(key)
+	volume.SetMeta(header, meta)
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	return header
+}
+
+// write_meta sets the stored headers of blob on a response
+func writeMeta(h http.Header, blob *db.Blob) {
+	volume.SetMeta(h, blob.Meta)
+	if blob.ContentType != "" {
+		h.Set("Content-Type", blob.ContentType)
+	}
+}
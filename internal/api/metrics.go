@@ -0,0 +1,19 @@
+package api
+
+import (
+	"time"
+
+	"github.com/afonp/microvault/internal/metrics"
+)
+
+var replicaWrites = metrics.NewHistogram("mv_replica_write_duration_seconds",
+	"time to stream a blob to one replica during a put", metrics.DefBuckets, "volume", "result")
+
+// observe_replica_write records how long writing to vol took
+func observeReplicaWrite(vol string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	replicaWrites.Observe(time.Since(start).Seconds(), vol, result)
+}
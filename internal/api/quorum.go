@@ -0,0 +1,212 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/afonp/microvault/internal/db"
+	"github.com/afonp/microvault/internal/journal"
+	"github.com/afonp/microvault/internal/volume"
+)
+
+// a put succeeds once writeQuorum volumes have the blob. the volumes that
+// missed it get a pending replica, which the repair loop fills in later.
+// a put that misses the quorum takes back whatever it wrote.
+//
+// a write holds at most one hash lock at a time: the lock of the content
+// it records. the client may name that content up front, and then its
+// lock is held for the whole write. otherwise it is only known once the
+// volumes have stored it, and a delete of the same content may have taken
+// the copies meanwhile, which the purge generation tells. content the
+// volumes stored instead is taken back once the lock is released.
+
+// write_error is a write that won't be recorded, and what to tell the
+// client
+type writeError struct {
+	status int
+	msg    string
+}
+
+func (e *writeError) Error() string {
+	return e.msg
+}
+
+// majority returns the hash most volumes agree on, or "" if none stored
+// anything
+func majority(hashes []string) string {
+	var best string
+	votes := make(map[string]int)
+	for _, hash := range hashes {
+		if !volume.ValidHash(hash) {
+			continue
+		}
+		votes[hash]++
+		if votes[hash] > votes[best] {
+			best = hash
+		}
+	}
+	return best
+}
+
+// commit records what volumes stored for blob.key, once enough of them
+// agree on it, and takes back whatever they shouldn't keep. hashes holds
+// what each volume stored, "" where it failed, sent is the hash of what
+// we streamed to them, "" if they built it themselves, and since is the
+// purge generation from before they were written. if the client named the
+// content, blob.hash is set and the caller holds its lock, which commit
+// releases with unlock. otherwise commit sets blob.hash to what was sent,
+// or to the majority.
+func (h *Handler) commit(ctx context.Context, blob *db.Blob, volumes, hashes []string, sent string, since uint64, unlock func()) error {
+	claimed := blob.Hash
+	if claimed == "" {
+		blob.Hash = sent
+		if blob.Hash == "" {
+			blob.Hash = majority(hashes)
+		}
+		if blob.Hash != "" {
+			unlock = h.hashLocks.Lock(blob.Hash)
+		}
+	}
+
+	var written, missed []string
+	stray := make([]string, len(hashes))
+	for i, vol := range volumes {
+		if blob.Hash != "" && hashes[i] == blob.Hash {
+			written = append(written, vol)
+		} else {
+			missed = append(missed, vol)
+			stray[i] = hashes[i]
+		}
+	}
+
+	var err error
+	switch {
+	case claimed != "" && sent != "" && sent != claimed:
+		err = &writeError{http.StatusBadRequest, "body does not match " + contentHashHeader}
+	case len(written) < h.opts.WriteQuorum:
+		err = &writeError{http.StatusBadGateway, fmt.Sprintf("wrote %d of %d replicas, need %d", len(written), len(volumes), h.opts.WriteQuorum)}
+	case claimed == "":
+		written, missed = h.recheck(ctx, blob.Hash, since, written, missed)
+		if len(written) < h.opts.WriteQuorum {
+			err = &writeError{http.StatusServiceUnavailable, "content was deleted while it was written, try again"}
+		}
+	}
+	if err != nil {
+		h.discard(ctx, blob.Key, blob.Hash, volumes, hashes, unlock)
+		return err
+	}
+
+	replaced, err := h.store.PutBlobHinted(*blob, written, missed)
+	unlock()
+	// volumes that stored something else keep none of it, and neither
+	// does the content the key pointed at before
+	h.rollback(ctx, blob.Key, volumes, stray, false)
+	h.release(ctx, blob.Key, replaced)
+	if err != nil {
+		return &writeError{http.StatusInternalServerError, "failed to update index"}
+	}
+	return nil
+}
+
+// discard takes back a write that won't be recorded. copies of hash, whose
+// lock unlock releases if the caller holds it, go first, and everything
+// else once the lock is released.
+func (h *Handler) discard(ctx context.Context, key, hash string, volumes, hashes []string, unlock func()) {
+	if unlock == nil {
+		h.rollback(ctx, key, volumes, hashes, false)
+		return
+	}
+	own := make([]string, len(hashes))
+	other := make([]string, len(hashes))
+	for i, got := range hashes {
+		if got == hash {
+			own[i] = got
+		} else {
+			other[i] = got
+		}
+	}
+	h.rollback(ctx, key, volumes, own, true)
+	unlock()
+	h.rollback(ctx, key, volumes, other, false)
+}
+
+// recheck is for writes that took the lock on their content only once the
+// volumes had it. if content was purged meanwhile, it may have been ours,
+// so it asks the volumes in written which still hold hash. the others join
+// missed, for the repair loop to fill in.
+func (h *Handler) recheck(ctx context.Context, hash string, since uint64, written, missed []string) ([]string, []string) {
+	if h.hashLocks.Generation() == since {
+		return written, missed
+	}
+	var kept []string
+	for _, vol := range written {
+		if h.holds(ctx, vol, hash) {
+			kept = append(kept, vol)
+		} else {
+			missed = append(missed, vol)
+		}
+	}
+	return kept, missed
+}
+
+// holds reports whether vol has the content hash
+func (h *Handler) holds(ctx context.Context, vol, hash string) bool {
+	u := volume.SignURL(volume.URL(h.cluster.URL(vol), hash), h.opts.URLSecret, h.opts.URLExpiry)
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// rollback undoes a failed write of key. hashes holds what each volume
+// stored, "" where it stored nothing. content another key already has on
+// a volume stays; only the journal hears that key didn't make it. locked
+// says the caller holds the lock of every hash in hashes.
+func (h *Handler) rollback(ctx context.Context, key string, volumes, hashes []string, locked bool) {
+	var wg sync.WaitGroup
+	for i, hash := range hashes {
+		if !volume.ValidHash(hash) {
+			continue
+		}
+		wg.Add(1)
+		go func(vol, hash string) {
+			defer wg.Done()
+			if !locked {
+				unlock := h.hashLocks.Lock(hash)
+				defer unlock()
+			}
+			h.rollbackOne(ctx, key, vol, hash)
+		}(volumes[i], hash)
+	}
+	wg.Wait()
+}
+
+// rollback_one takes back what key left on vol. callers hold the hash's
+// lock.
+func (h *Handler) rollbackOne(ctx context.Context, key, vol, hash string) {
+	replicas, err := h.store.GetReplicas(hash)
+	if err != nil {
+		// can't tell if anyone else needs it, so leave it for compact
+		return
+	}
+	for _, rep := range replicas {
+		if rep.VolumeID != vol {
+			continue
+		}
+		// the volume already had this content. the journal only needs
+		// fixing if key didn't point at it before.
+		if blob, err := h.store.GetBlob(key); err == nil && (blob == nil || blob.Hash != hash) {
+			h.appendJournal(ctx, []db.Replica{rep}, journal.Record{Op: journal.OpDelete, Key: key, Hash: hash})
+		}
+		return
+	}
+	h.purge(ctx, key, hash, []string{vol})
+}
@@ -0,0 +1,297 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/afonp/microvault/internal/cluster"
+	"github.com/afonp/microvault/internal/db"
+	"github.com/afonp/microvault/internal/repair"
+)
+
+// how a fake volume answers writes
+const (
+	volumeOK = "ok"
+	// fail answers 500 without storing anything
+	volumeFail = "fail"
+	// corrupt stores something other than what it was sent
+	volumeCorrupt = "corrupt"
+)
+
+// fake_volume keeps blobs in memory
+type fakeVolume struct {
+	mode  string
+	mu    sync.Mutex
+	blobs map[string]bool
+}
+
+func (v *fakeVolume) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/_journal":
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		switch v.mode {
+		case volumeFail:
+			http.Error(w, "disk on fire", http.StatusInternalServerError)
+			return
+		case volumeCorrupt:
+			body = append(body, 'x')
+		}
+		hash := sha256Hex(body)
+		v.blobs[hash] = true
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, hash)
+	case r.Method == http.MethodHead:
+		if !v.blobs[filepath.Base(r.URL.Path)] {
+			http.NotFound(w, r)
+		}
+	case r.Method == http.MethodDelete:
+		delete(v.blobs, filepath.Base(r.URL.Path))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (v *fakeVolume) stored() []string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var hashes []string
+	for hash := range v.blobs {
+		hashes = append(hashes, hash)
+	}
+	slices.Sort(hashes)
+	return hashes
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// new_test_handler runs an api over a volume in each mode, writing every
+// key to all of them
+func newTestHandler(t *testing.T, quorum int, modes ...string) (*Handler, *db.Store, []*fakeVolume, []string) {
+	t.Helper()
+	store, err := db.NewStore(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	registry, err := cluster.NewRegistry(store, cluster.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vols []*fakeVolume
+	var urls []string
+	for _, mode := range modes {
+		v := &fakeVolume{mode: mode, blobs: make(map[string]bool)}
+		srv := httptest.NewServer(v)
+		t.Cleanup(srv.Close)
+		registry.AddStatic(srv.URL)
+		vols = append(vols, v)
+		urls = append(urls, srv.URL)
+	}
+
+	repairer := repair.New(store, registry, len(modes), repair.Options{})
+	h := NewHandler(store, registry, repairer, Options{Replicas: len(modes), WriteQuorum: quorum})
+	return h, store, vols, urls
+}
+
+func put(h *Handler, key, body string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPut, "/blob/"+key, strings.NewReader(body))
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	h.PutBlob(w, r)
+	return w
+}
+
+func TestMajority(t *testing.T) {
+	a, b := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	tests := []struct {
+		name   string
+		hashes []string
+		want   string
+	}{
+		{"none", nil, ""},
+		{"all failed", []string{"", "", ""}, ""},
+		{"all agree", []string{a, a, a}, a},
+		{"one failed", []string{a, "", a}, a},
+		{"outvoted", []string{b, a, a}, a},
+		{"not a hash", []string{"oops", "oops", a}, a},
+		{"tie goes to the first", []string{b, a}, b},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := majority(tt.hashes); got != tt.want {
+				t.Errorf("majority(%v) = %q, want %q", tt.hashes, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPutQuorum(t *testing.T) {
+	const body = "hello world"
+	hash := sha256Hex([]byte(body))
+	other := sha256Hex([]byte("something else"))
+
+	tests := []struct {
+		name   string
+		quorum int
+		modes  []string
+		// claim is the content hash the client names, if any
+		claim  string
+		status int
+		// states is the state of the copy recorded on each volume, "" for
+		// none
+		states []string
+	}{
+		{
+			name: "all written", quorum: 2,
+			modes:  []string{volumeOK, volumeOK, volumeOK},
+			status: http.StatusCreated,
+			states: []string{db.ReplicaOK, db.ReplicaOK, db.ReplicaOK},
+		},
+		{
+			name: "one failed", quorum: 2,
+			modes:  []string{volumeOK, volumeFail, volumeOK},
+			status: http.StatusCreated,
+			states: []string{db.ReplicaOK, db.ReplicaPending, db.ReplicaOK},
+		},
+		{
+			name: "one stored something else", quorum: 2,
+			modes:  []string{volumeCorrupt, volumeOK, volumeOK},
+			status: http.StatusCreated,
+			states: []string{db.ReplicaPending, db.ReplicaOK, db.ReplicaOK},
+		},
+		{
+			name: "outvoted by what was sent", quorum: 1,
+			modes:  []string{volumeCorrupt, volumeCorrupt, volumeOK},
+			status: http.StatusCreated,
+			states: []string{db.ReplicaPending, db.ReplicaPending, db.ReplicaOK},
+		},
+		{
+			name: "quorum missed", quorum: 2,
+			modes:  []string{volumeOK, volumeFail, volumeFail},
+			status: http.StatusBadGateway,
+			states: []string{"", "", ""},
+		},
+		{
+			name: "quorum missed by bad copies", quorum: 2,
+			modes:  []string{volumeCorrupt, volumeOK, volumeCorrupt},
+			status: http.StatusBadGateway,
+			states: []string{"", "", ""},
+		},
+		{
+			name: "every copy needed", quorum: 3,
+			modes:  []string{volumeOK, volumeOK, volumeFail},
+			status: http.StatusBadGateway,
+			states: []string{"", "", ""},
+		},
+		{
+			name: "claimed content", quorum: 2,
+			modes:  []string{volumeOK, volumeOK, volumeFail},
+			claim:  hash,
+			status: http.StatusCreated,
+			states: []string{db.ReplicaOK, db.ReplicaOK, db.ReplicaPending},
+		},
+		{
+			name: "claim doesn't match the body", quorum: 2,
+			modes:  []string{volumeOK, volumeOK, volumeOK},
+			claim:  other,
+			status: http.StatusBadRequest,
+			states: []string{"", "", ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, store, vols, urls := newTestHandler(t, tt.quorum, tt.modes...)
+			header := make(http.Header)
+			if tt.claim != "" {
+				header.Set(contentHashHeader, tt.claim)
+			}
+
+			w := put(h, "k", body, header)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			replicas, err := store.GetReplicas(hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, url := range urls {
+				var state string
+				for _, rep := range replicas {
+					if rep.VolumeID == url {
+						state = rep.State
+					}
+				}
+				if state != tt.states[i] {
+					t.Errorf("volume %d: copy is %q, want %q", i, state, tt.states[i])
+				}
+			}
+
+			blob, err := store.GetBlob("k")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (blob != nil) != (tt.status == http.StatusCreated) {
+				t.Fatalf("blob = %+v after %d", blob, tt.status)
+			}
+
+			// volumes keep what the index says they have and nothing else
+			for i, v := range vols {
+				var want []string
+				if tt.states[i] == db.ReplicaOK {
+					want = []string{hash}
+				}
+				if got := v.stored(); !slices.Equal(got, want) {
+					t.Errorf("volume %d holds %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+// a rolled back write leaves content another key already has in place
+func TestRollbackKeepsSharedContent(t *testing.T) {
+	h, store, vols, _ := newTestHandler(t, 2, volumeOK, volumeOK)
+	if w := put(h, "first", "shared", nil); w.Code != http.StatusCreated {
+		t.Fatalf("first put: %d %s", w.Code, w.Body)
+	}
+
+	// the same content again, but now the second volume fails
+	vols[1].mode = volumeFail
+	if w := put(h, "second", "shared", nil); w.Code != http.StatusBadGateway {
+		t.Fatalf("second put: %d %s, want 502", w.Code, w.Body)
+	}
+
+	hash := sha256Hex([]byte("shared"))
+	for i, v := range vols {
+		if got := v.stored(); !slices.Equal(got, []string{hash}) {
+			t.Errorf("volume %d holds %v, want the shared content", i, got)
+		}
+	}
+	if b, _ := store.GetBlob("second"); b != nil {
+		t.Errorf("second key recorded: %+v", b)
+	}
+	if b, _ := store.GetBlob("first"); b == nil || b.Hash != hash {
+		t.Errorf("first key = %+v", b)
+	}
+}
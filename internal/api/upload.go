@@ -0,0 +1,354 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/afonp/microvault/internal/db"
+	"github.com/afonp/microvault/internal/logging"
+	"github.com/afonp/microvault/internal/volume"
+)
+
+// multipart uploads let clients send a large blob in pieces and retry only
+// the pieces that failed. parts live on the volumes picked for the key when
+// the upload starts, and the volumes stitch them together on completion.
+
+const maxPartNumber = 10000
+
+type uploadResponse struct {
+	Key      string `json:"key"`
+	UploadID string `json:"upload_id"`
+}
+
+type partResponse struct {
+	Number int    `json:"number"`
+	Size   int64  `json:"size"`
+	ETag   string `json:"etag"`
+}
+
+type listPartsResponse struct {
+	Key      string         `json:"key"`
+	UploadID string         `json:"upload_id"`
+	Parts    []partResponse `json:"parts"`
+}
+
+// create_upload handles POST /blob/{key}?uploads
+func (h *Handler) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/blob/")
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+
+	targetVolumes := h.cluster.Ring().GetNodes(key, h.opts.Replicas)
+	if len(targetVolumes) == 0 {
+		http.Error(w, "no volumes available", http.StatusServiceUnavailable)
+		return
+	}
+
+	contentType, meta, err := requestMeta(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	upload := db.Upload{ID: id, Key: key, VolumeIDs: targetVolumes, ContentType: contentType, Meta: meta}
+	if err := h.store.CreateUpload(upload); err != nil {
+		http.Error(w, "failed to update index", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(uploadResponse{Key: key, UploadID: id})
+}
+
+// upload_part handles PUT /blob/{key}?partNumber=N&uploadId=X
+// streams the part to every volume of the upload
+func (h *Handler) UploadPart(w http.ResponseWriter, r *http.Request) {
+	upload, ok := h.lookupUpload(w, r)
+	if !ok {
+		return
+	}
+
+	number, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || number < 1 || number > maxPartNumber {
+		http.Error(w, "invalid part number", http.StatusBadRequest)
+		return
+	}
+
+	path := fmt.Sprintf("/_uploads/%s/%d", upload.ID, number)
+	hashes, etag, size, err := h.fanOut(r.Context(), upload.VolumeIDs, path, make(http.Header), r.Body, r.ContentLength)
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusInternalServerError)
+		return
+	}
+
+	// every volume hashes the part, and they have to have stored what we
+	// sent
+	for _, hash := range hashes {
+		if hash != etag {
+			http.Error(w, "failed to write part to all replicas", http.StatusBadGateway)
+			return
+		}
+	}
+
+	if err := h.store.PutPart(upload.ID, db.Part{Number: number, Size: size, ETag: etag}); err != nil {
+		http.Error(w, "failed to update index", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+// list_parts handles GET /blob/{key}?uploadId=X
+// tells a client which parts made it so it can resume
+func (h *Handler) ListParts(w http.ResponseWriter, r *http.Request) {
+	upload, ok := h.lookupUpload(w, r)
+	if !ok {
+		return
+	}
+
+	parts, err := h.store.ListParts(upload.ID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := listPartsResponse{Key: upload.Key, UploadID: upload.ID, Parts: []partResponse{}}
+	for _, p := range parts {
+		resp.Parts = append(resp.Parts, partResponse{Number: p.Number, Size: p.Size, ETag: p.ETag})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// complete_upload handles POST /blob/{key}?uploadId=X
+// the body is an optional JSON list of part numbers. without it, every
+// recorded part is used in order.
+func (h *Handler) CompleteUpload(w http.ResponseWriter, r *http.Request) {
+	upload, ok := h.lookupUpload(w, r)
+	if !ok {
+		return
+	}
+
+	parts, err := h.store.ListParts(upload.ID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	recorded := make(map[int]int64) // part number -> size
+	var numbers []int
+	for _, p := range parts {
+		recorded[p.Number] = p.Size
+		numbers = append(numbers, p.Number)
+	}
+
+	var requested []int
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&requested); err != nil && err != io.EOF {
+		http.Error(w, "invalid part list", http.StatusBadRequest)
+		return
+	}
+	if len(requested) > 0 {
+		for i, n := range requested {
+			if _, ok := recorded[n]; !ok {
+				http.Error(w, fmt.Sprintf("part %d was not uploaded", n), http.StatusBadRequest)
+				return
+			}
+			if i > 0 && n <= requested[i-1] {
+				http.Error(w, "parts must be in ascending order", http.StatusBadRequest)
+				return
+			}
+		}
+		numbers = requested
+	}
+	if len(numbers) == 0 {
+		http.Error(w, "no parts uploaded", http.StatusBadRequest)
+		return
+	}
+
+	body, _ := json.Marshal(numbers)
+	header := metaHeader(upload.Key, "", upload.Meta)
+	if upload.ContentType != "" {
+		header.Set(volume.ContentTypeHeader, upload.ContentType)
+	}
+
+	// stitch the parts on every volume in parallel. the volumes keep the
+	// parts until we drop them, so a completion that fails can be retried.
+	since := h.hashLocks.Generation()
+	hashes := make([]string, len(upload.VolumeIDs))
+	var wg sync.WaitGroup
+	for i, vol := range upload.VolumeIDs {
+		wg.Add(1)
+		go func(i int, v string) {
+			defer wg.Done()
+			hash, err := h.postStream(r.Context(), fmt.Sprintf("%s/_uploads/%s", h.cluster.URL(v), upload.ID), header.Clone(), body)
+			if err == nil {
+				hashes[i] = hash
+			} else {
+				h.volumeFailed(v, err)
+			}
+		}(i, vol)
+	}
+	wg.Wait()
+
+	var size int64
+	for _, n := range numbers {
+		size += recorded[n]
+	}
+
+	// the stitched blob is recorded like any put: with a quorum, hints
+	// for the volumes that missed it, and rollback if it falls short
+	blob := db.Blob{Key: upload.Key, Size: size, ContentType: upload.ContentType, Meta: upload.Meta}
+	if err := h.commit(r.Context(), &blob, upload.VolumeIDs, hashes, "", since, nil); err != nil {
+		var we *writeError
+		errors.As(err, &we)
+		http.Error(w, we.msg, we.status)
+		return
+	}
+	if err := h.store.DeleteUpload(upload.ID); err != nil {
+		http.Error(w, "failed to update index", http.StatusInternalServerError)
+		return
+	}
+	h.dropParts(r.Context(), upload)
+
+	w.Header().Set("ETag", `"`+blob.Hash+`"`)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// abort_upload handles DELETE /blob/{key}?uploadId=X
+func (h *Handler) AbortUpload(w http.ResponseWriter, r *http.Request) {
+	upload, ok := h.lookupUpload(w, r)
+	if !ok {
+		return
+	}
+
+	h.dropParts(r.Context(), upload)
+	if err := h.store.DeleteUpload(upload.ID); err != nil {
+		http.Error(w, "failed to update index", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// drop_parts deletes the parts of an upload from all its volumes
+func (h *Handler) dropParts(ctx context.Context, upload *db.Upload) {
+	var wg sync.WaitGroup
+	for _, vol := range upload.VolumeIDs {
+		wg.Add(1)
+		go func(v string) {
+			defer wg.Done()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodDelete, fmt.Sprintf("%s/_uploads/%s", h.cluster.URL(v), upload.ID), nil)
+			resp, err := h.client.Do(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+		}(vol)
+	}
+	wg.Wait()
+}
+
+// expire_uploads aborts uploads started more than ttl ago, every hour or
+// every ttl if that is shorter, so parts clients gave up on don't stay on
+// the volumes forever
+func (h *Handler) ExpireUploads(ttl time.Duration) {
+	for {
+		time.Sleep(min(ttl, time.Hour))
+
+		ctx := logging.WithRequestID(context.Background(), logging.NewRequestID())
+		log := logging.FromContext(ctx)
+		ids, err := h.store.StaleUploads(time.Now().Add(-ttl))
+		if err != nil {
+			log.Error("failed to list stale uploads", "err", err)
+			continue
+		}
+		for _, id := range ids {
+			upload, err := h.store.GetUpload(id)
+			if err != nil || upload == nil {
+				continue
+			}
+			h.dropParts(ctx, upload)
+			if err := h.store.DeleteUpload(id); err != nil {
+				log.Error("failed to expire upload", "upload", id, "err", err)
+				continue
+			}
+			log.Info("expired upload", "upload", id, "key", upload.Key, "started", upload.CreatedAt)
+		}
+	}
+}
+
+// lookup_upload resolves the uploadId of a request and checks it belongs
+// to the key in the path. it writes the error response itself.
+func (h *Handler) lookupUpload(w http.ResponseWriter, r *http.Request) (*db.Upload, bool) {
+	key := strings.TrimPrefix(r.URL.Path, "/blob/")
+	id := r.URL.Query().Get("uploadId")
+	if key == "" || id == "" {
+		http.Error(w, "missing key or upload id", http.StatusBadRequest)
+		return nil, false
+	}
+
+	upload, err := h.store.GetUpload(id)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if upload == nil || upload.Key != key {
+		http.Error(w, "no such upload", http.StatusNotFound)
+		return nil, false
+	}
+	return upload, true
+}
+
+// post_stream POSTs body to url and returns the response body. the volume
+// only answers once it has re-read every part, so there is no timeout.
+func (h *Handler) postStream(ctx context.Context, url string, header http.Header, body []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.stitchClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return "", &statusError{resp.StatusCode}
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func newUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
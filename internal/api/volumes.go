@@ -0,0 +1,155 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/afonp/microvault/internal/cluster"
+	"github.com/afonp/microvault/internal/db"
+	"github.com/afonp/microvault/internal/volume"
+)
+
+type volumeResponse struct {
+	ID            string    `json:"id"`
+	URL           string    `json:"url"`
+	Total         uint64    `json:"total"`
+	Free          uint64    `json:"free"`
+	Weight        float64   `json:"weight"`
+	ReadOnly      bool      `json:"read_only"`
+	Drain         string    `json:"drain,omitempty"`
+	Zone          string    `json:"zone,omitempty"`
+	Rack          string    `json:"rack,omitempty"`
+	Host          string    `json:"host,omitempty"`
+	State         string    `json:"state"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	Healthy       bool      `json:"healthy"`
+	// latency_ms is how long health checks take on average
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// heartbeat handles POST /_volumes/heartbeat
+// volumes register themselves and report their capacity here
+func (h *Handler) Heartbeat(w http.ResponseWriter, r *http.Request) {
+	if h.opts.VolumeSecret != "" {
+		if err := volume.Verify(r, h.opts.VolumeSecret); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var hb volume.Heartbeat
+	if err := json.NewDecoder(r.Body).Decode(&hb); err != nil {
+		http.Error(w, "invalid heartbeat", http.StatusBadRequest)
+		return
+	}
+	if hb.ID == "" || hb.URL == "" {
+		http.Error(w, "missing id or url", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.cluster.Heartbeat(hb); err != nil {
+		http.Error(w, "failed to update registry", http.StatusInternalServerError)
+		return
+	}
+
+	// the volume's scrubber pulled these, so the copies there are gone
+	for _, hash := range hb.Quarantined {
+		if err := h.store.SetReplicaState(hash, hb.ID, db.ReplicaCorrupt); err != nil {
+			http.Error(w, "failed to update index", http.StatusInternalServerError)
+			return
+		}
+		h.repair.Enqueue(hash)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// repair_status handles GET /_repair
+// shows how far the cluster is from every blob having all its replicas
+func (h *Handler) RepairStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.repair.Status())
+}
+
+// list_volumes handles GET /_volumes
+func (h *Handler) ListVolumes(w http.ResponseWriter, r *http.Request) {
+	resp := []volumeResponse{}
+	for _, v := range h.cluster.Volumes() {
+		health := h.cluster.Health(v.ID)
+		resp = append(resp, volumeResponse{
+			ID:            v.ID,
+			URL:           v.URL,
+			Total:         v.Total,
+			Free:          v.Free,
+			Weight:        v.Weight,
+			ReadOnly:      v.ReadOnly,
+			Drain:         v.Drain,
+			Zone:          v.Zone,
+			Rack:          v.Rack,
+			Host:          v.Host,
+			State:         v.State,
+			LastHeartbeat: v.LastHeartbeat,
+			Healthy:       h.cluster.Healthy(v.ID),
+			LatencyMS:     float64(health.Latency) / float64(time.Millisecond),
+			Error:         health.LastError,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// drain_status handles GET /_volumes/{id}/drain
+// shows how far moving every blob off the volume has got
+func (h *Handler) DrainStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := h.repair.DrainStatus(r.PathValue("id"))
+	if err != nil {
+		drainError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// start_drain handles POST /_volumes/{id}/drain
+// takes the volume out of the ring and moves every blob on it to the
+// volumes that own it now. posting again resumes a drain that stopped.
+func (h *Handler) StartDrain(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := h.repair.Drain(id); err != nil {
+		drainError(w, err)
+		return
+	}
+	status, err := h.repair.DrainStatus(id)
+	if err != nil {
+		drainError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(status)
+}
+
+// cancel_drain handles DELETE /_volumes/{id}/drain
+// puts the volume back in the ring. blobs already moved stay moved.
+func (h *Handler) CancelDrain(w http.ResponseWriter, r *http.Request) {
+	if err := h.repair.CancelDrain(r.PathValue("id")); err != nil {
+		drainError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func drainError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, cluster.ErrUnknownVolume):
+		http.Error(w, "unknown volume", http.StatusNotFound)
+	case errors.Is(err, cluster.ErrStaticVolume):
+		http.Error(w, "static volumes can't be drained", http.StatusConflict)
+	default:
+		http.Error(w, "failed to update registry", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// clients of the master identify themselves with a key: an id and a
+// secret. each key has policies granting permissions on the keys under a
+// prefix, e.g. read and write on "photos/". requests either carry the
+// secret as a bearer token or are signed with it (see sign.go). requests
+// that carry neither get the anonymous policies, if any.
+
+// permission is what a policy allows
+type Permission string
+
+const (
+	// read is GET and HEAD of blobs, and listing
+	Read Permission = "read"
+	// write is PUT of blobs, including multipart uploads
+	Write Permission = "write"
+	// delete is DELETE of blobs
+	Delete Permission = "delete"
+	// admin is the cluster's own endpoints, e.g. /_volumes
+	Admin Permission = "admin"
+)
+
+// policy grants permissions on every key starting with prefix
+type Policy struct {
+	Prefix      string       `json:"prefix"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// key is a client's credentials and what they may do
+type Key struct {
+	ID       string   `json:"id"`
+	Secret   string   `json:"secret"`
+	Policies []Policy `json:"policies"`
+}
+
+// config is the keys file
+type Config struct {
+	Keys []Key `json:"keys"`
+	// anonymous policies apply to every request, signed or not
+	Anonymous []Policy `json:"anonymous"`
+}
+
+var (
+	ErrUnknownKey = errors.New("unknown key")
+	ErrForbidden  = errors.New("access denied")
+)
+
+// keys checks requests against a config. a nil *keys lets everything
+// through, which is how the master runs without a keys file.
+type Keys struct {
+	byID      map[string]Key
+	anonymous []Policy
+}
+
+// new builds keys from a config
+func New(cfg Config) (*Keys, error) {
+	k := &Keys{byID: make(map[string]Key), anonymous: cfg.Anonymous}
+	for _, p := range cfg.Anonymous {
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("anonymous: %v", err)
+		}
+	}
+	for _, key := range cfg.Keys {
+		if err := k.Add(key); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// load reads a keys file
+func Load(path string) (*Keys, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return New(cfg)
+}
+
+// clone returns a copy of k that keys can be added to without changing k.
+// the copy of nil is nil.
+func (k *Keys) Clone() *Keys {
+	if k == nil {
+		return nil
+	}
+	c := &Keys{byID: make(map[string]Key, len(k.byID)), anonymous: k.anonymous}
+	for id, key := range k.byID {
+		c.byID[id] = key
+	}
+	return c
+}
+
+// add adds a key
+func (k *Keys) Add(key Key) error {
+	if key.ID == "" || key.Secret == "" {
+		return fmt.Errorf("key %q: missing id or secret", key.ID)
+	}
+	if strings.ContainsAny(key.ID, ":, ") {
+		return fmt.Errorf("key %q: id can't contain ':', ',' or spaces", key.ID)
+	}
+	if _, ok := k.byID[key.ID]; ok {
+		return fmt.Errorf("key %q: defined twice", key.ID)
+	}
+	for _, p := range key.Policies {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("key %q: %v", key.ID, err)
+		}
+	}
+	k.byID[key.ID] = key
+	return nil
+}
+
+func (p Policy) validate() error {
+	for _, perm := range p.Permissions {
+		switch perm {
+		case Read, Write, Delete, Admin:
+		default:
+			return fmt.Errorf("unknown permission %q", perm)
+		}
+	}
+	return nil
+}
+
+// secret returns the secret of the key with the given id
+func (k *Keys) Secret(id string) (string, bool) {
+	key, ok := k.byID[id]
+	return key.Secret, ok
+}
+
+// allowed reports whether the key with the given id ("" for anonymous) may
+// do perm on resource. for listings the resource is the listed prefix, so
+// a policy has to cover all of it.
+func (k *Keys) Allowed(id string, perm Permission, resource string) bool {
+	if k == nil {
+		return true
+	}
+	if grants(k.anonymous, perm, resource) {
+		return true
+	}
+	key, ok := k.byID[id]
+	return ok && grants(key.Policies, perm, resource)
+}
+
+func grants(policies []Policy, perm Permission, resource string) bool {
+	for _, p := range policies {
+		if !strings.HasPrefix(resource, p.Prefix) {
+			continue
+		}
+		for _, allowed := range p.Permissions {
+			if allowed == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// check authenticates r and makes sure it may do perm on resource. if not,
+// it writes the error response itself: 401 when the request isn't signed
+// by a known key, 403 when the key isn't allowed.
+func (k *Keys) Check(w http.ResponseWriter, r *http.Request, perm Permission, resource string) bool {
+	_, ok := k.Authorize(w, r, perm, resource)
+	return ok
+}
+
+// authorize is check for handlers that decide more by who asked. it
+// returns r carrying its caller, for may.
+func (k *Keys) Authorize(w http.ResponseWriter, r *http.Request, perm Permission, resource string) (*http.Request, bool) {
+	if k == nil {
+		return r.WithContext(WithCaller(r.Context(), nil, "")), true
+	}
+	id, err := k.Authenticate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return r, false
+	}
+	if !k.Allowed(id, perm, resource) {
+		if id == "" {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+		} else {
+			http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+		}
+		return r, false
+	}
+	return r.WithContext(WithCaller(r.Context(), k, id)), true
+}
+
+type callerKey struct{}
+
+// caller is who made a request: a key id, "" for anonymous, and the keys
+// it was checked against
+type caller struct {
+	keys *Keys
+	id   string
+}
+
+// with_caller returns ctx carrying the key id a request was made with
+func WithCaller(ctx context.Context, keys *Keys, id string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller{keys: keys, id: id})
+}
+
+// may reports whether the caller in ctx may do perm on resource. a context
+// without a caller may do nothing.
+func May(ctx context.Context, perm Permission, resource string) bool {
+	c, ok := ctx.Value(callerKey{}).(caller)
+	return ok && c.keys.Allowed(c.id, perm, resource)
+}
+
+// check_signed is check for requests any known key may make
+func (k *Keys) CheckSigned(w http.ResponseWriter, r *http.Request) bool {
+	if k == nil {
+		return true
+	}
+	id, err := k.Authenticate(r)
+	if err == nil && id == "" {
+		err = errors.New("authentication required")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
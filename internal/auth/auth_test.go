@@ -0,0 +1,299 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "s3cr3t"
+
+func testKeys(t *testing.T) *Keys {
+	t.Helper()
+	k, err := New(Config{
+		Keys: []Key{
+			{ID: "alice", Secret: testSecret, Policies: []Policy{
+				{Prefix: "photos/", Permissions: []Permission{Read, Write}},
+				{Prefix: "photos/tmp/", Permissions: []Permission{Delete}},
+			}},
+			{ID: "root", Secret: "root-secret", Policies: []Policy{
+				{Prefix: "", Permissions: []Permission{Read, Write, Delete, Admin}},
+			}},
+		},
+		Anonymous: []Policy{{Prefix: "public/", Permissions: []Permission{Read}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		ok   bool
+	}{
+		{"empty", Config{}, true},
+		{"one key", Config{Keys: []Key{{ID: "a", Secret: "s"}}}, true},
+		{"no id", Config{Keys: []Key{{Secret: "s"}}}, false},
+		{"no secret", Config{Keys: []Key{{ID: "a"}}}, false},
+		{"colon in id", Config{Keys: []Key{{ID: "a:b", Secret: "s"}}}, false},
+		{"id twice", Config{Keys: []Key{{ID: "a", Secret: "s"}, {ID: "a", Secret: "t"}}}, false},
+		{"unknown permission", Config{Keys: []Key{{ID: "a", Secret: "s", Policies: []Policy{{Permissions: []Permission{"own"}}}}}}, false},
+		{"unknown anonymous permission", Config{Anonymous: []Policy{{Permissions: []Permission{"own"}}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.cfg)
+			if (err == nil) != tt.ok {
+				t.Fatalf("err = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	k := testKeys(t)
+	tests := []struct {
+		id       string
+		perm     Permission
+		resource string
+		want     bool
+	}{
+		{"alice", Read, "photos/a.jpg", true},
+		{"alice", Write, "photos/a.jpg", true},
+		{"alice", Delete, "photos/a.jpg", false},
+		{"alice", Delete, "photos/tmp/a.jpg", true},
+		{"alice", Read, "videos/a.mp4", false},
+		// a listing of "photos" would show more than photos/
+		{"alice", Read, "photos", false},
+		{"alice", Admin, "", false},
+		{"alice", Read, "public/a", true},
+		{"", Read, "public/a", true},
+		{"", Write, "public/a", false},
+		{"", Read, "photos/a.jpg", false},
+		{"root", Admin, "", true},
+		{"root", Delete, "anything", true},
+		{"mallory", Read, "photos/a.jpg", false},
+	}
+	for _, tt := range tests {
+		if got := k.Allowed(tt.id, tt.perm, tt.resource); got != tt.want {
+			t.Errorf("allowed(%q, %s, %q) = %v, want %v", tt.id, tt.perm, tt.resource, got, tt.want)
+		}
+	}
+
+	var none *Keys
+	if !none.Allowed("", Admin, "") {
+		t.Error("nil keys denied a request")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	k := testKeys(t)
+
+	// resign signs r again as of date
+	resign := func(r *http.Request, date string) {
+		r.Header.Set(DateHeader, date)
+		r.Header.Set("Authorization", Scheme+" Credential=alice, Signature="+signature(r, testSecret, date))
+	}
+
+	tests := []struct {
+		name string
+		// before changes the request before it is signed, after once it is
+		before, after func(r *http.Request)
+		id            string
+		ok            bool
+	}{
+		{name: "signed", id: "alice", ok: true},
+		{
+			name:   "content hash",
+			before: func(r *http.Request) { r.Header.Set(contentHashHeader, strings.Repeat("a", 64)) },
+			id:     "alice", ok: true,
+		},
+		{name: "no credentials", after: func(r *http.Request) { r.Header.Del("Authorization") }, id: "", ok: true},
+		{name: "bearer", after: func(r *http.Request) { r.Header.Set("Authorization", "Bearer alice:"+testSecret) }, id: "alice", ok: true},
+		{name: "bearer with the wrong secret", after: func(r *http.Request) { r.Header.Set("Authorization", "Bearer alice:guess") }},
+		{name: "bearer with an unknown key", after: func(r *http.Request) { r.Header.Set("Authorization", "Bearer mallory:"+testSecret) }},
+		{name: "method changed", after: func(r *http.Request) { r.Method = http.MethodDelete }},
+		{name: "path changed", after: func(r *http.Request) { r.URL.Path = "/blob/photos/b.jpg" }},
+		{name: "query changed", after: func(r *http.Request) { r.URL.RawQuery = "list&prefix=" }},
+		{
+			name:   "content hash changed",
+			before: func(r *http.Request) { r.Header.Set(contentHashHeader, strings.Repeat("a", 64)) },
+			after:  func(r *http.Request) { r.Header.Set(contentHashHeader, strings.Repeat("b", 64)) },
+		},
+		{name: "date changed", after: func(r *http.Request) { r.Header.Set(DateHeader, time.Now().UTC().Add(time.Second).Format(dateFormat)) }},
+		{name: "no date", after: func(r *http.Request) { r.Header.Del(DateHeader) }},
+		{name: "too old", after: func(r *http.Request) { resign(r, time.Now().UTC().Add(-maxSkew-time.Minute).Format(dateFormat)) }},
+		{name: "too new", after: func(r *http.Request) { resign(r, time.Now().UTC().Add(maxSkew+time.Minute).Format(dateFormat)) }},
+		{name: "within the skew", after: func(r *http.Request) { resign(r, time.Now().UTC().Add(-maxSkew/2).Format(dateFormat)) }, id: "alice", ok: true},
+		{
+			name: "other key's credential",
+			after: func(r *http.Request) {
+				r.Header.Set("Authorization", strings.Replace(r.Header.Get("Authorization"), "alice", "root", 1))
+			},
+		},
+		{name: "malformed", after: func(r *http.Request) { r.Header.Set("Authorization", Scheme+" Credential") }},
+		{name: "unknown scheme", after: func(r *http.Request) { r.Header.Set("Authorization", "Basic YWxpY2U6cw==") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/blob/photos/a.jpg", nil)
+			if tt.before != nil {
+				tt.before(r)
+			}
+			Sign(r, "alice", testSecret)
+			if tt.after != nil {
+				tt.after(r)
+			}
+			id, err := k.Authenticate(r)
+			if (err == nil) != tt.ok {
+				t.Fatalf("err = %v, want ok %v", err, tt.ok)
+			}
+			if id != tt.id {
+				t.Errorf("id = %q, want %q", id, tt.id)
+			}
+		})
+	}
+}
+
+func TestPresigned(t *testing.T) {
+	k := testKeys(t)
+	const rawURL = "http://localhost:3000/blob/photos/a.jpg"
+
+	tests := []struct {
+		name   string
+		method string
+		ttl    time.Duration
+		// change is done to the presigned url before it is used
+		change func(u *url.URL)
+		// use is the method the url is used with, the signed one if empty
+		use string
+		ok  bool
+	}{
+		{name: "get", method: http.MethodGet, ttl: time.Hour, ok: true},
+		{name: "put", method: http.MethodPut, ttl: time.Hour, ok: true},
+		{name: "used with another method", method: http.MethodGet, ttl: time.Hour, use: http.MethodDelete},
+		{name: "expired", method: http.MethodGet, ttl: -time.Minute},
+		{name: "other key", method: http.MethodGet, ttl: time.Hour, change: func(u *url.URL) { u.Path = "/blob/photos/b.jpg" }},
+		{name: "query added", method: http.MethodGet, ttl: time.Hour, change: setQuery("list", "1")},
+		{name: "expiry moved", method: http.MethodGet, ttl: time.Hour, change: setQuery("X-Mv-Expires", "99999999999")},
+		{name: "other credential", method: http.MethodGet, ttl: time.Hour, change: setQuery("X-Mv-Credential", "root")},
+		{name: "unknown credential", method: http.MethodGet, ttl: time.Hour, change: setQuery("X-Mv-Credential", "mallory")},
+		{name: "signature changed", method: http.MethodGet, ttl: time.Hour, change: setQuery("X-Mv-Signature", strings.Repeat("0", 64))},
+		{name: "no expiry", method: http.MethodGet, ttl: time.Hour, change: func(u *url.URL) {
+			q := u.Query()
+			q.Del("X-Mv-Expires")
+			u.RawQuery = q.Encode()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signed, err := Presign(rawURL, tt.method, "alice", testSecret, tt.ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, _ := url.Parse(signed)
+			if tt.change != nil {
+				tt.change(u)
+			}
+			method := tt.use
+			if method == "" {
+				method = tt.method
+			}
+
+			id, err := k.Authenticate(httptest.NewRequest(method, u.String(), nil))
+			if (err == nil) != tt.ok {
+				t.Fatalf("err = %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && id != "alice" {
+				t.Errorf("id = %q, want alice", id)
+			}
+		})
+	}
+}
+
+func setQuery(name, value string) func(u *url.URL) {
+	return func(u *url.URL) {
+		q := u.Query()
+		q.Set(name, value)
+		u.RawQuery = q.Encode()
+	}
+}
+
+func TestServePresign(t *testing.T) {
+	k := testKeys(t)
+
+	tests := []struct {
+		name   string
+		query  string
+		bearer string
+		status int
+	}{
+		{"read", "key=photos/a.jpg", "alice:" + testSecret, http.StatusOK},
+		{"write", "method=PUT&key=photos/a.jpg", "alice:" + testSecret, http.StatusOK},
+		{"not allowed", "method=DELETE&key=photos/a.jpg", "alice:" + testSecret, http.StatusForbidden},
+		{"anonymous", "key=public/a", "", http.StatusUnauthorized},
+		{"unknown method", "method=POST&key=photos/a.jpg", "alice:" + testSecret, http.StatusBadRequest},
+		{"no key", "", "alice:" + testSecret, http.StatusBadRequest},
+		{"too long", "key=photos/a.jpg&expires_in=99999999", "alice:" + testSecret, http.StatusBadRequest},
+		{"from a presigned url", "key=photos/a.jpg&X-Mv-Signature=x", "alice:" + testSecret, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/_presign?"+tt.query, nil)
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			w := httptest.NewRecorder()
+			k.ServePresign(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			// the url it hands out works for what was asked, and only that
+			var resp presignResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			method := r.URL.Query().Get("method")
+			if method == "" {
+				method = http.MethodGet
+			}
+			if id, err := k.Authenticate(httptest.NewRequest(method, resp.URL, nil)); err != nil || id != "alice" {
+				t.Errorf("presigned url: %q, %v", id, err)
+			}
+			if _, err := k.Authenticate(httptest.NewRequest(http.MethodDelete, resp.URL, nil)); err == nil {
+				t.Error("presigned url works for delete")
+			}
+		})
+	}
+}
+
+func TestMay(t *testing.T) {
+	k := testKeys(t)
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want bool
+	}{
+		{"no caller", context.Background(), false},
+		{"allowed", WithCaller(context.Background(), k, "alice"), true},
+		{"anonymous", WithCaller(context.Background(), k, ""), false},
+		{"without keys", WithCaller(context.Background(), nil, ""), true},
+	}
+	for _, tt := range tests {
+		if got := May(tt.ctx, Write, "photos/a.jpg"); got != tt.want {
+			t.Errorf("%s: may = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// a presigned url lets whoever holds it make one kind of request on one
+// key until it expires, with the permissions of the key that signed it:
+//
+//	/blob/{key}?X-Mv-Credential={key id}&X-Mv-Expires={unix time}&X-Mv-Signature={hex}
+//
+// the signature is the hmac-sha256, keyed with the secret, of
+//
+//	MV-HMAC-SHA256-PRESIGNED\n{expires}\n{method}\n{escaped path}\n{sorted query without the signature}
+
+const (
+	presignedScheme = Scheme + "-PRESIGNED"
+	// presigned urls live at most a week
+	maxPresignExpiry = 7 * 24 * time.Hour
+)
+
+// presign signs rawURL for method with a key, valid for ttl
+func Presign(rawURL, method, id, secret string, ttl time.Duration) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("X-Mv-Credential", id)
+	q.Set("X-Mv-Expires", strconv.FormatInt(time.Now().Add(ttl).Unix(), 10))
+	u.RawQuery = q.Encode()
+
+	r := &http.Request{Method: method, URL: u}
+	q.Set("X-Mv-Signature", presignature(r, secret))
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func presignature(r *http.Request, secret string) string {
+	q := r.URL.Query()
+	q.Del("X-Mv-Signature")
+	toSign := presignedScheme + "\n" + q.Get("X-Mv-Expires") + "\n" + r.Method + "\n" + escapedPath(r) + "\n" + q.Encode()
+	return hmacHex(secret, toSign)
+}
+
+// authenticate_presigned checks the query signature of r and returns the id
+// of the key that made it
+func (k *Keys) authenticatePresigned(r *http.Request) (string, error) {
+	q := r.URL.Query()
+	id := q.Get("X-Mv-Credential")
+	secret, ok := k.Secret(id)
+	if !ok {
+		return "", ErrUnknownKey
+	}
+	expires, err := strconv.ParseInt(q.Get("X-Mv-Expires"), 10, 64)
+	if err != nil {
+		return "", errMalformed
+	}
+	if !hmac.Equal([]byte(q.Get("X-Mv-Signature")), []byte(presignature(r, secret))) {
+		return "", errors.New("signature does not match")
+	}
+	if time.Now().Unix() > expires {
+		return "", errors.New("url has expired")
+	}
+	return id, nil
+}
+
+type presignResponse struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// serve_presign handles GET /_presign?method=PUT&key={key}&expires_in={seconds}
+// it hands out a presigned url for the key, if the caller may do method on
+// it. without authentication the plain url is all anyone needs.
+func (k *Keys) ServePresign(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	key := q.Get("key")
+	method := q.Get("method")
+	if method == "" {
+		method = http.MethodGet
+	}
+	var perm Permission
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		perm = Read
+	case http.MethodPut:
+		perm = Write
+	case http.MethodDelete:
+		perm = Delete
+	default:
+		http.Error(w, "method must be GET, HEAD, PUT or DELETE", http.StatusBadRequest)
+		return
+	}
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+
+	ttl := time.Hour
+	if s := q.Get("expires_in"); s != "" {
+		secs, err := strconv.Atoi(s)
+		if err != nil || secs < 1 || time.Duration(secs)*time.Second > maxPresignExpiry {
+			http.Error(w, fmt.Sprintf("expires_in must be between 1 and %d seconds", int(maxPresignExpiry.Seconds())), http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(secs) * time.Second
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	u := (&url.URL{Scheme: scheme, Host: r.Host, Path: "/blob/" + key}).String()
+	resp := presignResponse{URL: u, Expires: time.Now().Add(ttl).UTC().Truncate(time.Second)}
+
+	if k != nil {
+		// presigned urls can't be used to make more of them
+		if r.URL.Query().Has("X-Mv-Signature") {
+			http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+			return
+		}
+		if !k.CheckSigned(w, r) || !k.Check(w, r, perm, key) {
+			return
+		}
+		id, _ := k.Authenticate(r)
+		secret, _ := k.Secret(id)
+		var err error
+		if resp.URL, err = Presign(u, method, id, secret, ttl); err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(resp)
+}
@@ -0,0 +1,164 @@
+package cluster
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/afonp/microvault/internal/db"
+)
+
+// heartbeats say a volume process is alive, not that clients can read from
+// it. the registry also probes every volume's public url and listens for
+// failed requests to it, and reads are only sent to volumes that look
+// healthy.
+
+// weight of a new latency sample in the moving average
+const latencyAlpha = 0.3
+
+// health is what the registry knows about reaching a volume
+type Health struct {
+	Healthy bool
+	// latency is a moving average of successful requests
+	Latency time.Duration
+	// last_error describes why the volume is unhealthy
+	LastError string
+	Checked   time.Time
+}
+
+// health returns the health of a volume. volumes that were never probed
+// are assumed healthy.
+func (r *Registry) Health(id string) Health {
+	r.healthMu.Lock()
+	defer r.healthMu.Unlock()
+	if h, ok := r.health[id]; ok {
+		return *h
+	}
+	return Health{Healthy: true}
+}
+
+// healthy reports whether reads may be sent to a volume
+func (r *Registry) Healthy(id string) bool {
+	r.mu.RLock()
+	v, known := r.volumes[id]
+	r.mu.RUnlock()
+	if known && v.State != db.VolumeUp {
+		return false
+	}
+	return r.Health(id).Healthy
+}
+
+// fail records a failed request to a volume. it stays unhealthy until a
+// probe gets through.
+func (r *Registry) Fail(id string, err error) {
+	r.healthMu.Lock()
+	defer r.healthMu.Unlock()
+
+	h := r.healthEntry(id)
+	if h.Healthy {
+		slog.Warn("volume is unhealthy", "volume", id, "err", err)
+	}
+	h.Healthy = false
+	h.LastError = err.Error()
+	h.Checked = time.Now()
+}
+
+// succeed records a request to a volume that took d
+func (r *Registry) Succeed(id string, d time.Duration) {
+	r.healthMu.Lock()
+	defer r.healthMu.Unlock()
+
+	h := r.healthEntry(id)
+	if !h.Healthy {
+		slog.Info("volume is healthy again", "volume", id)
+	}
+	h.Healthy = true
+	h.LastError = ""
+	h.Checked = time.Now()
+	if h.Latency == 0 {
+		h.Latency = d
+	} else {
+		h.Latency = time.Duration(latencyAlpha*float64(d) + (1-latencyAlpha)*float64(h.Latency))
+	}
+}
+
+// health_entry returns the entry for id, creating it. callers hold health_mu.
+func (r *Registry) healthEntry(id string) *Health {
+	h, ok := r.health[id]
+	if !ok {
+		h = &Health{Healthy: true}
+		r.health[id] = h
+	}
+	return h
+}
+
+// pick chooses which of the volumes holding a blob a read goes to. of two
+// random healthy volumes it takes the faster one, which favours fast
+// volumes without piling every read on one of them. it returns "" if none
+// is healthy.
+func (r *Registry) Pick(ids []string) string {
+	var healthy []string
+	for _, id := range ids {
+		if r.Healthy(id) {
+			healthy = append(healthy, id)
+		}
+	}
+	switch len(healthy) {
+	case 0:
+		return ""
+	case 1:
+		return healthy[0]
+	}
+
+	i := rand.Intn(len(healthy))
+	j := rand.Intn(len(healthy) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := healthy[i], healthy[j]
+	if r.Health(b).Latency < r.Health(a).Latency {
+		return b
+	}
+	return a
+}
+
+// probe checks every volume that is up every interval. it never returns.
+func (r *Registry) Probe(interval time.Duration) {
+	client := &http.Client{Timeout: interval}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, v := range r.Volumes() {
+			if v.State != db.VolumeUp {
+				continue
+			}
+			wg.Add(1)
+			go func(v db.Volume) {
+				defer wg.Done()
+				r.probe(client, v)
+			}(v)
+		}
+		wg.Wait()
+		<-ticker.C
+	}
+}
+
+func (r *Registry) probe(client *http.Client, v db.Volume) {
+	start := time.Now()
+	resp, err := client.Get(v.URL + "/_health")
+	if err != nil {
+		r.Fail(v.ID, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		r.Fail(v.ID, fmt.Errorf("health check returned status %d", resp.StatusCode))
+		return
+	}
+	r.Succeed(v.ID, time.Since(start))
+}
@@ -0,0 +1,93 @@
+package cluster
+
+import (
+	"github.com/afonp/microvault/internal/db"
+	"github.com/afonp/microvault/internal/metrics"
+)
+
+// register_metrics exports what the registry knows about each volume to
+// reg: whether it's in the ring, read-only, draining and healthy, its
+// weight, and the disk space from its last heartbeat. the values are read when reg is scraped.
+func (r *Registry) RegisterMetrics(reg *metrics.Registry) {
+	labels := []string{"volume", "url"}
+	reg.NewGaugeFunc("mv_volume_in_ring", "1 if the volume is up, takes writes and is in the hashing ring", labels,
+		func(set func(float64, ...string)) {
+			for _, v := range r.Volumes() {
+				set(boolValue(InRing(v)), v.ID, v.URL)
+			}
+		})
+	reg.NewGaugeFunc("mv_volume_read_only", "1 if the volume is too full to take writes", labels,
+		func(set func(float64, ...string)) {
+			for _, v := range r.Volumes() {
+				set(boolValue(v.ReadOnly), v.ID, v.URL)
+			}
+		})
+	reg.NewGaugeFunc("mv_volume_draining", "1 while the volume's blobs are moved off it, 2 once it's drained", labels,
+		func(set func(float64, ...string)) {
+			for _, v := range r.Volumes() {
+				switch v.Drain {
+				case db.Draining:
+					set(1, v.ID, v.URL)
+				case db.Drained:
+					set(2, v.ID, v.URL)
+				default:
+					set(0, v.ID, v.URL)
+				}
+			}
+		})
+	reg.NewGaugeFunc("mv_volume_weight", "the volume's weight in the hashing ring", labels,
+		func(set func(float64, ...string)) {
+			for _, v := range r.Volumes() {
+				if v.Weight > 0 {
+					set(v.Weight, v.ID, v.URL)
+				}
+			}
+		})
+	reg.NewGaugeFunc("mv_volume_healthy", "1 if reads are sent to the volume", labels,
+		func(set func(float64, ...string)) {
+			for _, v := range r.Volumes() {
+				set(boolValue(r.Healthy(v.ID)), v.ID, v.URL)
+			}
+		})
+	reg.NewGaugeFunc("mv_volume_disk_total_bytes", "size of the volume's disk, as of its last heartbeat", labels,
+		func(set func(float64, ...string)) {
+			for _, v := range r.Volumes() {
+				if !r.isStatic(v.ID) {
+					set(float64(v.Total), v.ID, v.URL)
+				}
+			}
+		})
+	reg.NewGaugeFunc("mv_volume_disk_free_bytes", "free space on the volume's disk, as of its last heartbeat", labels,
+		func(set func(float64, ...string)) {
+			for _, v := range r.Volumes() {
+				if !r.isStatic(v.ID) {
+					set(float64(v.Free), v.ID, v.URL)
+				}
+			}
+		})
+	reg.NewGaugeFunc("mv_ring_volumes", "volumes in the hashing ring", nil,
+		func(set func(float64, ...string)) {
+			n := 0
+			for _, v := range r.Volumes() {
+				if InRing(v) {
+					n++
+				}
+			}
+			set(float64(n))
+		})
+}
+
+// is_static reports whether a volume only comes from configuration, so
+// there are no heartbeats to report on
+func (r *Registry) isStatic(id string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.static[id]
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
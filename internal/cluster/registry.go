@@ -0,0 +1,365 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/afonp/microvault/internal/db"
+	"github.com/afonp/microvault/internal/hashing"
+	"github.com/afonp/microvault/internal/volume"
+)
+
+// where volume weights come from
+const (
+	// every volume weighs the same
+	WeightNone = "none"
+	// the size of the volume's disk
+	WeightTotal = "total"
+	// the free space on the volume's disk
+	WeightFree = "free"
+)
+
+// disk space worth a weight of 1
+const weightUnit = 1 << 40
+
+// weights within this fraction of the one in the ring aren't worth moving
+// keys for
+const weightSlack = 0.1
+
+// errors set_drain returns for volumes it can't drain
+var (
+	ErrUnknownVolume = errors.New("unknown volume")
+	ErrStaticVolume  = errors.New("volume is only known from -volumes and can't be drained")
+)
+
+// options tune the registry
+type Options struct {
+	// placement places keys on the volumes in the ring
+	Placement hashing.Options
+	// timeout is how long a volume may go without a heartbeat before it's
+	// taken out of the ring
+	Timeout time.Duration
+	// weight_by is where a volume's weight comes from when it doesn't
+	// report its own: WeightNone, WeightTotal or WeightFree
+	WeightBy string
+	// min_free is the fraction of its disk a volume must have free to take
+	// writes. below it the volume is read-only until it has twice as much
+	// free again. 0 never makes volumes read-only.
+	MinFree float64
+}
+
+// registry tracks the volumes in the cluster and keeps the hashing ring in
+// sync with the ones that are up and take writes, i.e. aren't full or
+// being drained. registered volumes are persisted in the store; volumes
+// from the -volumes flag are static and always up.
+type Registry struct {
+	store *db.Store
+	opts  Options
+
+	mu      sync.RWMutex
+	volumes map[string]db.Volume // by id
+	static  map[string]bool
+	ring    hashing.Placement
+
+	healthMu sync.Mutex
+	health   map[string]*Health // by id
+}
+
+// new_registry loads the registered volumes from the store
+func NewRegistry(store *db.Store, opts Options) (*Registry, error) {
+	if _, err := hashing.New(opts.Placement); err != nil {
+		return nil, err
+	}
+	switch opts.WeightBy {
+	case "":
+		opts.WeightBy = WeightNone
+	case WeightNone, WeightTotal, WeightFree:
+	default:
+		return nil, fmt.Errorf("unknown weight source %q (want %s, %s or %s)", opts.WeightBy, WeightNone, WeightTotal, WeightFree)
+	}
+	vols, err := store.GetVolumes()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Registry{
+		store:   store,
+		opts:    opts,
+		volumes: make(map[string]db.Volume),
+		static:  make(map[string]bool),
+		health:  make(map[string]*Health),
+	}
+	now := time.Now()
+	for _, v := range vols {
+		// give volumes that were up a fresh grace period after a restart
+		// of the master, rather than dropping them all at once
+		if v.State == db.VolumeUp {
+			v.LastHeartbeat = now
+		}
+		r.volumes[v.ID] = v
+	}
+	r.rebuild()
+	return r, nil
+}
+
+// add_static adds a volume from configuration. it is known by its url.
+func (r *Registry) AddStatic(url string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, v := range r.volumes {
+		if v.URL == url {
+			// already registered under its own id
+			return
+		}
+	}
+	r.static[url] = true
+	r.volumes[url] = db.Volume{ID: url, URL: url, State: db.VolumeUp}
+	r.rebuild()
+}
+
+// heartbeat registers a volume or refreshes it
+func (r *Registry) Heartbeat(hb volume.Heartbeat) error {
+	v := db.Volume{
+		ID:            hb.ID,
+		URL:           hb.URL,
+		Total:         hb.Total,
+		Free:          hb.Free,
+		State:         db.VolumeUp,
+		LastHeartbeat: time.Now(),
+		Weight:        r.weight(hb),
+		Zone:          hb.Zone,
+		Rack:          hb.Rack,
+		Host:          hb.Host,
+	}
+
+	r.mu.RLock()
+	old, known := r.volumes[v.ID]
+	r.mu.RUnlock()
+
+	if known && !reweigh(old.Weight, v.Weight) {
+		v.Weight = old.Weight
+	}
+	v.ReadOnly = r.readOnly(hb, known && old.ReadOnly)
+
+	if !known || old.URL != v.URL {
+		// blobs written while this volume was only known by its url
+		// now belong to its id
+		if err := r.store.AdoptVolume(v.URL, v.ID); err != nil {
+			return err
+		}
+	}
+	if err := r.store.PutVolume(v); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// draining is up to set_drain, which may have run since we looked
+	v.Drain = r.volumes[v.ID].Drain
+	r.volumes[v.ID] = v
+	if r.static[v.URL] {
+		// the static entry was a stand-in for this volume
+		delete(r.static, v.URL)
+		delete(r.volumes, v.URL)
+	}
+	changed := !known || old.State != db.VolumeUp || old.URL != v.URL
+	if changed {
+		slog.Info("volume is up", "volume", v.ID, "url", v.URL, "weight", v.Weight, "domain", Domain(v))
+	} else if old.Weight != v.Weight {
+		slog.Info("volume weight changed", "volume", v.ID, "from", old.Weight, "to", v.Weight)
+		changed = true
+	}
+	if from, to := Domain(old), Domain(v); known && from != to {
+		slog.Info("volume moved", "volume", v.ID, "from", from, "to", to)
+		changed = true
+	}
+	if v.ReadOnly != old.ReadOnly {
+		if v.ReadOnly {
+			slog.Warn("volume is nearly full, making it read-only", "volume", v.ID, "free", v.Free, "total", v.Total)
+		} else {
+			slog.Info("volume has room again, taking writes", "volume", v.ID, "free", v.Free, "total", v.Total)
+		}
+		changed = true
+	}
+	if changed {
+		r.rebuild()
+	}
+	return nil
+}
+
+// weight returns the weight a volume's heartbeat earns it, 0 if it can't
+// be told
+func (r *Registry) weight(hb volume.Heartbeat) float64 {
+	if hb.Weight > 0 {
+		return hb.Weight
+	}
+	switch r.opts.WeightBy {
+	case WeightTotal:
+		return float64(hb.Total) / weightUnit
+	case WeightFree:
+		return float64(hb.Free) / weightUnit
+	}
+	return 1
+}
+
+// reweigh reports whether a volume's weight moved far enough from the one
+// it has in the ring to be worth moving keys for
+func reweigh(old, weight float64) bool {
+	return math.Abs(weight-old) > weightSlack*old
+}
+
+// read_only decides whether a volume reporting hb should refuse writes,
+// given whether it did so far
+func (r *Registry) readOnly(hb volume.Heartbeat, was bool) bool {
+	if r.opts.MinFree <= 0 || hb.Total == 0 {
+		return false
+	}
+	free := float64(hb.Free) / float64(hb.Total)
+	if was {
+		return free < 2*r.opts.MinFree
+	}
+	return free < r.opts.MinFree
+}
+
+// run marks volumes down when their heartbeats stop. it never returns.
+func (r *Registry) Run() {
+	ticker := time.NewTicker(r.opts.Timeout / 3)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.reap()
+	}
+}
+
+func (r *Registry) reap() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changed := false
+	for id, v := range r.volumes {
+		if r.static[id] || v.State != db.VolumeUp || time.Since(v.LastHeartbeat) < r.opts.Timeout {
+			continue
+		}
+		slog.Warn("volume missed its heartbeats, marking it down", "volume", id, "url", v.URL)
+		if err := r.store.SetVolumeState(id, db.VolumeDown); err != nil {
+			slog.Error("failed to mark volume down", "volume", id, "err", err)
+			continue
+		}
+		v.State = db.VolumeDown
+		r.volumes[id] = v
+		changed = true
+	}
+	if changed {
+		r.rebuild()
+	}
+}
+
+// ring returns the placement over the volumes that are up and take
+// writes. it is replaced, never modified, so callers may hold on to it.
+func (r *Registry) Ring() hashing.Placement {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.ring
+}
+
+// url returns the address of a volume. ids the registry doesn't know are
+// assumed to be urls, which is how volumes were identified before they
+// registered.
+func (r *Registry) URL(id string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if v, ok := r.volumes[id]; ok {
+		return v.URL
+	}
+	return id
+}
+
+// volume returns the volume with an id, if it's known
+func (r *Registry) Volume(id string) (db.Volume, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	v, ok := r.volumes[id]
+	return v, ok
+}
+
+// set_drain starts (db.Draining) or finishes (db.Drained) decommissioning
+// a volume, or calls it off (""). a volume being drained or drained is
+// out of the ring, so it gets no new blobs, but it's still read from.
+// static volumes can't be drained, since nothing would remember it.
+func (r *Registry) SetDrain(id, drain string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	v, ok := r.volumes[id]
+	if !ok {
+		return fmt.Errorf("%w %s", ErrUnknownVolume, id)
+	}
+	if r.static[id] {
+		return fmt.Errorf("%w: %s", ErrStaticVolume, id)
+	}
+	if v.Drain == drain {
+		return nil
+	}
+	if err := r.store.SetVolumeDrain(id, drain); err != nil {
+		return err
+	}
+	slog.Info("volume drain changed", "volume", id, "from", v.Drain, "to", drain)
+	v.Drain = drain
+	r.volumes[id] = v
+	r.rebuild()
+	return nil
+}
+
+// volumes returns every known volume ordered by id
+func (r *Registry) Volumes() []db.Volume {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	vols := make([]db.Volume, 0, len(r.volumes))
+	for _, v := range r.volumes {
+		vols = append(vols, v)
+	}
+	sort.Slice(vols, func(i, j int) bool { return vols[i].ID < vols[j].ID })
+	return vols
+}
+
+// in_ring reports whether new keys may be placed on v
+func InRing(v db.Volume) bool {
+	return v.State == db.VolumeUp && !v.ReadOnly && v.Drain == ""
+}
+
+// domain returns the failure domains v is in
+func Domain(v db.Volume) hashing.Domain {
+	return hashing.Domain{Zone: v.Zone, Rack: v.Rack, Host: v.Host}
+}
+
+// node returns v as the ring sees it
+func Node(v db.Volume) hashing.Node {
+	return hashing.Node{ID: v.ID, Weight: v.Weight, Domain: Domain(v)}
+}
+
+// rebuild replaces the ring. callers hold mu.
+func (r *Registry) rebuild() {
+	var ids []string
+	for id, v := range r.volumes {
+		if InRing(v) {
+			ids = append(ids, id)
+		}
+	}
+	// the ring doesn't depend on insertion order, but keep it stable anyway
+	sort.Strings(ids)
+
+	// the options were checked by new_registry
+	ring, _ := hashing.New(r.opts.Placement)
+	for _, id := range ids {
+		ring.AddNode(Node(r.volumes[id]))
+	}
+	r.ring = ring
+}
@@ -0,0 +1,185 @@
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// key provider wraps the per-blob data keys with a master key it holds, so
+// whoever reads the disk still needs the master key to read a blob.
+// keyfiles and commands are the two that ship; anything that speaks to a
+// real kms can implement it too.
+type KeyProvider interface {
+	// wrap encrypts a data key and names the master key it used
+	Wrap(dataKey []byte) (keyID string, wrapped []byte, err error)
+	// unwrap decrypts a data key wrapped with the named master key
+	Unwrap(keyID string, wrapped []byte) ([]byte, error)
+}
+
+var ErrUnknownKey = errors.New("unknown master key")
+
+// keyfile holds master keys in a local file, one per line as
+//
+//	{key id} {64 hex characters}
+//
+// the first key wraps new data keys, the others only unwrap old ones, so a
+// key is rotated by adding a new first line.
+type Keyfile struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// load_keyfile reads a keyfile
+func LoadKeyfile(path string) (*Keyfile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &Keyfile{keys: make(map[string]cipher.AEAD)}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, hexKey, ok := strings.Cut(line, " ")
+		raw, err := hex.DecodeString(strings.TrimSpace(hexKey))
+		if !ok || err != nil || len(raw) != 32 || len(id) > 255 {
+			return nil, fmt.Errorf("%s:%d: expected a key id and 32 hex-encoded bytes", path, n)
+		}
+		if _, dup := k.keys[id]; dup {
+			return nil, fmt.Errorf("%s:%d: key %q defined twice", path, n, id)
+		}
+		if k.keys[id], err = newGCM(raw); err != nil {
+			return nil, err
+		}
+		if k.current == "" {
+			k.current = id
+		}
+	}
+	if k.current == "" {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return k, nil
+}
+
+func (k *Keyfile) Wrap(dataKey []byte) (string, []byte, error) {
+	aead := k.keys[k.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return k.current, aead.Seal(nonce, nonce, dataKey, []byte(k.current)), nil
+}
+
+func (k *Keyfile) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrCorrupt
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, sealed, []byte(keyID))
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return dataKey, nil
+}
+
+// command hands wrapping to an external program, for master keys that
+// live in a kms or hsm. it is run as
+//
+//	{path} wrap                 stdin: base64 data key   stdout: {key id} {base64 wrapped key}
+//	{path} unwrap {key id}      stdin: base64 wrapped    stdout: base64 data key
+//
+// and must exit non-zero on failure. unwrapped keys are cached, so the
+// program isn't run on every read.
+type Command struct {
+	path string
+
+	mu    sync.Mutex
+	cache map[string][]byte
+}
+
+// cap on cached data keys, after which the cache starts over
+const commandCacheSize = 4096
+
+// new_command returns a provider that runs the program at path
+func NewCommand(path string) *Command {
+	return &Command{path: path, cache: make(map[string][]byte)}
+}
+
+func (c *Command) Wrap(dataKey []byte) (string, []byte, error) {
+	out, err := c.run(base64.StdEncoding.EncodeToString(dataKey), "wrap")
+	if err != nil {
+		return "", nil, err
+	}
+	keyID, enc, ok := strings.Cut(out, " ")
+	wrapped, err := base64.StdEncoding.DecodeString(enc)
+	if !ok || err != nil || keyID == "" || len(keyID) > 255 {
+		return "", nil, fmt.Errorf("%s wrap: malformed output", c.path)
+	}
+	return keyID, wrapped, nil
+}
+
+func (c *Command) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	enc := base64.StdEncoding.EncodeToString(wrapped)
+	cacheKey := keyID + " " + enc
+
+	c.mu.Lock()
+	dataKey, ok := c.cache[cacheKey]
+	c.mu.Unlock()
+	if ok {
+		return dataKey, nil
+	}
+
+	out, err := c.run(enc, "unwrap", keyID)
+	if err != nil {
+		return nil, err
+	}
+	if dataKey, err = base64.StdEncoding.DecodeString(out); err != nil {
+		return nil, fmt.Errorf("%s unwrap: malformed output", c.path)
+	}
+
+	c.mu.Lock()
+	if len(c.cache) >= commandCacheSize {
+		clear(c.cache)
+	}
+	c.cache[cacheKey] = dataKey
+	c.mu.Unlock()
+	return dataKey, nil
+}
+
+func (c *Command) run(stdin string, args ...string) (string, error) {
+	cmd := exec.Command(c.path, args...)
+	cmd.Stdin = strings.NewReader(stdin + "\n")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %v: %s", c.path, args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,357 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// an encrypted blob is a header followed by the content in chunks, each
+// sealed with aes-256-gcm under a data key of its own:
+//
+//	"MVCRYPT1" | chunk size (u32) | nonce prefix (7 bytes) |
+//	key id length (u8) | key id | wrapped key length (u16) | wrapped data key |
+//	chunk 0 | chunk 1 | ... | last chunk
+//
+// every chunk but the last holds chunk size bytes of content plus a
+// 16 byte tag. the nonce of chunk i is the prefix, i (u32) and a byte
+// that is 1 for the last chunk only, so chunks can't be reordered and the
+// file can't be truncated without it showing. the header is authenticated
+// with every chunk. chunks can be decrypted on their own, so ranges don't
+// need the whole blob decrypted.
+//
+// blobs are still named by the sha256 of their content, so dedup and
+// scrubbing work as before, and so does checking a blob against its name.
+//
+// a detached stream is the same without the header, which is kept
+// elsewhere (e.g. in the blob's metadata) and passed in to read it.
+
+const (
+	magic = "MVCRYPT1"
+
+	// content bytes per chunk
+	ChunkSize = 64 << 10
+
+	prefixSize = 7
+	tagSize    = 16
+)
+
+var ErrCorrupt = errors.New("encrypted blob is corrupt")
+
+// is_encrypted reports whether r starts like an encrypted blob
+func IsEncrypted(r io.ReaderAt) bool {
+	buf := make([]byte, len(magic))
+	_, err := r.ReadAt(buf, 0)
+	return err == nil && string(buf) == magic
+}
+
+// writer encrypts everything written to it into w
+type Writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	prefix []byte
+	buf    []byte
+	chunk  uint32
+	closed bool
+}
+
+// new_writer writes the header of a new encrypted blob to w, under a fresh
+// data key wrapped by keys. close writes the last chunk; it doesn't close w.
+func NewWriter(w io.Writer, keys KeyProvider) (*Writer, error) {
+	ew, err := NewDetachedWriter(w, keys)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(ew.header); err != nil {
+		return nil, err
+	}
+	return ew, nil
+}
+
+// new_detached_writer is new_writer without writing the header, which
+// header returns instead
+func NewDetachedWriter(w io.Writer, keys KeyProvider) (*Writer, error) {
+	dataKey := make([]byte, 32)
+	prefix := make([]byte, prefixSize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	keyID, wrapped, err := keys.Wrap(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyID) > 255 || len(wrapped) > 65535 {
+		return nil, errors.New("wrapped key too long")
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var h bytes.Buffer
+	h.WriteString(magic)
+	binary.Write(&h, binary.BigEndian, uint32(ChunkSize))
+	h.Write(prefix)
+	h.WriteByte(byte(len(keyID)))
+	h.WriteString(keyID)
+	binary.Write(&h, binary.BigEndian, uint16(len(wrapped)))
+	h.Write(wrapped)
+
+	return &Writer{
+		w:      w,
+		aead:   aead,
+		header: h.Bytes(),
+		prefix: prefix,
+		buf:    make([]byte, 0, ChunkSize),
+	}, nil
+}
+
+// header is what has to be passed to new_detached_reader to read the stream
+func (w *Writer) Header() []byte {
+	return w.header
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed writer")
+	}
+	n := len(p)
+	for len(p) > 0 {
+		// a full chunk is only sealed once more comes after it, since
+		// the last chunk has to be marked as such
+		if len(w.buf) == ChunkSize {
+			if err := w.seal(false); err != nil {
+				return n - len(p), err
+			}
+		}
+		c := copy(w.buf[len(w.buf):ChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+	}
+	return n, nil
+}
+
+// close seals and writes the last chunk
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.seal(true)
+}
+
+func (w *Writer) seal(last bool) error {
+	sealed := w.aead.Seal(nil, nonce(w.prefix, w.chunk, last), w.buf, w.header)
+	w.buf = w.buf[:0]
+	w.chunk++
+	_, err := w.w.Write(sealed)
+	return err
+}
+
+// reader decrypts an encrypted blob. it reads and seeks over the content,
+// so it can be handed to http.ServeContent.
+type Reader struct {
+	r          io.ReaderAt
+	aead       cipher.AEAD
+	header     []byte
+	prefix     []byte
+	chunkSize  int64
+	bodyOffset int64
+	fileSize   int64
+	chunks     int64
+	size       int64
+
+	cur    int64 // index of the chunk in plain, -1 if none
+	plain  []byte
+	offset int64
+}
+
+// new_reader opens the encrypted blob in r, which is size bytes long
+func NewReader(r io.ReaderAt, size int64, keys KeyProvider) (*Reader, error) {
+	var header bytes.Buffer
+	h, err := parseHeader(io.TeeReader(io.NewSectionReader(r, 0, size), &header))
+	if err != nil {
+		return nil, err
+	}
+	h.raw = header.Bytes()
+	return newReader(r, size, h, int64(len(h.raw)), keys)
+}
+
+// new_detached_reader opens a detached stream of size bytes in r, given the
+// header its writer returned
+func NewDetachedReader(r io.ReaderAt, size int64, header []byte, keys KeyProvider) (*Reader, error) {
+	br := bytes.NewReader(header)
+	h, err := parseHeader(br)
+	if err != nil || br.Len() != 0 {
+		return nil, ErrCorrupt
+	}
+	h.raw = header
+	return newReader(r, size, h, 0, keys)
+}
+
+type streamHeader struct {
+	chunkSize int64
+	prefix    []byte
+	keyID     string
+	wrapped   []byte
+	raw       []byte
+}
+
+func parseHeader(r io.Reader) (streamHeader, error) {
+	var h streamHeader
+	fixed := make([]byte, len(magic)+4+prefixSize+1)
+	if _, err := io.ReadFull(r, fixed); err != nil || string(fixed[:len(magic)]) != magic {
+		return h, ErrCorrupt
+	}
+	h.chunkSize = int64(binary.BigEndian.Uint32(fixed[len(magic):]))
+	h.prefix = fixed[len(magic)+4 : len(magic)+4+prefixSize]
+
+	keyID := make([]byte, fixed[len(fixed)-1])
+	if _, err := io.ReadFull(r, keyID); err != nil {
+		return h, ErrCorrupt
+	}
+	h.keyID = string(keyID)
+	var wrappedLen uint16
+	if err := binary.Read(r, binary.BigEndian, &wrappedLen); err != nil {
+		return h, ErrCorrupt
+	}
+	h.wrapped = make([]byte, wrappedLen)
+	if _, err := io.ReadFull(r, h.wrapped); err != nil {
+		return h, ErrCorrupt
+	}
+	if h.chunkSize == 0 {
+		return h, ErrCorrupt
+	}
+	return h, nil
+}
+
+func newReader(r io.ReaderAt, size int64, h streamHeader, bodyOffset int64, keys KeyProvider) (*Reader, error) {
+	// every chunk is full except the last, which has at least its tag
+	body := size - bodyOffset
+	if body < tagSize {
+		return nil, ErrCorrupt
+	}
+	chunks := (body + h.chunkSize + tagSize - 1) / (h.chunkSize + tagSize)
+	if body-(chunks-1)*(h.chunkSize+tagSize) < tagSize {
+		return nil, ErrCorrupt
+	}
+
+	dataKey, err := keys.Unwrap(h.keyID, h.wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+
+	return &Reader{
+		r:          r,
+		aead:       aead,
+		header:     h.raw,
+		prefix:     h.prefix,
+		chunkSize:  h.chunkSize,
+		bodyOffset: bodyOffset,
+		fileSize:   size,
+		chunks:     chunks,
+		size:       body - chunks*tagSize,
+		cur:        -1,
+	}, nil
+}
+
+// size is the length of the decrypted content
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(p) {
+		if off >= r.size {
+			return n, io.EOF
+		}
+		i := off / r.chunkSize
+		// the last chunk is always read, even if empty, so truncation
+		// at a chunk boundary shows
+		if err := r.load(i); err != nil {
+			return n, err
+		}
+		c := copy(p[n:], r.plain[off-i*r.chunkSize:])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		// check the last chunk before reporting the end of the content
+		if err := r.load(r.chunks - 1); err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	n, err := r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// load decrypts chunk i into plain
+func (r *Reader) load(i int64) error {
+	if r.cur == i {
+		return nil
+	}
+	start := r.bodyOffset + i*(r.chunkSize+tagSize)
+	end := min(start+r.chunkSize+tagSize, r.fileSize)
+	sealed := make([]byte, end-start)
+	if _, err := r.r.ReadAt(sealed, start); err != nil && err != io.EOF {
+		return err
+	}
+	plain, err := r.aead.Open(r.plain[:0], nonce(r.prefix, uint32(i), i == r.chunks-1), sealed, r.header)
+	if err != nil {
+		r.cur = -1
+		return ErrCorrupt
+	}
+	r.plain, r.cur = plain, i
+	return nil
+}
+
+func nonce(prefix []byte, chunk uint32, last bool) []byte {
+	n := make([]byte, 0, prefixSize+5)
+	n = append(n, prefix...)
+	n = binary.BigEndian.AppendUint32(n, chunk)
+	if last {
+		return append(n, 1)
+	}
+	return append(n, 0)
+}
@@ -0,0 +1,269 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	oldKey = "old 0000000000000000000000000000000000000000000000000000000000000000"
+	newKey = "new 1111111111111111111111111111111111111111111111111111111111111111"
+)
+
+func keyfile(t *testing.T, lines ...string) *Keyfile {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := LoadKeyfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func content(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func encrypt(t *testing.T, keys KeyProvider, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// odd sized writes, so chunks don't line up with them
+	for rest := data; len(rest) > 0; {
+		n := min(len(rest), 1000)
+		if _, err := w.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// decrypt reads an encrypted blob to the end
+func decrypt(blob []byte, keys KeyProvider) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(blob), int64(len(blob)), keys)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestRoundTrip(t *testing.T) {
+	keys := keyfile(t, oldKey)
+	sizes := []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3 * ChunkSize, 3*ChunkSize + 5}
+	for _, size := range sizes {
+		data := content(t, size)
+		blob := encrypt(t, keys, data)
+		if !IsEncrypted(bytes.NewReader(blob)) {
+			t.Fatalf("%d bytes: not recognized as encrypted", size)
+		}
+
+		got, err := decrypt(blob, keys)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%d bytes: decrypted %d bytes that differ", size, len(got))
+		}
+	}
+}
+
+func TestDetached(t *testing.T) {
+	keys := keyfile(t, oldKey)
+	data := content(t, 2*ChunkSize+10)
+
+	var buf bytes.Buffer
+	w, err := NewDetachedWriter(&buf, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if IsEncrypted(bytes.NewReader(buf.Bytes())) {
+		t.Fatal("detached stream starts with a header")
+	}
+
+	r, err := NewDetachedReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), w.Header(), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, %v", len(got), err)
+	}
+}
+
+// ranges decrypt only the chunks they touch, across chunk boundaries too
+func TestReadAt(t *testing.T) {
+	keys := keyfile(t, oldKey)
+	data := content(t, 3*ChunkSize+100)
+	blob := encrypt(t, keys, data)
+	r, err := NewReader(bytes.NewReader(blob), int64(len(blob)), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != int64(len(data)) {
+		t.Fatalf("size = %d, want %d", r.Size(), len(data))
+	}
+
+	tests := []struct {
+		name     string
+		off, len int
+	}{
+		{"start", 0, 10},
+		{"within a chunk", 100, 1000},
+		{"last byte of a chunk", ChunkSize - 1, 1},
+		{"across a boundary", ChunkSize - 10, 20},
+		{"across two boundaries", ChunkSize - 10, ChunkSize + 20},
+		{"last chunk", 3 * ChunkSize, 100},
+		{"everything", 0, len(data)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := make([]byte, tt.len)
+			n, err := r.ReadAt(p, int64(tt.off))
+			if err != nil && !(err == io.EOF && tt.off+tt.len == len(data)) {
+				t.Fatal(err)
+			}
+			if n != tt.len || !bytes.Equal(p, data[tt.off:tt.off+tt.len]) {
+				t.Fatalf("read %d bytes that differ", n)
+			}
+		})
+	}
+
+	if _, err := r.Seek(-5, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	tail, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(tail, data[len(data)-5:]) {
+		t.Fatalf("tail = %x, %v", tail, err)
+	}
+}
+
+func TestTampering(t *testing.T) {
+	keys := keyfile(t, oldKey)
+	data := content(t, 3*ChunkSize+100)
+	blob := encrypt(t, keys, data)
+	header := len(blob) - (len(data) + 4*tagSize)
+	chunk := ChunkSize + tagSize
+	// body returns the sealed chunk i
+	body := func(i int) []byte {
+		start := header + i*chunk
+		return blob[start:min(start+chunk, len(blob))]
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	tests := []struct {
+		name string
+		blob []byte
+		keys KeyProvider
+		want error
+	}{
+		{name: "intact", blob: blob},
+		{name: "truncated mid chunk", blob: blob[:len(blob)-50], want: ErrCorrupt},
+		{name: "truncated at a chunk boundary", blob: blob[:header+3*chunk], want: ErrCorrupt},
+		{name: "last chunk dropped", blob: join(blob[:header], body(0), body(1), body(3)), want: ErrCorrupt},
+		{name: "chunks reordered", blob: join(blob[:header], body(1), body(0), body(2), body(3)), want: ErrCorrupt},
+		{name: "chunk repeated", blob: join(blob[:header], body(0), body(0), body(1), body(2), body(3)), want: ErrCorrupt},
+		{name: "content changed", blob: flip(blob, header+10), want: ErrCorrupt},
+		{name: "tag changed", blob: flip(blob, len(blob)-1), want: ErrCorrupt},
+		{name: "nonce prefix changed", blob: flip(blob, len(magic)+4), want: ErrCorrupt},
+		{name: "chunk size changed", blob: flip(blob, len(magic)+3), want: ErrCorrupt},
+		{name: "magic changed", blob: flip(blob, 0), want: ErrCorrupt},
+		{name: "header only", blob: blob[:header], want: ErrCorrupt},
+		{name: "unknown master key", blob: blob, keys: keyfile(t, newKey), want: ErrUnknownKey},
+		{name: "same key id, other key", blob: blob, keys: keyfile(t, "old "+strings.Repeat("22", 32)), want: ErrCorrupt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := tt.keys
+			if k == nil {
+				k = keys
+			}
+			got, err := decrypt(tt.blob, k)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			if err == nil && !bytes.Equal(got, data) {
+				t.Fatal("decrypted content differs")
+			}
+		})
+	}
+}
+
+func flip(b []byte, i int) []byte {
+	c := bytes.Clone(b)
+	c[i] ^= 1
+	return c
+}
+
+// a rotated keyfile wraps new blobs with its first key and still reads
+// blobs wrapped with the old one
+func TestKeyRotation(t *testing.T) {
+	data := content(t, 100)
+	old := encrypt(t, keyfile(t, oldKey), data)
+
+	rotated := keyfile(t, newKey, oldKey)
+	got, err := decrypt(old, rotated)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("old blob: %v", err)
+	}
+
+	id, _, err := rotated.Wrap(make([]byte, 32))
+	if err != nil || id != "new" {
+		t.Fatalf("wrapped with %q, %v, want new", id, err)
+	}
+}
+
+func TestLoadKeyfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		ok      bool
+	}{
+		{"one key", oldKey + "\n", true},
+		{"comments and blank lines", "# keys\n\n" + newKey + "\n" + oldKey + "\n", true},
+		{"empty", "", false},
+		{"only comments", "# nothing\n", false},
+		{"short key", "k 0011\n", false},
+		{"not hex", "k " + strings.Repeat("zz", 32) + "\n", false},
+		{"no key", "k\n", false},
+		{"duplicate id", oldKey + "\n" + oldKey + "\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keys")
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadKeyfile(path)
+			if (err == nil) != tt.ok {
+				t.Fatalf("err = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -3,33 +3,58 @@ package db
 import (
 	"database/sql"
 	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// replica states
+const (
+	// the copy is in place and readable
+	ReplicaOK = "ok"
+	// the volume doesn't have the copy
+	ReplicaMissing = "missing"
+	// the copy no longer matches its hash
+	ReplicaCorrupt = "corrupt"
+	// the volume was down when the blob was written. the copy is a hint
+	// for the repair loop to write it there later.
+	ReplicaPending = "pending"
+)
+
 // store handles interactions with the metadata database
 type Store struct {
 	db *sql.DB
 }
 
-// new_store initializes the database connection and schema
+// blob is what a key points at
+type Blob struct {
+	Key         string
+	Hash        string
+	Size        int64
+	ContentType string
+	// meta holds the other headers stored with the key, by canonical name
+	Meta      map[string]string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// replica is one copy of a piece of content on a volume
+type Replica struct {
+	Hash     string
+	VolumeID string
+	State    string
+}
+
+// new_store initializes the database connection and brings the schema up
+// to date
 func NewStore(path string) (*Store, error) {
 	db, err := sql.Open("sqlite3", path)
 	if err != nil {
 		return nil, err
 	}
 
-	// create blobs table if it doesn't exist
-	// key: the blob key (user provided or hash)
-	// volume_id: the identifier of the volume where the blob is stored
-	// for now we might just store the full url or a simple id
-	query := `
-	CREATE TABLE IF NOT EXISTS blobs (
-		key TEXT PRIMARY KEY,
-		volume_id TEXT
-	);`
-
-	if _, err := db.Exec(query); err != nil {
+	if err := migrate(db); err != nil {
+		db.Close()
 		return nil, err
 	}
 
@@ -41,50 +66,338 @@ func (s *Store) Close() error {
 	return s.db.Close()
 }
 
-// put_blob records a blob's location(s)
-func (s *Store) PutBlob(key string, volumeIDs []string) error {
-	val := strings.Join(volumeIDs, ",")
-	_, err := s.db.Exec("INSERT OR REPLACE INTO blobs (key, volume_id) VALUES (?, ?)", key, val)
-	return err
+// put_blob points b.Key at b.Hash and records the volumes holding it.
+// created_at is kept when a key is overwritten. it returns the content the
+// key pointed at before, if that was something else; its replicas stay
+// until drop_unreferenced.
+func (s *Store) PutBlob(b Blob, volumeIDs []string) (string, error) {
+	return s.PutBlobHinted(b, volumeIDs, nil)
 }
 
-// get_blob retrieves a blob's location(s)
-func (s *Store) GetBlob(key string) ([]string, error) {
-	var val string
-	err := s.db.QueryRow("SELECT volume_id FROM blobs WHERE key = ?", key).Scan(&val)
-	if err == sql.ErrNoRows {
+// put_blob_hinted is put_blob for a write that missed some of its volumes.
+// those get a pending copy, unless they already hold the content.
+func (s *Store) PutBlobHinted(b Blob, volumeIDs, hinted []string) (string, error) {
+	defer observe("PutBlobHinted", time.Now())
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var oldHash string
+	err = tx.QueryRow("SELECT hash FROM blobs WHERE key = ?", b.Key).Scan(&oldHash)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	if oldHash == b.Hash {
+		oldHash = ""
+	}
+
+	now := time.Now().Unix()
+	_, err = tx.Exec(`
+	INSERT INTO blobs (key, hash, size, content_type, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT (key) DO UPDATE SET
+		hash = excluded.hash,
+		size = excluded.size,
+		content_type = excluded.content_type,
+		updated_at = excluded.updated_at`,
+		b.Key, b.Hash, b.Size, b.ContentType, now, now)
+	if err != nil {
+		return "", err
+	}
+
+	if err := putMeta(tx, "blob_meta", "key", b.Key, b.Meta); err != nil {
+		return "", err
+	}
+
+	for _, vol := range volumeIDs {
+		if err := addReplica(tx, b.Hash, vol, ReplicaOK); err != nil {
+			return "", err
+		}
+	}
+	for _, vol := range hinted {
+		_, err := tx.Exec(`
+		INSERT INTO replicas (hash, volume_id, state) VALUES (?, ?, ?)
+		ON CONFLICT (hash, volume_id) DO NOTHING`,
+			b.Hash, vol, ReplicaPending)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return oldHash, tx.Commit()
+}
+
+// drop_unreferenced forgets the replicas of hash if no key points at it,
+// and returns the ones it forgot
+func (s *Store) DropUnreferenced(hash string) ([]Replica, error) {
+	defer observe("DropUnreferenced", time.Now())
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var referenced bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM blobs WHERE hash = ?)", hash).Scan(&referenced); err != nil {
+		return nil, err
+	}
+	if referenced {
 		return nil, nil
 	}
+
+	rows, err := tx.Query("SELECT hash, volume_id, state FROM replicas WHERE hash = ? ORDER BY volume_id", hash)
 	if err != nil {
 		return nil, err
 	}
-	if val == "" {
+	defer rows.Close()
+	var replicas []Replica
+	for rows.Next() {
+		var r Replica
+		if err := rows.Scan(&r.Hash, &r.VolumeID, &r.State); err != nil {
+			return nil, err
+		}
+		replicas = append(replicas, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := dropUnreferenced(tx, hash); err != nil {
+		return nil, err
+	}
+	return replicas, tx.Commit()
+}
+
+// get_blob retrieves what a key points at, or nil if it doesn't exist
+func (s *Store) GetBlob(key string) (*Blob, error) {
+	defer observe("GetBlob", time.Now())
+	var b Blob
+	var created, updated int64
+	err := s.db.QueryRow("SELECT key, hash, size, content_type, created_at, updated_at FROM blobs WHERE key = ?", key).
+		Scan(&b.Key, &b.Hash, &b.Size, &b.ContentType, &created, &updated)
+	if err == sql.ErrNoRows {
 		return nil, nil
 	}
-	return strings.Split(val, ","), nil
+	if err != nil {
+		return nil, err
+	}
+	b.CreatedAt = time.Unix(created, 0)
+	b.UpdatedAt = time.Unix(updated, 0)
+	b.Meta, err = s.getMeta("blob_meta", "key", key)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// get_replicas returns every recorded copy of hash
+func (s *Store) GetReplicas(hash string) ([]Replica, error) {
+	defer observe("GetReplicas", time.Now())
+	rows, err := s.db.Query("SELECT hash, volume_id, state FROM replicas WHERE hash = ? ORDER BY volume_id", hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var replicas []Replica
+	for rows.Next() {
+		var r Replica
+		if err := rows.Scan(&r.Hash, &r.VolumeID, &r.State); err != nil {
+			return nil, err
+		}
+		replicas = append(replicas, r)
+	}
+	return replicas, rows.Err()
+}
+
+// add_replica records a copy of hash on a volume, or updates its state
+func (s *Store) AddReplica(hash, volumeID, state string) error {
+	defer observe("AddReplica", time.Now())
+	return addReplica(s.db, hash, volumeID, state)
+}
+
+// set_replica_state changes the state of a known copy. unknown copies are
+// left alone.
+func (s *Store) SetReplicaState(hash, volumeID, state string) error {
+	defer observe("SetReplicaState", time.Now())
+	_, err := s.db.Exec("UPDATE replicas SET state = ? WHERE hash = ? AND volume_id = ?", state, hash, volumeID)
+	return err
+}
+
+// under_replicated returns the hashes with fewer than n good copies on the
+// given volumes, or with a copy on one of them that isn't ok. copies on
+// other volumes are left for when those come back.
+func (s *Store) UnderReplicated(volumeIDs []string, n int) ([]string, error) {
+	defer observe("UnderReplicated", time.Now())
+	placeholders := make([]string, len(volumeIDs))
+	ids := make([]any, len(volumeIDs))
+	for i, id := range volumeIDs {
+		placeholders[i] = "?"
+		ids[i] = id
+	}
+	in := "NULL"
+	if len(placeholders) > 0 {
+		in = strings.Join(placeholders, ", ")
+	}
+
+	args := append([]any{ReplicaOK}, ids...)
+	args = append(args, n, ReplicaOK)
+	args = append(args, ids...)
+	return s.listStrings(`
+	SELECT hash FROM replicas GROUP BY hash
+	HAVING SUM(state = ? AND volume_id IN (`+in+`)) < ?
+		OR SUM(state != ? AND volume_id IN (`+in+`)) > 0`, args...)
+}
+
+// remove_replica forgets the copy of hash on a volume
+func (s *Store) RemoveReplica(hash, volumeID string) error {
+	defer observe("RemoveReplica", time.Now())
+	_, err := s.db.Exec("DELETE FROM replicas WHERE hash = ? AND volume_id = ?", hash, volumeID)
+	return err
 }
 
 // list_keys returns all keys in the store
 func (s *Store) ListKeys() ([]string, error) {
-	rows, err := s.db.Query("SELECT key FROM blobs")
+	defer observe("ListKeys", time.Now())
+	return s.listStrings("SELECT key FROM blobs")
+}
+
+// list_hashes returns every hash the store knows about, whether through a
+// key or a replica
+func (s *Store) ListHashes() ([]string, error) {
+	defer observe("ListHashes", time.Now())
+	return s.listStrings("SELECT hash FROM blobs UNION SELECT hash FROM replicas")
+}
+
+// find_hash returns some blob whose content is hash, or nil if no key
+// points at it
+func (s *Store) FindHash(hash string) (*Blob, error) {
+	defer observe("FindHash", time.Now())
+	var key string
+	err := s.db.QueryRow("SELECT key FROM blobs WHERE hash = ? LIMIT 1", hash).Scan(&key)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.GetBlob(key)
+}
+
+// hash_keys returns the keys pointing at hash
+func (s *Store) HashKeys(hash string) ([]string, error) {
+	defer observe("HashKeys", time.Now())
+	return s.listStrings("SELECT key FROM blobs WHERE hash = ? ORDER BY key", hash)
+}
+
+// delete_blob removes a key and returns how many keys still point at its
+// content. replicas of the content are forgotten once that reaches zero.
+func (s *Store) DeleteBlob(key string) (int, error) {
+	defer observe("DeleteBlob", time.Now())
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var hash string
+	err = tx.QueryRow("SELECT hash FROM blobs WHERE key = ?", key).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM blobs WHERE key = ?", key); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM blob_meta WHERE key = ?", key); err != nil {
+		return 0, err
+	}
+	var remaining int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM blobs WHERE hash = ?", hash).Scan(&remaining); err != nil {
+		return 0, err
+	}
+	if err := dropUnreferenced(tx, hash); err != nil {
+		return 0, err
+	}
+	return remaining, tx.Commit()
+}
+
+// put_meta replaces the meta rows of one key or upload. table and column
+// are constants from this package, never user input.
+func putMeta(tx *sql.Tx, table, column, id string, meta map[string]string) error {
+	if _, err := tx.Exec("DELETE FROM "+table+" WHERE "+column+" = ?", id); err != nil {
+		return err
+	}
+	for name, value := range meta {
+		if _, err := tx.Exec("INSERT INTO "+table+" ("+column+", name, value) VALUES (?, ?, ?)", id, name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// get_meta returns the meta rows of one key or upload, or nil if there are
+// none
+func (s *Store) getMeta(table, column, id string) (map[string]string, error) {
+	rows, err := s.db.Query("SELECT name, value FROM "+table+" WHERE "+column+" = ?", id)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var keys []string
+	var meta map[string]string
 	for rows.Next() {
-		var key string
-		if err := rows.Scan(&key); err != nil {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
 			return nil, err
 		}
-		keys = append(keys, key)
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[name] = value
 	}
-	return keys, nil
+	return meta, rows.Err()
+}
+
+func (s *Store) listStrings(query string, args ...any) ([]string, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
+
+// execer is what *sql.DB and *sql.Tx have in common
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func addReplica(e execer, hash, volumeID, state string) error {
+	_, err := e.Exec(`
+	INSERT INTO replicas (hash, volume_id, state) VALUES (?, ?, ?)
+	ON CONFLICT (hash, volume_id) DO UPDATE SET state = excluded.state`,
+		hash, volumeID, state)
+	return err
 }
 
-// delete_blob removes a blob's metadata
-func (s *Store) DeleteBlob(key string) error {
-	_, err := s.db.Exec("DELETE FROM blobs WHERE key = ?", key)
+// drop_unreferenced forgets the replicas of hash once no key points at it
+func dropUnreferenced(tx *sql.Tx, hash string) error {
+	_, err := tx.Exec(`
+	DELETE FROM replicas WHERE hash = ?
+		AND NOT EXISTS (SELECT 1 FROM blobs WHERE hash = ?)`, hash, hash)
 	return err
 }
@@ -0,0 +1,120 @@
+package db
+
+import (
+	"strings"
+	"time"
+)
+
+// listing walks the blobs table in key order through its primary key, so
+// a page costs the same no matter how many keys there are. keys sharing a
+// prefix up to the delimiter are rolled up into one common prefix and
+// skipped over with a single range query.
+
+// list_options selects a page of keys
+type ListOptions struct {
+	// prefix restricts the listing to keys starting with it
+	Prefix string
+	// start_after skips keys up to and including it
+	StartAfter string
+	// delimiter rolls up keys that contain it after the prefix
+	Delimiter string
+	// limit caps how many keys and common prefixes a page holds
+	Limit int
+}
+
+// listing is one page of keys
+type Listing struct {
+	Blobs []Blob
+	// prefixes are the common prefixes, each ending in the delimiter
+	Prefixes []string
+	// next is where the following page starts after, or "" if this is
+	// the last page
+	Next string
+}
+
+// no byte in a utf-8 string is 0xff, so s+maxSuffix sorts after every key
+// starting with s
+const maxSuffix = "\xff"
+
+// list returns a page of keys in order
+func (s *Store) List(opts ListOptions) (*Listing, error) {
+	defer observe("List", time.Now())
+	var l Listing
+	if opts.Limit <= 0 {
+		return &l, nil
+	}
+
+	cursor := opts.StartAfter
+	if p, ok := commonPrefix(cursor, opts.Prefix, opts.Delimiter); ok {
+		// the previous page ended on this common prefix
+		cursor = p + maxSuffix
+	}
+
+	count := 0
+	for {
+		rows, err := s.db.Query(`
+		SELECT key, hash, size, content_type, created_at, updated_at FROM blobs
+		WHERE key > ? AND key >= ? AND key < ?
+		ORDER BY key LIMIT ?`,
+			cursor, opts.Prefix, opts.Prefix+maxSuffix, opts.Limit-count+1)
+		if err != nil {
+			return nil, err
+		}
+
+		skipped := false
+		for rows.Next() {
+			var b Blob
+			var created, updated int64
+			if err := rows.Scan(&b.Key, &b.Hash, &b.Size, &b.ContentType, &created, &updated); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if count == opts.Limit {
+				// there is more
+				l.Next = cursor
+				break
+			}
+
+			if p, ok := commonPrefix(b.Key, opts.Prefix, opts.Delimiter); ok {
+				l.Prefixes = append(l.Prefixes, p)
+				count++
+				// jump over every other key under the prefix
+				cursor = p + maxSuffix
+				skipped = true
+				break
+			}
+
+			b.CreatedAt = time.Unix(created, 0)
+			b.UpdatedAt = time.Unix(updated, 0)
+			l.Blobs = append(l.Blobs, b)
+			count++
+			cursor = b.Key
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		if l.Next != "" {
+			// after a common prefix the cursor isn't a key
+			l.Next = strings.TrimSuffix(l.Next, maxSuffix)
+			return &l, nil
+		}
+		if !skipped {
+			return &l, nil
+		}
+	}
+}
+
+// common_prefix returns the part of key up to and including the first
+// delimiter after prefix, if there is one
+func commonPrefix(key, prefix, delimiter string) (string, bool) {
+	if delimiter == "" || !strings.HasPrefix(key, prefix) {
+		return "", false
+	}
+	i := strings.Index(key[len(prefix):], delimiter)
+	if i < 0 {
+		return "", false
+	}
+	return key[:len(prefix)+i+len(delimiter)], true
+}
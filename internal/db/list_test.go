@@ -0,0 +1,189 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var listKeys = []string{
+	"a",
+	"photos/2023/a.jpg",
+	"photos/2023/b.jpg",
+	"photos/2024/a.jpg",
+	"photos/2024/jan/b.jpg",
+	"photos/c.jpg",
+	"photos/d.jpg",
+	"videos/a.mp4",
+	"videos/b.mp4",
+	"z/",
+	"zz",
+	"é",
+}
+
+func newListStore(t *testing.T) *Store {
+	t.Helper()
+	store, err := NewStore(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	for _, key := range listKeys {
+		if _, err := store.PutBlob(Blob{Key: key, Hash: hashA}, []string{"v1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+// entries is what a listing shows, keys and common prefixes in order
+func entries(l *Listing) []string {
+	var out []string
+	for _, b := range l.Blobs {
+		out = append(out, b.Key)
+	}
+	for _, p := range l.Prefixes {
+		out = append(out, p+" (prefix)")
+	}
+	slices.SortFunc(out, func(a, b string) int {
+		return strings.Compare(strings.TrimSuffix(a, " (prefix)"), strings.TrimSuffix(b, " (prefix)"))
+	})
+	return out
+}
+
+// want_entries lists keys the slow way
+func wantEntries(prefix, delimiter string) []string {
+	var out []string
+	for _, key := range listKeys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if p, ok := commonPrefix(key, prefix, delimiter); ok {
+			if e := p + " (prefix)"; !slices.Contains(out, e) {
+				out = append(out, e)
+			}
+			continue
+		}
+		out = append(out, key)
+	}
+	return out
+}
+
+func TestListPage(t *testing.T) {
+	store := newListStore(t)
+
+	tests := []struct {
+		name string
+		opts ListOptions
+		want []string
+		next string
+	}{
+		{
+			name: "everything",
+			opts: ListOptions{Limit: 100},
+			want: listKeys,
+		},
+		{
+			name: "prefix",
+			opts: ListOptions{Prefix: "videos/", Limit: 100},
+			want: []string{"videos/a.mp4", "videos/b.mp4"},
+		},
+		{
+			name: "delimiter",
+			opts: ListOptions{Delimiter: "/", Limit: 100},
+			want: []string{"a", "photos/ (prefix)", "videos/ (prefix)", "z/ (prefix)", "zz", "é"},
+		},
+		{
+			name: "prefix and delimiter",
+			opts: ListOptions{Prefix: "photos/", Delimiter: "/", Limit: 100},
+			want: []string{"photos/2023/ (prefix)", "photos/2024/ (prefix)", "photos/c.jpg", "photos/d.jpg"},
+		},
+		{
+			name: "limit",
+			opts: ListOptions{Limit: 2},
+			want: []string{"a", "photos/2023/a.jpg"},
+			next: "photos/2023/a.jpg",
+		},
+		{
+			name: "limit ending on a common prefix",
+			opts: ListOptions{Delimiter: "/", Limit: 2},
+			want: []string{"a", "photos/ (prefix)"},
+			next: "photos/",
+		},
+		{
+			name: "start after a key",
+			opts: ListOptions{StartAfter: "videos/a.mp4", Limit: 100},
+			want: []string{"videos/b.mp4", "z/", "zz", "é"},
+		},
+		{
+			name: "start after a common prefix",
+			opts: ListOptions{StartAfter: "photos/", Delimiter: "/", Limit: 100},
+			want: []string{"videos/ (prefix)", "z/ (prefix)", "zz", "é"},
+		},
+		{
+			name: "exact page has no next",
+			opts: ListOptions{Prefix: "videos/", Limit: 2},
+			want: []string{"videos/a.mp4", "videos/b.mp4"},
+		},
+		{
+			name: "no match",
+			opts: ListOptions{Prefix: "nothing/", Limit: 10},
+		},
+		{
+			name: "no limit",
+			opts: ListOptions{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := store.List(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := entries(l); !slices.Equal(got, tt.want) {
+				t.Errorf("entries = %q, want %q", got, tt.want)
+			}
+			if l.Next != tt.next {
+				t.Errorf("next = %q, want %q", l.Next, tt.next)
+			}
+		})
+	}
+}
+
+// paging through with any limit gives the same entries as one big page
+func TestListPages(t *testing.T) {
+	store := newListStore(t)
+
+	for _, prefix := range []string{"", "photos/", "photos/2024/", "z"} {
+		for _, delimiter := range []string{"", "/"} {
+			for limit := 1; limit <= len(listKeys)+1; limit++ {
+				t.Run(fmt.Sprintf("%q %q %d", prefix, delimiter, limit), func(t *testing.T) {
+					var got []string
+					opts := ListOptions{Prefix: prefix, Delimiter: delimiter, Limit: limit}
+					for pages := 0; ; pages++ {
+						if pages > len(listKeys) {
+							t.Fatal("paging doesn't end")
+						}
+						l, err := store.List(opts)
+						if err != nil {
+							t.Fatal(err)
+						}
+						if n := len(l.Blobs) + len(l.Prefixes); n > limit {
+							t.Fatalf("page holds %d entries, limit %d", n, limit)
+						}
+						got = append(got, entries(l)...)
+						if l.Next == "" {
+							break
+						}
+						opts.StartAfter = l.Next
+					}
+					if want := wantEntries(prefix, delimiter); !slices.Equal(got, want) {
+						t.Errorf("entries = %q, want %q", got, want)
+					}
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package db
+
+import (
+	"time"
+
+	"github.com/afonp/microvault/internal/metrics"
+)
+
+var queryDuration = metrics.NewHistogram("mv_db_query_duration_seconds",
+	"time spent in store methods, transactions included", metrics.DefBuckets, "query")
+
+// observe records how long the store method named query took since start.
+// called deferred at the top of the method.
+func observe(query string, start time.Time) {
+	queryDuration.Observe(time.Since(start).Seconds(), query)
+}
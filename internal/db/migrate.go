@@ -0,0 +1,301 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// migrations upgrade the schema one version at a time. the current version
+// is kept in sqlite's user_version pragma, so a database created by any
+// earlier release is brought up to date in place when the store opens.
+// never edit a migration once released; add a new one instead.
+var migrations = []func(tx *sql.Tx) error{
+	migrateInitial,
+	migrateNormalize,
+	migrateVolumes,
+	migrateMeta,
+	migrateWeights,
+	migrateTopology,
+	migrateDrain,
+}
+
+// migrate applies every migration newer than the database's version, each
+// in its own transaction
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := migrations[i](tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		// pragmas can't take bound parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// migrate_initial is the original schema. databases from before migrations
+// existed already have it, hence IF NOT EXISTS.
+func migrateInitial(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS blobs (
+		key TEXT PRIMARY KEY,
+		volume_id TEXT
+	);
+
+	CREATE TABLE IF NOT EXISTS uploads (
+		upload_id TEXT PRIMARY KEY,
+		key TEXT,
+		volume_id TEXT,
+		created_at INTEGER
+	);
+
+	CREATE TABLE IF NOT EXISTS upload_parts (
+		upload_id TEXT,
+		part_number INTEGER,
+		size INTEGER,
+		etag TEXT,
+		PRIMARY KEY (upload_id, part_number)
+	);`)
+	return err
+}
+
+// migrate_normalize replaces the comma-joined url lists with one row per
+// replica, and keys with a pointer to the content hash
+func migrateNormalize(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	ALTER TABLE blobs RENAME TO blobs_v1;
+
+	-- key: the blob key (user provided or hash)
+	-- hash: sha256 of the content, which is also its name on the volumes
+	CREATE TABLE blobs (
+		key TEXT PRIMARY KEY,
+		hash TEXT NOT NULL,
+		size INTEGER NOT NULL DEFAULT 0,
+		content_type TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	);
+	CREATE INDEX blobs_hash ON blobs (hash);
+
+	-- one row per copy of a piece of content
+	-- volume_id: the volume holding the copy
+	-- state: ok, or why the copy can't be relied on
+	CREATE TABLE replicas (
+		hash TEXT NOT NULL,
+		volume_id TEXT NOT NULL,
+		state TEXT NOT NULL DEFAULT 'ok',
+		PRIMARY KEY (hash, volume_id)
+	);
+
+	ALTER TABLE uploads RENAME TO uploads_v1;
+
+	CREATE TABLE uploads (
+		upload_id TEXT PRIMARY KEY,
+		key TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+
+	-- volumes holding the parts of an upload
+	CREATE TABLE upload_volumes (
+		upload_id TEXT NOT NULL,
+		volume_id TEXT NOT NULL,
+		PRIMARY KEY (upload_id, volume_id)
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// v1 stored full blob urls like http://vol:8081/ab/cd/hash
+	rows, err := tx.Query("SELECT key, volume_id FROM blobs_v1")
+	if err != nil {
+		return err
+	}
+	type oldBlob struct{ key, urls string }
+	var old []oldBlob
+	for rows.Next() {
+		var b oldBlob
+		var urls sql.NullString
+		if err := rows.Scan(&b.key, &urls); err != nil {
+			rows.Close()
+			return err
+		}
+		b.urls = urls.String
+		old = append(old, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	for _, b := range old {
+		var hash string
+		for _, u := range strings.Split(b.urls, ",") {
+			base, h, ok := splitBlobURL(u)
+			if !ok {
+				continue
+			}
+			hash = h
+			if _, err := tx.Exec("INSERT OR IGNORE INTO replicas (hash, volume_id, state) VALUES (?, ?, ?)",
+				h, base, ReplicaOK); err != nil {
+				return err
+			}
+		}
+		if hash == "" {
+			// nothing we can point the key at
+			continue
+		}
+		if _, err := tx.Exec("INSERT INTO blobs (key, hash, created_at, updated_at) VALUES (?, ?, ?, ?)",
+			b.key, hash, now, now); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`
+	INSERT INTO uploads (upload_id, key, created_at)
+		SELECT upload_id, key, created_at FROM uploads_v1;`)
+	if err != nil {
+		return err
+	}
+
+	rows, err = tx.Query("SELECT upload_id, volume_id FROM uploads_v1")
+	if err != nil {
+		return err
+	}
+	type oldUpload struct{ id, vols string }
+	var uploads []oldUpload
+	for rows.Next() {
+		var u oldUpload
+		var vols sql.NullString
+		if err := rows.Scan(&u.id, &vols); err != nil {
+			rows.Close()
+			return err
+		}
+		u.vols = vols.String
+		uploads = append(uploads, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, u := range uploads {
+		for _, v := range strings.Split(u.vols, ",") {
+			if v == "" {
+				continue
+			}
+			if _, err := tx.Exec("INSERT OR IGNORE INTO upload_volumes (upload_id, volume_id) VALUES (?, ?)", u.id, v); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = tx.Exec(`
+	DROP TABLE blobs_v1;
+	DROP TABLE uploads_v1;`)
+	return err
+}
+
+// migrate_volumes adds the volume registry. volumes known only from the
+// -volumes flag are still referenced by their url until they register.
+func migrateVolumes(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	-- id: stable id the volume keeps in its root
+	-- url: where the volume can currently be reached
+	-- total, free: disk space in bytes as of the last heartbeat
+	CREATE TABLE volumes (
+		id TEXT PRIMARY KEY,
+		url TEXT NOT NULL,
+		total INTEGER NOT NULL DEFAULT 0,
+		free INTEGER NOT NULL DEFAULT 0,
+		state TEXT NOT NULL DEFAULT 'up',
+		last_heartbeat INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE INDEX replicas_volume ON replicas (volume_id);`)
+	return err
+}
+
+// migrate_meta keeps headers besides content type with keys, and the
+// headers given when a multipart upload starts until it completes
+func migrateMeta(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	-- name: canonical header name, e.g. X-Mv-Meta-Author
+	CREATE TABLE blob_meta (
+		key TEXT NOT NULL,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (key, name)
+	);
+
+	ALTER TABLE uploads ADD COLUMN content_type TEXT NOT NULL DEFAULT '';
+
+	CREATE TABLE upload_meta (
+		upload_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (upload_id, name)
+	);`)
+	return err
+}
+
+// migrate_weights keeps each volume's placement weight and whether it
+// takes writes
+func migrateWeights(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	-- weight: share of new keys the volume gets, 0 if not known yet
+	-- read_only: 1 if the volume is too full to take writes
+	ALTER TABLE volumes ADD COLUMN weight REAL NOT NULL DEFAULT 0;
+	ALTER TABLE volumes ADD COLUMN read_only INTEGER NOT NULL DEFAULT 0;`)
+	return err
+}
+
+// migrate_topology keeps the failure domains each volume reports
+func migrateTopology(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	-- zone, rack, host: where the volume sits, '' if not given
+	ALTER TABLE volumes ADD COLUMN zone TEXT NOT NULL DEFAULT '';
+	ALTER TABLE volumes ADD COLUMN rack TEXT NOT NULL DEFAULT '';
+	ALTER TABLE volumes ADD COLUMN host TEXT NOT NULL DEFAULT '';`)
+	return err
+}
+
+// migrate_drain keeps how far decommissioning each volume has got
+func migrateDrain(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	-- drain: '' normally, draining while its blobs are moved off, drained
+	-- once it holds nothing
+	ALTER TABLE volumes ADD COLUMN drain TEXT NOT NULL DEFAULT '';`)
+	return err
+}
+
+// split_blob_url splits http://vol:8081/ab/cd/hash into the volume base
+// url and the hash
+func splitBlobURL(u string) (string, string, bool) {
+	parts := strings.Split(strings.TrimSpace(u), "/")
+	if len(parts) < 4 {
+		return "", "", false
+	}
+	hash := parts[len(parts)-1]
+	if len(hash) != 64 {
+		return "", "", false
+	}
+	return strings.Join(parts[:len(parts)-3], "/"), hash, true
+}
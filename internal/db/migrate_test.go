@@ -0,0 +1,214 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var (
+	hashA = strings.Repeat("a", 64)
+	hashB = strings.Repeat("b", 64)
+)
+
+// open_at creates a database with the schema of version, as a release that
+// stopped there would have left it
+func openAt(t *testing.T, version int) (*sql.DB, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "metadata.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for i := 0; i < version; i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := migrations[i](tx); err != nil {
+			t.Fatalf("migration %d: %v", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db, path
+}
+
+func userVersion(t *testing.T, path string) int {
+	t.Helper()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var v int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestMigrateFromEveryVersion(t *testing.T) {
+	for version := 0; version <= len(migrations); version++ {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			_, path := openAt(t, version)
+			store, err := NewStore(path)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			defer store.Close()
+			if v := userVersion(t, path); v != len(migrations) {
+				t.Fatalf("user_version = %d, want %d", v, len(migrations))
+			}
+
+			// the upgraded schema works
+			b := Blob{Key: "k", Hash: hashA, Size: 3, ContentType: "text/plain", Meta: map[string]string{"X-Mv-Meta-Owner": "me"}}
+			if _, err := store.PutBlob(b, []string{"v1"}); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+			if err := store.PutVolume(Volume{ID: "v1", URL: "http://v1", State: VolumeUp, Zone: "z1"}); err != nil {
+				t.Fatalf("put volume: %v", err)
+			}
+			got, err := store.GetBlob("k")
+			if err != nil || got == nil || got.Hash != hashA || got.Meta["X-Mv-Meta-Owner"] != "me" {
+				t.Fatalf("get = %+v, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestMigrateReopen(t *testing.T) {
+	_, path := openAt(t, 0)
+	for i := 0; i < 2; i++ {
+		store, err := NewStore(path)
+		if err != nil {
+			t.Fatalf("open %d: %v", i+1, err)
+		}
+		store.Close()
+	}
+	if v := userVersion(t, path); v != len(migrations) {
+		t.Fatalf("user_version = %d, want %d", v, len(migrations))
+	}
+}
+
+// a database from before migrations has the initial schema with
+// comma-joined blob urls and volume lists, and no user_version
+func TestMigrateV1Data(t *testing.T) {
+	db, path := openAt(t, 0)
+	_, err := db.Exec(`
+	CREATE TABLE blobs (key TEXT PRIMARY KEY, volume_id TEXT);
+	CREATE TABLE uploads (upload_id TEXT PRIMARY KEY, key TEXT, volume_id TEXT, created_at INTEGER);
+	CREATE TABLE upload_parts (upload_id TEXT, part_number INTEGER, size INTEGER, etag TEXT, PRIMARY KEY (upload_id, part_number));`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := []struct{ key, urls string }{
+		{"two", "http://vol1:8081/aa/aa/" + hashA + ",http://vol2:8081/aa/aa/" + hashA},
+		{"one", "http://vol2:8081/bb/bb/" + hashB},
+		{"junk", "http://vol1:8081/not-a-blob, "},
+		{"empty", ""},
+	}
+	for _, b := range blobs {
+		if _, err := db.Exec("INSERT INTO blobs (key, volume_id) VALUES (?, ?)", b.key, b.urls); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec("INSERT INTO uploads VALUES ('u1', 'big', 'http://vol1:8081,http://vol2:8081', 100)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO upload_parts VALUES ('u1', 1, 10, 'etag1')"); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+
+	tests := []struct {
+		key  string
+		hash string
+		vols []string
+	}{
+		{"two", hashA, []string{"http://vol1:8081", "http://vol2:8081"}},
+		{"one", hashB, []string{"http://vol2:8081"}},
+		{"junk", "", nil},
+		{"empty", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			b, err := store.GetBlob(tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.hash == "" {
+				if b != nil {
+					t.Fatalf("got %+v, want the key dropped", b)
+				}
+				return
+			}
+			if b == nil || b.Hash != tt.hash {
+				t.Fatalf("got %+v, want hash %s", b, tt.hash)
+			}
+			replicas, err := store.GetReplicas(tt.hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var vols []string
+			for _, r := range replicas {
+				if r.State != ReplicaOK {
+					t.Errorf("replica on %s is %s", r.VolumeID, r.State)
+				}
+				vols = append(vols, r.VolumeID)
+			}
+			slices.Sort(vols)
+			if !slices.Equal(vols, tt.vols) {
+				t.Errorf("replicas on %v, want %v", vols, tt.vols)
+			}
+		})
+	}
+
+	u, err := store.GetUpload("u1")
+	if err != nil || u == nil {
+		t.Fatalf("upload = %+v, %v", u, err)
+	}
+	slices.Sort(u.VolumeIDs)
+	if u.Key != "big" || !slices.Equal(u.VolumeIDs, []string{"http://vol1:8081", "http://vol2:8081"}) {
+		t.Errorf("upload = %+v", u)
+	}
+	parts, err := store.ListParts("u1")
+	if err != nil || len(parts) != 1 || parts[0].ETag != "etag1" {
+		t.Errorf("parts = %+v, %v", parts, err)
+	}
+}
+
+func TestSplitBlobURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		base string
+		hash string
+		ok   bool
+	}{
+		{"http://vol:8081/aa/aa/" + hashA, "http://vol:8081", hashA, true},
+		{" http://vol:8081/blob/aa/aa/" + hashA + " ", "http://vol:8081/blob", hashA, true},
+		{"http://vol:8081/aa/aa/short", "", "", false},
+		{"/" + hashA, "", "", false},
+		{"", "", "", false},
+	}
+	for _, tt := range tests {
+		base, hash, ok := splitBlobURL(tt.url)
+		if base != tt.base || hash != tt.hash || ok != tt.ok {
+			t.Errorf("split_blob_url(%q) = %q, %q, %v, want %q, %q, %v", tt.url, base, hash, ok, tt.base, tt.hash, tt.ok)
+		}
+	}
+}
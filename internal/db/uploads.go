@@ -0,0 +1,135 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// upload is an in-progress multipart upload
+type Upload struct {
+	ID        string
+	Key       string
+	VolumeIDs []string
+	// content_type and meta are given when the upload starts and end up
+	// on the blob
+	ContentType string
+	Meta        map[string]string
+	CreatedAt   time.Time
+}
+
+// part is an uploaded piece of a multipart upload
+type Part struct {
+	Number int
+	Size   int64
+	ETag   string
+}
+
+// create_upload records a new multipart upload and where its parts live.
+// u.id, u.key and u.volume_ids are required.
+func (s *Store) CreateUpload(u Upload) error {
+	defer observe("CreateUpload", time.Now())
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO uploads (upload_id, key, content_type, created_at) VALUES (?, ?, ?, ?)",
+		u.ID, u.Key, u.ContentType, time.Now().Unix()); err != nil {
+		return err
+	}
+	for _, vol := range u.VolumeIDs {
+		if _, err := tx.Exec("INSERT INTO upload_volumes (upload_id, volume_id) VALUES (?, ?)", u.ID, vol); err != nil {
+			return err
+		}
+	}
+	if err := putMeta(tx, "upload_meta", "upload_id", u.ID, u.Meta); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// get_upload retrieves a multipart upload, or nil if it doesn't exist
+func (s *Store) GetUpload(id string) (*Upload, error) {
+	defer observe("GetUpload", time.Now())
+	var u Upload
+	var created int64
+	err := s.db.QueryRow("SELECT upload_id, key, content_type, created_at FROM uploads WHERE upload_id = ?", id).
+		Scan(&u.ID, &u.Key, &u.ContentType, &created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.CreatedAt = time.Unix(created, 0)
+
+	u.VolumeIDs, err = s.listStrings("SELECT volume_id FROM upload_volumes WHERE upload_id = ? ORDER BY volume_id", id)
+	if err != nil {
+		return nil, err
+	}
+	u.Meta, err = s.getMeta("upload_meta", "upload_id", id)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// put_part records a part once all volumes have it. re-uploading a part
+// replaces it.
+func (s *Store) PutPart(id string, p Part) error {
+	defer observe("PutPart", time.Now())
+	_, err := s.db.Exec("INSERT OR REPLACE INTO upload_parts (upload_id, part_number, size, etag) VALUES (?, ?, ?, ?)",
+		id, p.Number, p.Size, p.ETag)
+	return err
+}
+
+// list_parts returns the recorded parts of an upload ordered by number
+func (s *Store) ListParts(id string) ([]Part, error) {
+	defer observe("ListParts", time.Now())
+	rows, err := s.db.Query("SELECT part_number, size, etag FROM upload_parts WHERE upload_id = ? ORDER BY part_number", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var parts []Part
+	for rows.Next() {
+		var p Part
+		if err := rows.Scan(&p.Number, &p.Size, &p.ETag); err != nil {
+			return nil, err
+		}
+		parts = append(parts, p)
+	}
+	return parts, rows.Err()
+}
+
+// stale_uploads returns the ids of uploads started before t
+func (s *Store) StaleUploads(t time.Time) ([]string, error) {
+	defer observe("StaleUploads", time.Now())
+	return s.listStrings("SELECT upload_id FROM uploads WHERE created_at < ? ORDER BY created_at", t.Unix())
+}
+
+// delete_upload removes an upload and its parts
+func (s *Store) DeleteUpload(id string) error {
+	defer observe("DeleteUpload", time.Now())
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM upload_parts WHERE upload_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM upload_volumes WHERE upload_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM upload_meta WHERE upload_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM uploads WHERE upload_id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
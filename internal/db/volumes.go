@@ -0,0 +1,138 @@
+package db
+
+import (
+	"time"
+)
+
+// volume states
+const (
+	VolumeUp   = "up"
+	VolumeDown = "down"
+)
+
+// how far a volume is drained
+const (
+	// blobs are being moved off the volume
+	Draining = "draining"
+	// the volume holds nothing and can be shut down
+	Drained = "drained"
+)
+
+// volume is a registered volume server
+type Volume struct {
+	ID            string
+	URL           string
+	Total         uint64
+	Free          uint64
+	State         string
+	LastHeartbeat time.Time
+
+	// weight is the volume's share of new keys, 0 if not known
+	Weight float64
+	// read_only volumes are too full to take writes. they stay up and
+	// serve what they hold.
+	ReadOnly bool
+
+	// the failure domains the volume is in
+	Zone string
+	Rack string
+	Host string
+
+	// drain is Draining or Drained while the volume is decommissioned, ""
+	// otherwise. it's only changed by set_volume_drain.
+	Drain string
+}
+
+// put_volume records a volume's latest heartbeat
+func (s *Store) PutVolume(v Volume) error {
+	defer observe("PutVolume", time.Now())
+	_, err := s.db.Exec(`
+	INSERT INTO volumes (id, url, total, free, weight, read_only, zone, rack, host, state, last_heartbeat)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (id) DO UPDATE SET
+		url = excluded.url,
+		total = excluded.total,
+		free = excluded.free,
+		weight = excluded.weight,
+		read_only = excluded.read_only,
+		zone = excluded.zone,
+		rack = excluded.rack,
+		host = excluded.host,
+		state = excluded.state,
+		last_heartbeat = excluded.last_heartbeat`,
+		v.ID, v.URL, v.Total, v.Free, v.Weight, v.ReadOnly, v.Zone, v.Rack, v.Host, v.State, v.LastHeartbeat.Unix())
+	return err
+}
+
+// get_volumes returns every registered volume
+func (s *Store) GetVolumes() ([]Volume, error) {
+	defer observe("GetVolumes", time.Now())
+	rows, err := s.db.Query("SELECT id, url, total, free, weight, read_only, zone, rack, host, drain, state, last_heartbeat FROM volumes ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var vols []Volume
+	for rows.Next() {
+		var v Volume
+		var hb int64
+		if err := rows.Scan(&v.ID, &v.URL, &v.Total, &v.Free, &v.Weight, &v.ReadOnly, &v.Zone, &v.Rack, &v.Host, &v.Drain, &v.State, &hb); err != nil {
+			return nil, err
+		}
+		v.LastHeartbeat = time.Unix(hb, 0)
+		vols = append(vols, v)
+	}
+	return vols, rows.Err()
+}
+
+// set_volume_state marks a volume up or down
+func (s *Store) SetVolumeState(id, state string) error {
+	defer observe("SetVolumeState", time.Now())
+	_, err := s.db.Exec("UPDATE volumes SET state = ? WHERE id = ?", state, id)
+	return err
+}
+
+// set_volume_drain records how far a volume is drained
+func (s *Store) SetVolumeDrain(id, drain string) error {
+	defer observe("SetVolumeDrain", time.Now())
+	_, err := s.db.Exec("UPDATE volumes SET drain = ? WHERE id = ?", drain, id)
+	return err
+}
+
+// hashes_on returns the hashes with a copy recorded on a volume, in any
+// state
+func (s *Store) HashesOn(volumeID string) ([]string, error) {
+	defer observe("HashesOn", time.Now())
+	return s.listStrings("SELECT hash FROM replicas WHERE volume_id = ? ORDER BY hash", volumeID)
+}
+
+// count_replicas returns how many copies are recorded on a volume
+func (s *Store) CountReplicas(volumeID string) (int, error) {
+	defer observe("CountReplicas", time.Now())
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM replicas WHERE volume_id = ?", volumeID).Scan(&n)
+	return n, err
+}
+
+// adopt_volume moves replicas and uploads recorded under oldID (a volume's
+// url, from before it registered) over to id
+func (s *Store) AdoptVolume(oldID, id string) error {
+	defer observe("AdoptVolume", time.Now())
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"replicas", "upload_volumes"} {
+		// a row already under the new id wins over the legacy one
+		if _, err := tx.Exec("UPDATE OR IGNORE "+table+" SET volume_id = ? WHERE volume_id = ?", id, oldID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE volume_id = ?", oldID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
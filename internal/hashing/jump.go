@@ -0,0 +1,114 @@
+package hashing
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// buckets per unit of weight for jump
+const jumpBuckets = 16
+
+// hashes of a key jump tries before settling for the next free bucket
+const jumpTries = 64
+
+// jump is jump consistent hashing (lamping and veach): a key maps straight
+// to one of n buckets, perfectly evenly and with no table. growing from n
+// to n+1 buckets moves only the keys the new one takes, but buckets are
+// volumes in sorted order, so that only holds for volumes whose ids sort
+// last. any other change shifts the volumes after it and moves far more.
+// each volume gets jumpBuckets buckets per unit of weight, so reweighting
+// one shifts the volumes after it too.
+type Jump struct {
+	mu      sync.RWMutex
+	nodes   []string // sorted
+	weights map[string]float64
+	buckets []string // each node as many times as its weight calls for
+}
+
+// new_jump returns an empty jump hash
+func NewJump() *Jump {
+	return &Jump{weights: make(map[string]float64)}
+}
+
+func (j *Jump) AddNode(n Node) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	i, found := slices.BinarySearch(j.nodes, n.ID)
+	if !found {
+		j.nodes = slices.Insert(j.nodes, i, n.ID)
+	}
+	j.weights[n.ID] = weightOrOne(n.Weight)
+	j.rebucket()
+}
+
+func (j *Jump) RemoveNode(id string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if i, found := slices.BinarySearch(j.nodes, id); found {
+		j.nodes = slices.Delete(j.nodes, i, i+1)
+	}
+	delete(j.weights, id)
+	j.rebucket()
+}
+
+// rebucket lays the buckets out again after a change. callers hold mu.
+func (j *Jump) rebucket() {
+	j.buckets = j.buckets[:0]
+	for _, node := range j.nodes {
+		count := max(1, int(math.Round(jumpBuckets*j.weights[node])))
+		for range count {
+			j.buckets = append(j.buckets, node)
+		}
+	}
+}
+
+func (j *Jump) GetNode(key string) string {
+	nodes := j.GetNodes(key, 1)
+	if len(nodes) == 0 {
+		return ""
+	}
+	return nodes[0]
+}
+
+// get_nodes picks each replica by jumping over the buckets with the key
+// hashed afresh, until it lands on a volume not picked yet
+func (j *Jump) GetNodes(key string, n int) []string {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	n = min(n, len(j.nodes))
+	result := make([]string, 0, n)
+	picked := make(map[string]bool, n)
+	for i := 0; len(result) < n; i++ {
+		h := hash64(key)
+		if i > 0 {
+			h = hash64(key + "\x00" + strconv.Itoa(i))
+		}
+		b := jumpHash(h, len(j.buckets))
+		if i >= jumpTries {
+			// a few heavy volumes keep winning; take the next bucket
+			// along that isn't theirs
+			for picked[j.buckets[b]] {
+				b = (b + 1) % len(j.buckets)
+			}
+		}
+		if node := j.buckets[b]; !picked[node] {
+			picked[node] = true
+			result = append(result, node)
+		}
+	}
+	return result
+}
+
+// jump_hash maps key to a bucket in [0, buckets)
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
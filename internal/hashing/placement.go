@@ -0,0 +1,102 @@
+package hashing
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// node is a volume as placement sees it
+type Node struct {
+	ID string
+	// weight is the volume's share of the keys: it gets them in proportion
+	// to it. 1 is an ordinary volume, and 0 or less counts as 1.
+	Weight float64
+	// domain is where the volume sits, to spread copies over
+	Domain Domain
+}
+
+// placement decides which volumes hold a key. every strategy gives the
+// same answer for the same nodes wherever it runs, so the master and mkv
+// agree as long as they're configured alike.
+type Placement interface {
+	// add_node adds a volume. nodes are added before any lookup.
+	AddNode(n Node)
+	// remove_node takes a volume out. its keys go to the volumes that
+	// would have had them without it.
+	RemoveNode(id string)
+	// get_node returns the volume a key belongs on first
+	GetNode(key string) string
+	// get_nodes returns up to n distinct volumes for a key, most
+	// preferred first. asking for more gives the same volumes first.
+	GetNodes(key string, n int) []string
+}
+
+// placement strategies
+const (
+	// consistent hashing on a ring with VNodes points per volume
+	StrategyRing = "ring"
+	// jump consistent hash: even, but only cheap to grow when new volumes
+	// sort after the existing ones
+	StrategyJump = "jump"
+	// rendezvous (highest random weight) hashing: even, and a membership
+	// change only moves the keys it has to, at the cost of hashing the key
+	// with every volume on each lookup
+	StrategyRendezvous = "rendezvous"
+	// the original ring: crc32 with VNodes points per volume. only for
+	// clusters whose blobs were placed with it.
+	StrategyCRC32 = "crc32"
+)
+
+// strategies lists every strategy by name
+var Strategies = []string{StrategyRing, StrategyJump, StrategyRendezvous, StrategyCRC32}
+
+// default number of points per volume on a ring
+const DefaultVNodes = 128
+
+// options pick and tune a strategy
+type Options struct {
+	Strategy string
+	// vnodes is the number of points per volume, for the rings
+	VNodes int
+}
+
+// new returns an empty placement. whatever the strategy, the copies of a
+// key are spread over the volumes' failure domains.
+func New(opts Options) (Placement, error) {
+	vnodes := opts.VNodes
+	if vnodes <= 0 {
+		vnodes = DefaultVNodes
+	}
+	var p Placement
+	switch opts.Strategy {
+	case "", StrategyRing:
+		p = NewRing(vnodes)
+	case StrategyJump:
+		p = NewJump()
+	case StrategyRendezvous:
+		p = NewRendezvous()
+	case StrategyCRC32:
+		p = newCRC32Ring(vnodes)
+	default:
+		return nil, fmt.Errorf("unknown placement %q (want %s)", opts.Strategy, strings.Join(Strategies, ", "))
+	}
+	return &spread{Placement: p, topology: NewTopology()}, nil
+}
+
+// weight_or_one is weight, or 1 if it's unset
+func weightOrOne(weight float64) float64 {
+	if weight <= 0 {
+		return 1
+	}
+	return weight
+}
+
+// hash64 is a well mixed 64 bit hash of s: the start of its sha256. it's
+// slower than a non-cryptographic hash, but stable everywhere and spreads
+// similar strings (like a volume's ring points) evenly.
+func hash64(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,245 @@
+package hashing
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+)
+
+const testKeys = 20000
+
+func newPlacement(t *testing.T, strategy string, nodes ...Node) Placement {
+	t.Helper()
+	p, err := New(Options{Strategy: strategy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range nodes {
+		p.AddNode(n)
+	}
+	return p
+}
+
+func nodes(ids ...string) []Node {
+	out := make([]Node, len(ids))
+	for i, id := range ids {
+		out[i] = Node{ID: id}
+	}
+	return out
+}
+
+// share counts the keys each node gets first
+func share(p Placement) map[string]int {
+	counts := make(map[string]int)
+	for i := range testKeys {
+		counts[p.GetNode(fmt.Sprintf("key-%d", i))]++
+	}
+	return counts
+}
+
+func TestNewUnknownStrategy(t *testing.T) {
+	if _, err := New(Options{Strategy: "random"}); err == nil {
+		t.Fatal("unknown strategy accepted")
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	for _, strategy := range Strategies {
+		p := newPlacement(t, strategy)
+		if got := p.GetNodes("key", 3); len(got) != 0 {
+			t.Errorf("%s: empty placement gave %v", strategy, got)
+		}
+	}
+}
+
+// get_nodes gives distinct nodes, as many as asked for or there are, most
+// preferred first and the same ones first however many are asked for
+func TestGetNodes(t *testing.T) {
+	for _, strategy := range Strategies {
+		t.Run(strategy, func(t *testing.T) {
+			p := newPlacement(t, strategy, nodes("a", "b", "c", "d", "e")...)
+			for i := range 500 {
+				key := fmt.Sprintf("key-%d", i)
+				all := p.GetNodes(key, 10)
+				if len(all) != 5 {
+					t.Fatalf("%s: got %d nodes, want 5", key, len(all))
+				}
+				if sorted := slices.Sorted(slices.Values(all)); len(slices.Compact(sorted)) != 5 {
+					t.Fatalf("%s: nodes repeat: %v", key, all)
+				}
+				if first := p.GetNode(key); first != all[0] {
+					t.Fatalf("%s: get_node = %s, get_nodes starts with %s", key, first, all[0])
+				}
+				for n := 1; n <= 5; n++ {
+					if got := p.GetNodes(key, n); !slices.Equal(got, all[:n]) {
+						t.Fatalf("%s: get_nodes(%d) = %v, want %v", key, n, got, all[:n])
+					}
+				}
+			}
+		})
+	}
+}
+
+// placement only depends on the nodes, not the order they came in, so the
+// master and mkv agree
+func TestOrderIndependent(t *testing.T) {
+	for _, strategy := range Strategies {
+		t.Run(strategy, func(t *testing.T) {
+			p := newPlacement(t, strategy, nodes("a", "b", "c", "d")...)
+			q := newPlacement(t, strategy, nodes("d", "b", "a", "c")...)
+			for i := range 1000 {
+				key := fmt.Sprintf("key-%d", i)
+				if got, want := q.GetNodes(key, 3), p.GetNodes(key, 3); !slices.Equal(got, want) {
+					t.Fatalf("%s: %v, want %v", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEven(t *testing.T) {
+	tests := []struct {
+		strategy string
+		// tolerance is how far from an even share a node may be
+		tolerance float64
+	}{
+		{StrategyRing, 0.15},
+		{StrategyJump, 0.05},
+		{StrategyRendezvous, 0.05},
+		{StrategyCRC32, 0.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			ids := []string{"a", "b", "c", "d", "e"}
+			counts := share(newPlacement(t, tt.strategy, nodes(ids...)...))
+			even := float64(testKeys) / float64(len(ids))
+			for _, id := range ids {
+				if off := math.Abs(float64(counts[id])-even) / even; off > tt.tolerance {
+					t.Errorf("%s has %d keys, %.0f%% off an even %.0f", id, counts[id], off*100, even)
+				}
+			}
+		})
+	}
+}
+
+func TestWeights(t *testing.T) {
+	tests := []struct {
+		strategy  string
+		tolerance float64
+	}{
+		{StrategyRing, 0.15},
+		{StrategyJump, 0.05},
+		{StrategyRendezvous, 0.05},
+	}
+	weighted := []Node{{ID: "small", Weight: 1}, {ID: "unset"}, {ID: "big", Weight: 3}, {ID: "half", Weight: 0.5}}
+	want := map[string]float64{"small": 1, "unset": 1, "big": 3, "half": 0.5}
+	total := 5.5
+
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			counts := share(newPlacement(t, tt.strategy, weighted...))
+			for id, w := range want {
+				expect := testKeys * w / total
+				if off := math.Abs(float64(counts[id])-expect) / expect; off > tt.tolerance {
+					t.Errorf("%s has %d keys, %.0f%% off its %.0f", id, counts[id], off*100, expect)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoveNode(t *testing.T) {
+	tests := []struct {
+		strategy string
+		remove   string
+		// stable says every key keeps its first node unless it was the
+		// removed one
+		stable bool
+	}{
+		{StrategyRing, "c", true},
+		{StrategyRendezvous, "c", true},
+		{StrategyCRC32, "c", true},
+		// jump only keeps keys in place when the last node goes
+		{StrategyJump, "e", true},
+		{StrategyJump, "a", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy+" "+tt.remove, func(t *testing.T) {
+			p := newPlacement(t, tt.strategy, nodes("a", "b", "c", "d", "e")...)
+			before := make([]string, testKeys)
+			for i := range before {
+				before[i] = p.GetNode(fmt.Sprintf("key-%d", i))
+			}
+			p.RemoveNode(tt.remove)
+
+			moved := 0
+			for i, was := range before {
+				now := p.GetNode(fmt.Sprintf("key-%d", i))
+				if now == tt.remove {
+					t.Fatalf("key-%d still on the removed node", i)
+				}
+				if was != tt.remove && now != was {
+					moved++
+				}
+			}
+			if tt.stable && moved > 0 {
+				t.Errorf("%d keys moved that weren't on %s", moved, tt.remove)
+			}
+			if !tt.stable && moved == 0 {
+				t.Errorf("no keys moved, expected jump to shift them")
+			}
+		})
+	}
+}
+
+// adding a node only takes keys for it; none move between the others
+func TestAddNode(t *testing.T) {
+	for _, strategy := range []string{StrategyRing, StrategyRendezvous, StrategyCRC32, StrategyJump} {
+		t.Run(strategy, func(t *testing.T) {
+			p := newPlacement(t, strategy, nodes("a", "b", "c", "d")...)
+			before := make([]string, testKeys)
+			for i := range before {
+				before[i] = p.GetNode(fmt.Sprintf("key-%d", i))
+			}
+			// sorts last, which jump needs
+			p.AddNode(Node{ID: "z"})
+
+			taken := 0
+			for i, was := range before {
+				now := p.GetNode(fmt.Sprintf("key-%d", i))
+				switch now {
+				case was:
+				case "z":
+					taken++
+				default:
+					t.Fatalf("key-%d moved from %s to %s", i, was, now)
+				}
+			}
+			if expect := testKeys / 5; taken < expect/2 || taken > expect*2 {
+				t.Errorf("new node took %d keys, expected about %d", taken, expect)
+			}
+		})
+	}
+}
+
+func TestJumpHash(t *testing.T) {
+	// growing the buckets only moves keys to the new bucket
+	for key := uint64(0); key < 5000; key++ {
+		h := hash64(fmt.Sprint(key))
+		prev := jumpHash(h, 1)
+		if prev != 0 {
+			t.Fatalf("one bucket gave %d", prev)
+		}
+		for buckets := 2; buckets <= 50; buckets++ {
+			b := jumpHash(h, buckets)
+			if b < 0 || b >= buckets {
+				t.Fatalf("jump_hash(%d, %d) = %d, out of range", h, buckets, b)
+			}
+			if b != prev && b != buckets-1 {
+				t.Fatalf("growing to %d buckets moved a key from %d to %d", buckets, prev, b)
+			}
+			prev = b
+		}
+	}
+}
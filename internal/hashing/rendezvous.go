@@ -0,0 +1,84 @@
+package hashing
+
+import (
+	"math"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// rendezvous is highest random weight hashing: every volume scores every
+// key with a hash of the two, and a key belongs to the volumes scoring it
+// highest. it's even without virtual nodes, and adding or removing a volume
+// only moves the keys it wins or held. each lookup hashes the key once per
+// volume, which is fine for the tens of volumes a cluster has. weights are
+// applied the logarithmic way (schindelhauer and schomaker), so a volume
+// wins keys exactly in proportion to its weight.
+type Rendezvous struct {
+	mu      sync.RWMutex
+	nodes   []string
+	weights map[string]float64
+}
+
+// new_rendezvous returns an empty rendezvous hash
+func NewRendezvous() *Rendezvous {
+	return &Rendezvous{weights: make(map[string]float64)}
+}
+
+func (r *Rendezvous) AddNode(n Node) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.weights[n.ID]; !ok {
+		r.nodes = append(r.nodes, n.ID)
+	}
+	r.weights[n.ID] = weightOrOne(n.Weight)
+}
+
+func (r *Rendezvous) RemoveNode(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nodes = slices.DeleteFunc(r.nodes, func(n string) bool { return n == id })
+	delete(r.weights, id)
+}
+
+func (r *Rendezvous) GetNode(key string) string {
+	nodes := r.GetNodes(key, 1)
+	if len(nodes) == 0 {
+		return ""
+	}
+	return nodes[0]
+}
+
+func (r *Rendezvous) GetNodes(key string, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	type scored struct {
+		node  string
+		score float64
+	}
+	all := make([]scored, len(r.nodes))
+	for i, node := range r.nodes {
+		all[i] = scored{node, score(hash64(node+"\x00"+key), r.weights[node])}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].score != all[j].score {
+			return all[i].score > all[j].score
+		}
+		return all[i].node < all[j].node
+	})
+
+	result := make([]string, 0, min(n, len(all)))
+	for _, s := range all[:min(n, len(all))] {
+		result = append(result, s.node)
+	}
+	return result
+}
+
+// score turns a hash into a volume's bid for a key: -weight/ln(u) for the
+// hash as a number u in (0, 1). it grows with the hash, so equal weights
+// rank volumes by their hashes alone.
+func score(h uint64, weight float64) float64 {
+	u := (float64(h>>11) + 0.5) / (1 << 53)
+	return -weight / math.Log(u)
+}
@@ -2,34 +2,57 @@ package hashing
 
 import (
 	"hash/crc32"
+	"math"
+	"slices"
 	"sort"
 	"strconv"
 	"sync"
 )
 
+// ring is consistent hashing: every volume gets vnodes points on a ring of
+// hashes, and a key belongs to the volumes owning the next points
+// clockwise from its own hash. adding or removing a volume only moves the
+// keys next to its points. more points even out the load. weights scale
+// the points, so a volume of weight 2 gets twice as many.
 type Ring struct {
-	nodes    []string
-	vNodes   map[uint32]string
-	sorted   []uint32
-	replicas int
-	mu       sync.RWMutex
+	nodes  []string
+	vNodes map[uint64]string
+	sorted []uint64
+	points int
+	hash   func(string) uint64
+	mu     sync.RWMutex
 }
 
-func NewRing(replicas int) *Ring {
+// new_ring returns an empty ring with vnodes points per unit of weight
+func NewRing(vnodes int) *Ring {
 	return &Ring{
-		vNodes:   make(map[uint32]string),
-		replicas: replicas,
+		vNodes: make(map[uint64]string),
+		points: vnodes,
+		hash:   hash64,
 	}
 }
 
-func (r *Ring) AddNode(node string) {
+// new_crc32_ring is the ring as it first was, hashed with crc32
+func newCRC32Ring(vnodes int) *Ring {
+	r := NewRing(vnodes)
+	r.hash = func(s string) uint64 {
+		return uint64(crc32.ChecksumIEEE([]byte(s)))
+	}
+	return r
+}
+
+func (r *Ring) AddNode(n Node) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	r.nodes = append(r.nodes, node)
-	for i := 0; i < r.replicas; i++ {
-		hash := r.hash(node + strconv.Itoa(i))
-		r.vNodes[hash] = node
+	// every volume keeps at least one point. point i of a volume is where
+	// it is whatever the weight, so reweighting only moves the keys next
+	// to the points gained or lost.
+	points := max(1, int(math.Round(float64(r.points)*weightOrOne(n.Weight))))
+	r.nodes = append(r.nodes, n.ID)
+	for i := 0; i < points; i++ {
+		hash := r.hash(n.ID + strconv.Itoa(i))
+		r.vNodes[hash] = n.ID
 		r.sorted = append(r.sorted, hash)
 	}
 	sort.Slice(r.sorted, func(i, j int) bool {
@@ -37,6 +60,20 @@ func (r *Ring) AddNode(node string) {
 	})
 }
 
+func (r *Ring) RemoveNode(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nodes = slices.DeleteFunc(r.nodes, func(n string) bool { return n == id })
+	r.sorted = slices.DeleteFunc(r.sorted, func(hash uint64) bool {
+		if r.vNodes[hash] != id {
+			return false
+		}
+		delete(r.vNodes, hash)
+		return true
+	})
+}
+
 func (r *Ring) GetNode(key string) string {
 	nodes := r.GetNodes(key, 1)
 	if len(nodes) == 0 {
@@ -80,7 +117,3 @@ func (r *Ring) GetNodes(key string, n int) []string {
 
 	return result
 }
-
-func (r *Ring) hash(key string) uint32 {
-	return crc32.ChecksumIEEE([]byte(key))
-}
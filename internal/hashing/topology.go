@@ -0,0 +1,200 @@
+package hashing
+
+import (
+	"fmt"
+	"sync"
+)
+
+// failure domains, widest first. a rack is in a zone and a host in a rack,
+// so two racks with the same name in different zones are different racks.
+const (
+	levelZone = iota
+	levelRack
+	levelHost
+	levels
+)
+
+var levelNames = [levels]string{"zone", "rack", "host"}
+
+// domain is where a volume sits. volumes sharing a domain can fail
+// together: a host takes its disks with it, a rack its hosts, and so on.
+// empty names are a domain like any other.
+type Domain struct {
+	Zone string
+	Rack string
+	Host string
+}
+
+// key names the domain at level
+func (d Domain) key(level int) string {
+	switch level {
+	case levelZone:
+		return d.Zone
+	case levelRack:
+		return d.Zone + "/" + d.Rack
+	}
+	return d.Zone + "/" + d.Rack + "/" + d.Host
+}
+
+func (d Domain) String() string {
+	return d.key(levelHost)
+}
+
+// topology knows the domain of every volume and spreads the copies of a
+// key over as many zones as it can, then racks, then hosts
+type Topology struct {
+	mu      sync.RWMutex
+	domains map[string]Domain
+	// volumes in each domain at each level
+	counts [levels]map[string]int
+}
+
+// new_topology returns an empty topology
+func NewTopology() *Topology {
+	t := &Topology{domains: make(map[string]Domain)}
+	for i := range t.counts {
+		t.counts[i] = make(map[string]int)
+	}
+	return t
+}
+
+// add places a volume in a domain
+func (t *Topology) Add(node string, d Domain) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.domains[node]; ok {
+		return
+	}
+	t.domains[node] = d
+	for level := range t.counts {
+		t.counts[level][d.key(level)]++
+	}
+}
+
+// remove forgets a volume
+func (t *Topology) Remove(node string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d, ok := t.domains[node]
+	if !ok {
+		return
+	}
+	delete(t.domains, node)
+	for level := range t.counts {
+		key := d.key(level)
+		if t.counts[level][key]--; t.counts[level][key] == 0 {
+			delete(t.counts[level], key)
+		}
+	}
+}
+
+// len returns the number of volumes
+func (t *Topology) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.domains)
+}
+
+// flat reports whether every volume is in the same domains, so there is
+// nothing to spread over
+func (t *Topology) flat() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, c := range t.counts {
+		if len(c) > 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// spread picks n of the volumes in prefs, which are in order of
+// preference. the first pass takes the most preferred volume of each zone,
+// the next ones the most preferred left in each rack and host not picked
+// from yet, and the last whatever is left, in order. so the copies span
+// as many domains as they can at every level, and asking for more copies
+// gives the same ones first.
+func (t *Topology) Spread(prefs []string, n int) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	n = min(n, len(prefs))
+	result := make([]string, 0, n)
+	picked := make(map[string]bool, n)
+	for level := levelZone; level <= levels && len(result) < n; level++ {
+		used := make(map[string]bool)
+		if level < levels {
+			for _, node := range result {
+				used[t.domains[node].key(level)] = true
+			}
+		}
+		for _, node := range prefs {
+			if len(result) == n {
+				break
+			}
+			if picked[node] {
+				continue
+			}
+			if level < levels {
+				key := t.domains[node].key(level)
+				if used[key] {
+					continue
+				}
+				used[key] = true
+			}
+			picked[node] = true
+			result = append(result, node)
+		}
+	}
+	return result
+}
+
+// check returns an error if nodes, the volumes holding copies of a key,
+// crowd into fewer domains than they could: at every level the copies
+// should span as many domains as there are copies, or as there are
+// domains. volumes it doesn't know are left out.
+func (t *Topology) Check(nodes []string) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var known []Domain
+	for _, node := range nodes {
+		if d, ok := t.domains[node]; ok {
+			known = append(known, d)
+		}
+	}
+	for level := range t.counts {
+		spanned := make(map[string]bool)
+		for _, d := range known {
+			spanned[d.key(level)] = true
+		}
+		if want := min(len(known), len(t.counts[level])); len(spanned) < want {
+			return fmt.Errorf("%d copies span %d of %d %ss", len(known), len(spanned), len(t.counts[level]), levelNames[level])
+		}
+	}
+	return nil
+}
+
+// spread wraps a strategy to spread each key's copies over failure
+// domains. the strategy still picks the first copy.
+type spread struct {
+	Placement
+	topology *Topology
+}
+
+func (s *spread) AddNode(n Node) {
+	s.Placement.AddNode(n)
+	s.topology.Add(n.ID, n.Domain)
+}
+
+func (s *spread) RemoveNode(id string) {
+	s.Placement.RemoveNode(id)
+	s.topology.Remove(id)
+}
+
+func (s *spread) GetNodes(key string, n int) []string {
+	if s.topology.flat() {
+		return s.Placement.GetNodes(key, n)
+	}
+	return s.topology.Spread(s.Placement.GetNodes(key, s.topology.Len()), n)
+}
@@ -0,0 +1,120 @@
+package hashing
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// a cluster of two zones: z1 has two racks, z2 one rack with two hosts
+var testDomains = map[string]Domain{
+	"a": {Zone: "z1", Rack: "r1", Host: "h1"},
+	"b": {Zone: "z1", Rack: "r1", Host: "h2"},
+	"c": {Zone: "z1", Rack: "r2", Host: "h3"},
+	"d": {Zone: "z2", Rack: "r1", Host: "h4"},
+	"e": {Zone: "z2", Rack: "r1", Host: "h5"},
+	"f": {Zone: "z2", Rack: "r1", Host: "h5"},
+}
+
+func newTestTopology() *Topology {
+	t := NewTopology()
+	for node, d := range testDomains {
+		t.Add(node, d)
+	}
+	return t
+}
+
+func TestSpread(t *testing.T) {
+	top := newTestTopology()
+
+	tests := []struct {
+		name  string
+		prefs []string
+		n     int
+		want  []string
+	}{
+		{"one copy is the first preference", []string{"b", "a", "d"}, 1, []string{"b"}},
+		{"zones first", []string{"a", "b", "c", "d"}, 2, []string{"a", "d"}},
+		{"then racks", []string{"a", "b", "c", "d"}, 3, []string{"a", "d", "c"}},
+		{"then hosts", []string{"a", "b", "c", "d"}, 4, []string{"a", "d", "c", "b"}},
+		{"racks in another zone are other racks", []string{"a", "d", "b"}, 2, []string{"a", "d"}},
+		{"hosts before a second disk", []string{"e", "f", "d"}, 2, []string{"e", "d"}},
+		{"whatever is left last", []string{"e", "f", "d"}, 3, []string{"e", "d", "f"}},
+		{"no more than there are", []string{"a", "d"}, 5, []string{"a", "d"}},
+		{"none", nil, 3, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := top.Spread(tt.prefs, tt.n); !slices.Equal(got, tt.want) {
+				t.Errorf("spread(%v, %d) = %v, want %v", tt.prefs, tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	top := newTestTopology()
+
+	tests := []struct {
+		name  string
+		nodes []string
+		ok    bool
+	}{
+		{"one copy", []string{"a"}, true},
+		{"two zones", []string{"a", "d"}, true},
+		{"one zone for two copies", []string{"a", "c"}, false},
+		{"zones and racks", []string{"a", "c", "d"}, true},
+		{"one rack in z1 for two of three copies", []string{"a", "b", "d"}, false},
+		{"two disks of a host", []string{"a", "c", "e", "f"}, false},
+		{"unknown volumes left out", []string{"a", "x", "d"}, true},
+		{"everything", []string{"a", "b", "c", "d", "e", "f"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := top.Check(tt.nodes)
+			if (err == nil) != tt.ok {
+				t.Errorf("check(%v) = %v, want ok %v", tt.nodes, err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestTopologyRemove(t *testing.T) {
+	top := newTestTopology()
+	top.Remove("d")
+	top.Remove("e")
+	top.Remove("f")
+	if top.Len() != 3 {
+		t.Fatalf("len = %d, want 3", top.Len())
+	}
+	// z1 is the only zone left, so copies only need to span its racks
+	if err := top.Check([]string{"a", "c"}); err != nil {
+		t.Errorf("check after removing z2: %v", err)
+	}
+}
+
+// every strategy spreads the copies of every key over the zones
+func TestPlacementSpreads(t *testing.T) {
+	var domained []Node
+	for _, id := range []string{"a", "b", "c", "d", "e", "f"} {
+		domained = append(domained, Node{ID: id, Domain: testDomains[id]})
+	}
+	for _, strategy := range Strategies {
+		t.Run(strategy, func(t *testing.T) {
+			p := newPlacement(t, strategy, domained...)
+			top := newTestTopology()
+			for i := range 1000 {
+				key := fmt.Sprintf("key-%d", i)
+				for n := 1; n <= len(domained); n++ {
+					got := p.GetNodes(key, n)
+					if len(got) != n {
+						t.Fatalf("%s: %d copies, want %d", key, len(got), n)
+					}
+					if err := top.Check(got); err != nil {
+						t.Fatalf("%s: %v: %v", key, got, err)
+					}
+				}
+			}
+		})
+	}
+}
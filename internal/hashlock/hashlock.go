@@ -0,0 +1,67 @@
+package hashlock
+
+import "sync"
+
+// locks serialize the changes that decide whether content stays on the
+// volumes: linking keys to it, deleting it and copying it around. the api
+// and the repairer share one set, so a key can't be linked to content that
+// a concurrent delete of its last other key is removing, and repair can't
+// copy content back that was just deleted. a caller holds at most one hash
+// lock at a time, so there is no lock order to get wrong.
+//
+// the zero value is ready to use.
+type Locks struct {
+	mu    sync.Mutex
+	locks map[string]*hashLock
+	// purges counts deletes of content from the volumes, so a write that
+	// only learns its hash once the volumes have the content can tell
+	// whether one ran meanwhile
+	purges uint64
+}
+
+type hashLock struct {
+	sync.Mutex
+	waiters int
+}
+
+// lock locks hash and returns the unlock func
+func (l *Locks) Lock(hash string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*hashLock)
+	}
+	hl, ok := l.locks[hash]
+	if !ok {
+		hl = &hashLock{}
+		l.locks[hash] = hl
+	}
+	hl.waiters++
+	l.mu.Unlock()
+
+	hl.Lock()
+	return func() {
+		hl.Unlock()
+		l.mu.Lock()
+		hl.waiters--
+		if hl.waiters == 0 {
+			delete(l.locks, hash)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// purged records a purge. it's called once the deletes are done, so a
+// write that started before the last of them landed sees a new
+// generation.
+func (l *Locks) Purged() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.purges++
+}
+
+// generation returns how many purges there have been
+func (l *Locks) Generation() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.purges
+}
@@ -0,0 +1,88 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// the journal is an append-only file of JSON lines kept in each volume's
+// root. volumes only know blobs by hash, so the journal is what lets a
+// rebuild map user keys back onto them when the master's index is lost.
+
+const (
+	OpPut    = "put"
+	OpDelete = "delete"
+)
+
+// record is a single journal line
+type Record struct {
+	Op          string    `json:"op"`
+	Key         string    `json:"key"`
+	Hash        string    `json:"hash"`
+	Size        int64     `json:"size,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Time        time.Time `json:"time"`
+
+	// meta holds the other headers stored with the key
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+// journal appends records to a file
+type Journal struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// open opens (or creates) the journal at path for appending
+func Open(path string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{f: f}, nil
+}
+
+// append writes rec as one line and syncs it to disk
+func (j *Journal) Append(rec Record) error {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := j.f.Write(line); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// close closes the journal file
+func (j *Journal) Close() error {
+	return j.f.Close()
+}
+
+// read decodes every record in r. a torn last line (e.g. from a crash
+// mid-append) is skipped rather than failing the whole read.
+func Read(r io.Reader) ([]Record, error) {
+	var recs []Record
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var rec Record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	return recs, sc.Err()
+}
@@ -0,0 +1,277 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/afonp/microvault/internal/trace"
+)
+
+// every binary logs through log/slog, as text or json. the master gives
+// each request an id, which it sends on to the volumes it talks to and
+// puts on the redirects it hands out, so one request can be followed
+// through the logs of every process it touched.
+
+// header carrying the request id between processes
+const RequestIDHeader = "X-Request-Id"
+
+// query parameter carrying the request id on redirects to volumes
+const RequestIDParam = "request_id"
+
+// options are the logging flags
+type Options struct {
+	Format string
+	Level  string
+}
+
+// flags registers the logging flags on the command line
+func Flags() *Options {
+	o := &Options{}
+	flag.StringVar(&o.Format, "log-format", "text", "log format: text or json")
+	flag.StringVar(&o.Level, "log-level", "info", "log level: debug, info, warn or error")
+	return o
+}
+
+// setup makes slog's default logger write to stderr as opts says. the log
+// package goes through it too.
+func Setup(opts *Options) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(opts.Level)); err != nil {
+		return fmt.Errorf("unknown -log-level %q", opts.Level)
+	}
+	ho := &slog.HandlerOptions{Level: level}
+	switch opts.Format {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, ho)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, ho)))
+	default:
+		return fmt.Errorf("unknown -log-format %q", opts.Format)
+	}
+	return nil
+}
+
+// fatal logs msg as an error and exits
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// paths requested every few seconds by machines. their requests are only
+// logged at debug level and aren't traced, so they don't drown everything
+// else.
+var quiet = map[string]bool{
+	"/_health":            true,
+	"/_volumes/heartbeat": true,
+	"/metrics":            true,
+}
+
+type requestIDKey struct{}
+
+// new_request_id returns a random id for a request
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// with_request_id returns ctx carrying id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// request_id returns the request id in ctx, or ""
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// from_context returns the default logger with the request id and trace
+// id in ctx, if any
+func FromContext(ctx context.Context) *slog.Logger {
+	l := slog.Default()
+	if id := RequestID(ctx); id != "" {
+		l = l.With("request_id", id)
+	}
+	if id := trace.FromContext(ctx).TraceID(); id != "" {
+		l = l.With("trace_id", id)
+	}
+	return l
+}
+
+// valid_request_id keeps ids from clients short and printable
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// middleware gives every request to h an id and a server span, and logs it
+// once it has been served. the id is taken from the request (its header,
+// or the query of a redirect) if it has one, so it follows the request
+// from the master to the volumes; otherwise a new one is made.
+func Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = r.URL.Query().Get(RequestIDParam)
+		}
+		if !validRequestID(id) {
+			id = NewRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		ctx := WithRequestID(r.Context(), id)
+		var span *trace.Span
+		if !quiet[r.URL.Path] {
+			ctx, span = trace.Start(trace.Extract(ctx, r.Header), r.Method, trace.KindServer)
+		}
+		span.Set("http.request.method", r.Method)
+		span.Set("url.path", r.URL.Path)
+		span.Set("request_id", id)
+
+		rw := &responseWriter{ResponseWriter: w, code: http.StatusOK}
+		r = r.WithContext(ctx)
+		h.ServeHTTP(rw, r)
+
+		// a mux sets the route it matched on the request
+		if r.Pattern != "" {
+			span.SetName(r.Method + " " + r.Pattern)
+		}
+		span.Set("http.response.status_code", rw.code)
+		if rw.code >= 500 {
+			span.Fail(fmt.Errorf("status %d", rw.code))
+		}
+		span.End()
+
+		level := slog.LevelInfo
+		switch {
+		case rw.code >= 500:
+			level = slog.LevelError
+		case quiet[r.URL.Path]:
+			level = slog.LevelDebug
+		}
+		FromContext(ctx).LogAttrs(ctx, level, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rw.code),
+			slog.Int64("bytes", rw.n),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote", r.RemoteAddr),
+		)
+	})
+}
+
+// response_writer remembers the status and counts the body
+type responseWriter struct {
+	http.ResponseWriter
+	code        int
+	n           int64
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.code, w.wroteHeader = code, true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// transport sends the request id and trace context of each request's
+// context along with it, timing it in a client span
+type transport struct {
+	base http.RoundTripper
+}
+
+// new_transport wraps base (the default transport if nil) to propagate
+// request ids and traces
+func NewTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{base: base}
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	var span *trace.Span
+	if trace.FromContext(ctx) != nil {
+		// requests made outside of any operation, like health probes,
+		// aren't worth a trace of their own
+		ctx, span = trace.Start(ctx, req.Method, trace.KindClient)
+	}
+	id := RequestID(ctx)
+	if span == nil && id == "" {
+		return t.base.RoundTrip(req)
+	}
+
+	// a round tripper must not change the request it was given
+	req = req.Clone(ctx)
+	if id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+	trace.Inject(ctx, req.Header)
+	span.Set("http.request.method", req.Method)
+	// the query can hold signatures
+	span.Set("url.full", req.URL.Scheme+"://"+req.URL.Host+req.URL.Path)
+	span.Set("server.address", req.URL.Host)
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.Fail(err)
+	} else {
+		span.Set("http.response.status_code", resp.StatusCode)
+		if resp.StatusCode >= 500 {
+			span.Fail(fmt.Errorf("status %d", resp.StatusCode))
+		}
+	}
+	span.End()
+	return resp, err
+}
+
+// with_request_param adds the request id in ctx to a url handed to a
+// client, e.g. in a redirect
+func WithRequestParam(ctx context.Context, rawURL string) string {
+	id := RequestID(ctx)
+	if id == "" {
+		return rawURL
+	}
+	sep := "?"
+	if strings.Contains(rawURL, "?") {
+		sep = "&"
+	}
+	return rawURL + sep + RequestIDParam + "=" + url.QueryEscape(id)
+}
@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	httpRequests = NewCounter("mv_http_requests_total",
+		"http requests served", "handler", "method", "code")
+	httpDuration = NewHistogram("mv_http_request_duration_seconds",
+		"time to serve http requests", DefBuckets, "handler", "method", "code")
+	httpBytesIn = NewCounter("mv_http_request_bytes_total",
+		"bytes read from http request bodies", "handler", "method")
+	httpBytesOut = NewCounter("mv_http_response_bytes_total",
+		"bytes written in http response bodies", "handler", "method")
+)
+
+// instrument counts and times the requests served by h. they are labeled
+// with the pattern of the mux route that served them, or name if h isn't a
+// mux.
+func Instrument(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		body := &countingReader{r: r.Body}
+		if r.Body != nil {
+			r.Body = body
+		}
+		rw := &responseWriter{ResponseWriter: w, code: http.StatusOK}
+
+		h.ServeHTTP(rw, r)
+
+		handler := r.Pattern
+		if handler == "" {
+			handler = name
+		}
+		method := methodLabel(r.Method)
+		code := strconv.Itoa(rw.code)
+		httpRequests.Inc(handler, method, code)
+		httpDuration.Observe(time.Since(start).Seconds(), handler, method, code)
+		httpBytesIn.Add(float64(body.n), handler, method)
+		httpBytesOut.Add(float64(rw.n), handler, method)
+	})
+}
+
+// method_label keeps made up methods from making up label values
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPost,
+		http.MethodDelete, http.MethodOptions, http.MethodPatch:
+		return method
+	}
+	return "other"
+}
+
+type countingReader struct {
+	r io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) Close() error {
+	return c.r.Close()
+}
+
+// response_writer remembers the status and counts the body
+type responseWriter struct {
+	http.ResponseWriter
+	code        int
+	n           int64
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.code, w.wroteHeader = code, true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// flush keeps streaming responses (like a volume's scrub) streaming
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
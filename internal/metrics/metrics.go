@@ -0,0 +1,364 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// a small implementation of prometheus metrics: counters, gauges and
+// histograms with labels, written in the text exposition format. metrics
+// are registered once, usually as package variables, and
+// written out by Handler or WriteTextfile.
+
+// registry is a set of metrics
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+// default is the registry the package level constructors register with
+var Default = NewRegistry()
+
+type metric interface {
+	write(w io.Writer, name string)
+}
+
+// new_registry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[name]; ok {
+		panic("metrics: " + name + " registered twice")
+	}
+	r.metrics[name] = m
+}
+
+// write_to writes every metric in the text format, sorted by name
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	metrics := make(map[string]metric, len(r.metrics))
+	for name, m := range r.metrics {
+		names = append(names, name)
+		metrics[name] = m
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, name := range names {
+		metrics[name].write(cw, name)
+	}
+	err := cw.w.(*bufio.Writer).Flush()
+	return cw.n, err
+}
+
+// handler serves the registry to prometheus
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+// write_textfile writes the registry to path for node_exporter's textfile
+// collector. the file is replaced in one go, so it is never read half
+// written.
+func (r *Registry) WriteTextfile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".metrics-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // cleanup if not renamed
+	if _, err := r.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// handler serves the default registry
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// vec holds one value per combination of label values
+type vec[T any] struct {
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*series[T]
+	newT   func() T
+}
+
+type series[T any] struct {
+	values []string
+	v      T
+}
+
+func newVec[T any](kind, help string, labels []string, newT func() T) *vec[T] {
+	return &vec[T]{kind: kind, help: help, labels: labels, series: make(map[string]*series[T]), newT: newT}
+}
+
+// get returns the series for values, creating it. callers hold mu.
+func (v *vec[T]) get(values []string) T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: got %d label values for %d labels", len(values), len(v.labels)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series[T]{values: append([]string(nil), values...), v: v.newT()}
+		v.series[key] = s
+	}
+	return s.v
+}
+
+// each calls fn for every series in label order. callers hold mu.
+func (v *vec[T]) each(fn func(values []string, t T)) {
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := v.series[k]
+		fn(s.values, s.v)
+	}
+}
+
+func (v *vec[T]) header(w io.Writer, name string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(v.help), name, v.kind)
+}
+
+// counter only goes up
+type Counter struct {
+	vec *vec[*float64]
+}
+
+// new_counter registers a counter with the given label names
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{vec: newVec("counter", help, labels, func() *float64 { return new(float64) })}
+	r.register(name, c)
+	return c
+}
+
+// new_counter registers a counter with the default registry
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+// add adds v to the series with the given label values
+func (c *Counter) Add(v float64, values ...string) {
+	c.vec.mu.Lock()
+	*c.vec.get(values) += v
+	c.vec.mu.Unlock()
+}
+
+// inc adds one
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *Counter) write(w io.Writer, name string) {
+	c.vec.mu.Lock()
+	defer c.vec.mu.Unlock()
+	c.vec.header(w, name)
+	c.vec.each(func(values []string, v *float64) {
+		fmt.Fprintf(w, "%s%s %s\n", name, labelString(c.vec.labels, values), formatFloat(*v))
+	})
+}
+
+// gauge is a value that goes up and down. a gauge with a collect function
+// asks it for its values every time it is written.
+type Gauge struct {
+	vec     *vec[*float64]
+	collect func(set func(v float64, values ...string))
+}
+
+// new_gauge registers a gauge with the given label names
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{vec: newVec("gauge", help, labels, func() *float64 { return new(float64) })}
+	r.register(name, g)
+	return g
+}
+
+// new_gauge registers a gauge with the default registry
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return Default.NewGauge(name, help, labels...)
+}
+
+// new_gauge_func registers a gauge whose series are set by collect each
+// time it is written, e.g. to report the state of something as it is
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect func(set func(v float64, values ...string))) *Gauge {
+	g := &Gauge{vec: newVec("gauge", help, labels, func() *float64 { return new(float64) }), collect: collect}
+	r.register(name, g)
+	return g
+}
+
+// new_gauge_func registers a collected gauge with the default registry
+func NewGaugeFunc(name, help string, labels []string, collect func(set func(v float64, values ...string))) *Gauge {
+	return Default.NewGaugeFunc(name, help, labels, collect)
+}
+
+// set sets the series with the given label values to v
+func (g *Gauge) Set(v float64, values ...string) {
+	g.vec.mu.Lock()
+	*g.vec.get(values) = v
+	g.vec.mu.Unlock()
+}
+
+func (g *Gauge) write(w io.Writer, name string) {
+	if g.collect != nil {
+		// series come and go with what they describe
+		fresh := newVec("gauge", g.vec.help, g.vec.labels, g.vec.newT)
+		g.collect(func(v float64, values ...string) {
+			*fresh.get(values) = v
+		})
+		g.vec.mu.Lock()
+		g.vec.series = fresh.series
+		g.vec.mu.Unlock()
+	}
+
+	g.vec.mu.Lock()
+	defer g.vec.mu.Unlock()
+	g.vec.header(w, name)
+	g.vec.each(func(values []string, v *float64) {
+		fmt.Fprintf(w, "%s%s %s\n", name, labelString(g.vec.labels, values), formatFloat(*v))
+	})
+}
+
+// default histogram buckets, in seconds
+var DefBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram counts observations into buckets
+type Histogram struct {
+	vec     *vec[*histogramSeries]
+	buckets []float64
+}
+
+type histogramSeries struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// new_histogram registers a histogram with the given upper bounds and
+// label names
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{buckets: buckets}
+	h.vec = newVec("histogram", help, labels, func() *histogramSeries {
+		return &histogramSeries{counts: make([]uint64, len(buckets))}
+	})
+	r.register(name, h)
+	return h
+}
+
+// new_histogram registers a histogram with the default registry
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+// observe records v in the series with the given label values
+func (h *Histogram) Observe(v float64, values ...string) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.vec.mu.Lock()
+	s := h.vec.get(values)
+	if i < len(s.counts) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+	h.vec.mu.Unlock()
+}
+
+func (h *Histogram) write(w io.Writer, name string) {
+	h.vec.mu.Lock()
+	defer h.vec.mu.Unlock()
+	h.vec.header(w, name)
+	labels := append(append([]string(nil), h.vec.labels...), "le")
+	h.vec.each(func(values []string, s *histogramSeries) {
+		withLE := append(append([]string(nil), values...), "")
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			withLE[len(values)] = formatFloat(le)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, labelString(labels, withLE), cumulative)
+		}
+		withLE[len(values)] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, labelString(labels, withLE), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, labelString(h.vec.labels, values), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, labelString(h.vec.labels, values), s.count)
+	})
+}
+
+func labelString(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// limiter is a token bucket over bytes. it allows bursts of up to one
+// second's worth of bytes. a nil limiter doesn't limit anything.
+type Limiter struct {
+	rate float64 // bytes per second
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// new returns a limiter allowing bytesPerSec on average, or nil (no limit)
+// if bytesPerSec isn't positive
+func New(bytesPerSec int64) *Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &Limiter{
+		rate:   float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until n bytes may pass
+func (l *Limiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	// go into debt rather than refusing reads bigger than the burst.
+	// whoever comes next waits it off.
+	l.tokens -= float64(n)
+	debt := -l.tokens
+	l.mu.Unlock()
+
+	if debt > 0 {
+		time.Sleep(time.Duration(debt / l.rate * float64(time.Second)))
+	}
+}
+
+type reader struct {
+	r io.Reader
+	l *Limiter
+}
+
+// reader wraps r so reads through it are limited by l
+func Reader(r io.Reader, l *Limiter) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &reader{r: r, l: l}
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.l.Wait(n)
+	return n, err
+}
@@ -0,0 +1,205 @@
+package repair
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/afonp/microvault/internal/cluster"
+	"github.com/afonp/microvault/internal/db"
+	"github.com/afonp/microvault/internal/logging"
+	"github.com/afonp/microvault/internal/trace"
+)
+
+// draining moves every copy off a volume so it can be shut down. the
+// volume leaves the ring first, so it gets no new blobs, and then each
+// hash it holds is repaired as if its copy there didn't count: copies go
+// to the volumes the ring now picks, and the volume's own is forgotten.
+// moved copies are gone from the index, so a drain that stopped, because
+// the master restarted or some copies failed, picks up where it left off.
+
+// drain_status is how far draining a volume has got
+type DrainStatus struct {
+	Volume string `json:"volume"`
+	// drain is db.Draining or db.Drained, or "" if the volume isn't being
+	// drained
+	Drain string `json:"drain"`
+	// running is whether blobs are being moved off it right now
+	Running bool `json:"running"`
+	// remaining is how many hashes still have a copy on the volume
+	Remaining int       `json:"remaining"`
+	Moved     int64     `json:"moved"`
+	Failed    int64     `json:"failed"`
+	Started   time.Time `json:"started"`
+	// error is why the last run stopped short
+	Error string `json:"error,omitempty"`
+}
+
+var errCalledOff = errors.New("drain called off")
+
+// drain starts moving every copy off a volume, or resumes a drain that
+// stopped. it returns at once; drain_status shows how it goes.
+func (r *Repairer) Drain(id string) error {
+	if err := r.cluster.SetDrain(id, db.Draining); err != nil {
+		return err
+	}
+	remaining, err := r.store.CountReplicas(id)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if st := r.drains[id]; st != nil && st.Running {
+		return nil
+	}
+	r.drains[id] = &DrainStatus{Volume: id, Running: true, Remaining: remaining, Started: time.Now()}
+	go r.drain(id)
+	return nil
+}
+
+// cancel_drain stops draining a volume and puts it back in the ring.
+// copies already moved stay where they are.
+func (r *Repairer) CancelDrain(id string) error {
+	return r.cluster.SetDrain(id, "")
+}
+
+// drain_status returns how far draining a volume has got
+func (r *Repairer) DrainStatus(id string) (DrainStatus, error) {
+	v, ok := r.cluster.Volume(id)
+	if !ok {
+		return DrainStatus{}, fmt.Errorf("%w %s", cluster.ErrUnknownVolume, id)
+	}
+
+	r.mu.Lock()
+	st := DrainStatus{Volume: id}
+	if d := r.drains[id]; d != nil {
+		st = *d
+	}
+	r.mu.Unlock()
+
+	st.Drain = v.Drain
+	if !st.Running {
+		n, err := r.store.CountReplicas(id)
+		if err != nil {
+			return st, err
+		}
+		st.Remaining = n
+	}
+	return st, nil
+}
+
+// resume_drains restarts the drains the last master didn't finish
+func (r *Repairer) resumeDrains() {
+	for _, v := range r.cluster.Volumes() {
+		if v.Drain != db.Draining {
+			continue
+		}
+		slog.Info("resuming drain", "volume", v.ID)
+		if err := r.Drain(v.ID); err != nil {
+			slog.Error("failed to resume drain", "volume", v.ID, "err", err)
+		}
+	}
+}
+
+func (r *Repairer) drain(id string) {
+	ctx := logging.WithRequestID(context.Background(), logging.NewRequestID())
+	ctx, span := trace.Start(ctx, "drain", trace.KindInternal)
+	span.Set("volume", id)
+	log := logging.FromContext(ctx)
+	log.Info("draining volume", "volume", id)
+
+	err := r.drainAll(ctx, id)
+	span.Fail(err)
+	span.End()
+
+	r.mu.Lock()
+	st := r.drains[id]
+	st.Running = false
+	if err != nil {
+		st.Error = err.Error()
+	}
+	r.mu.Unlock()
+
+	if err != nil {
+		log.Warn("drain stopped", "volume", id, "err", err)
+	} else {
+		log.Info("volume drained", "volume", id)
+	}
+}
+
+// drain_all moves copies off a volume until it holds none, then marks it
+// drained. writes that picked the volume before it left the ring can
+// still land on it, so it goes over the volume until a pass finds nothing.
+func (r *Repairer) drainAll(ctx context.Context, id string) error {
+	last := -1
+	for {
+		hashes, err := r.store.HashesOn(id)
+		if err != nil {
+			return err
+		}
+		if len(hashes) == last {
+			return fmt.Errorf("%d blobs are stuck on the volume", last)
+		}
+		last = len(hashes)
+		r.mu.Lock()
+		r.drains[id].Remaining = len(hashes)
+		r.mu.Unlock()
+		if len(hashes) == 0 {
+			return r.cluster.SetDrain(id, db.Drained)
+		}
+
+		failed, err := r.drainPass(ctx, id, hashes)
+		if err != nil {
+			return err
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d blobs couldn't be moved, drain again to retry", failed)
+		}
+	}
+}
+
+// drain_pass moves hashes off a volume with the repairer's workers and
+// returns how many it couldn't move
+func (r *Repairer) drainPass(ctx context.Context, id string, hashes []string) (int, error) {
+	work := make(chan string)
+	var wg sync.WaitGroup
+	var failed int
+	for i := 0; i < r.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for hash := range work {
+				err := r.repair(ctx, hash, id)
+				r.mu.Lock()
+				st := r.drains[id]
+				if err != nil {
+					st.Failed++
+					failed++
+				} else {
+					st.Moved++
+					st.Remaining--
+				}
+				r.mu.Unlock()
+				if err != nil {
+					logging.FromContext(ctx).Warn("drain: failed to move blob", "volume", id, "hash", hash, "err", err)
+				}
+			}
+		}()
+	}
+
+	var err error
+	for _, hash := range hashes {
+		if v, _ := r.cluster.Volume(id); v.Drain != db.Draining {
+			err = errCalledOff
+			break
+		}
+		work <- hash
+	}
+	close(work)
+	wg.Wait()
+	return failed, err
+}
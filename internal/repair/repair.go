@@ -0,0 +1,454 @@
+package repair
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/afonp/microvault/internal/cluster"
+	"github.com/afonp/microvault/internal/db"
+	"github.com/afonp/microvault/internal/hashlock"
+	"github.com/afonp/microvault/internal/logging"
+	"github.com/afonp/microvault/internal/ratelimit"
+	"github.com/afonp/microvault/internal/trace"
+	"github.com/afonp/microvault/internal/volume"
+)
+
+// the repairer keeps every piece of content at the configured number of
+// good copies. it scans the index for content that falls short (copies on
+// down volumes, or marked missing or corrupt) and also takes hashes pushed
+// to it directly, e.g. from scrub reports. each hash is copied from a good
+// replica onto the volumes the ring prefers for it, under the hash's lock,
+// so the api can't delete it meanwhile.
+
+// header naming the user key on requests to volumes
+const keyHeader = "X-Mv-Key"
+
+var errNoSource = errors.New("no healthy replica to copy from")
+
+// options tune the repairer
+type Options struct {
+	// workers is how many hashes are repaired at once
+	Workers int
+	// rate caps the bytes per second copied across all workers, 0 for
+	// no limit
+	Rate int64
+	// interval between scans of the index, 0 to only repair what is
+	// enqueued
+	Interval time.Duration
+	// volume_secret signs the copies sent to volumes
+	VolumeSecret string
+	// url_secret signs the urls copies are read from
+	URLSecret string
+	// hash_locks are shared with the api. nil gets a set of its own.
+	HashLocks *hashlock.Locks
+}
+
+// status is a snapshot of the repairer's progress
+type Status struct {
+	Queued   int       `json:"queued"`
+	InFlight int       `json:"in_flight"`
+	Repaired int64     `json:"repaired"`
+	Failed   int64     `json:"failed"`
+	Bytes    int64     `json:"bytes"`
+	LastScan time.Time `json:"last_scan"`
+}
+
+type Repairer struct {
+	store    *db.Store
+	cluster  *cluster.Registry
+	replicas int
+	opts     Options
+	limiter  *ratelimit.Limiter
+	client   *http.Client
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []string
+	queued  map[string]bool // pending or in flight
+	status  Status
+	drains  map[string]*DrainStatus // by volume id
+}
+
+// new returns a repairer keeping replicas copies of everything
+func New(store *db.Store, registry *cluster.Registry, replicas int, opts Options) *Repairer {
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	if opts.HashLocks == nil {
+		opts.HashLocks = &hashlock.Locks{}
+	}
+	r := &Repairer{
+		store:    store,
+		cluster:  registry,
+		replicas: replicas,
+		opts:     opts,
+		limiter:  ratelimit.New(opts.Rate),
+		client:   &http.Client{Transport: volume.NewTransport(opts.VolumeSecret, logging.NewTransport(nil))},
+		queued:   make(map[string]bool),
+		drains:   make(map[string]*DrainStatus),
+	}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+// run starts the workers and scans the index every interval. it never
+// returns.
+func (r *Repairer) Run() {
+	r.resumeDrains()
+	for i := 0; i < r.opts.Workers; i++ {
+		go r.work()
+	}
+
+	if r.opts.Interval <= 0 {
+		select {}
+	}
+	for {
+		r.scan()
+		time.Sleep(r.opts.Interval)
+	}
+}
+
+// enqueue asks for hash to be checked and repaired. hashes already waiting
+// aren't queued twice.
+func (r *Repairer) Enqueue(hash string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.queued[hash] {
+		return
+	}
+	r.queued[hash] = true
+	r.pending = append(r.pending, hash)
+	r.status.Queued = len(r.pending)
+	r.cond.Signal()
+}
+
+// status returns the repairer's progress so far
+func (r *Repairer) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+// scan queues everything the index says is short of good copies
+func (r *Repairer) scan() {
+	var up []string
+	for _, v := range r.cluster.Volumes() {
+		if v.State == db.VolumeUp {
+			up = append(up, v.ID)
+		}
+	}
+
+	hashes, err := r.store.UnderReplicated(up, r.replicas)
+	if err != nil {
+		slog.Error("repair: scan failed", "err", err)
+		return
+	}
+	for _, hash := range hashes {
+		r.Enqueue(hash)
+	}
+
+	r.mu.Lock()
+	r.status.LastScan = time.Now()
+	r.mu.Unlock()
+
+	if len(hashes) > 0 {
+		slog.Info("repair: scan found hashes to repair", "hashes", len(hashes))
+	}
+}
+
+func (r *Repairer) work() {
+	for {
+		r.mu.Lock()
+		for len(r.pending) == 0 {
+			r.cond.Wait()
+		}
+		hash := r.pending[0]
+		r.pending = r.pending[1:]
+		r.status.Queued = len(r.pending)
+		r.status.InFlight++
+		r.mu.Unlock()
+
+		// each repair gets a request id and a trace of its own, which the
+		// volumes it copies between log and join
+		ctx := logging.WithRequestID(context.Background(), logging.NewRequestID())
+		ctx, span := trace.Start(ctx, "repair", trace.KindInternal)
+		span.Set("hash", hash)
+		err := r.repair(ctx, hash, "")
+		span.Fail(err)
+		span.End()
+
+		r.mu.Lock()
+		r.status.InFlight--
+		delete(r.queued, hash)
+		if err != nil {
+			r.status.Failed++
+		}
+		r.mu.Unlock()
+
+		if err != nil {
+			logging.FromContext(ctx).Warn("repair failed", "hash", hash, "err", err)
+		}
+	}
+}
+
+// stray is a copy that came out as other content than it was copied as,
+// because its source was corrupt
+type stray struct {
+	volume, hash string
+}
+
+// repair brings hash back up to the configured number of good copies. if
+// leaving names a volume, its copy can be read from but doesn't count, and
+// is forgotten once there are enough copies elsewhere.
+func (r *Repairer) repair(ctx context.Context, hash, leaving string) error {
+	unlock := r.opts.HashLocks.Lock(hash)
+	key, strays, err := r.repairLocked(ctx, hash, leaving)
+	unlock()
+	// strays are other content, so they go under its lock
+	for _, st := range strays {
+		r.dropStray(ctx, key, st)
+	}
+	return err
+}
+
+// repair_locked is repair under the hash's lock. it returns the key it
+// copied as, and the strays it left on the volumes.
+func (r *Repairer) repairLocked(ctx context.Context, hash, leaving string) (string, []stray, error) {
+	replicas, err := r.store.GetReplicas(hash)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(replicas) == 0 {
+		// deleted since it was queued
+		return "", nil, nil
+	}
+	blob, err := r.store.FindHash(hash)
+	if err != nil {
+		return "", nil, err
+	}
+	if blob == nil {
+		// no key points at it any more. compact cleans it up.
+		if leaving != "" {
+			return "", nil, r.store.RemoveReplica(hash, leaving)
+		}
+		return "", nil, nil
+	}
+
+	up := make(map[string]bool)
+	writable := make(map[string]bool)
+	for _, v := range r.cluster.Volumes() {
+		if v.State == db.VolumeUp {
+			up[v.ID] = true
+			writable[v.ID] = cluster.InRing(v)
+		}
+	}
+
+	var sources []string
+	good := make(map[string]bool)
+	for _, rep := range replicas {
+		if rep.State == db.ReplicaOK && up[rep.VolumeID] {
+			if rep.VolumeID != leaving {
+				good[rep.VolumeID] = true
+			}
+			if r.cluster.Healthy(rep.VolumeID) {
+				sources = append(sources, rep.VolumeID)
+			}
+		}
+	}
+	if len(sources) == 0 {
+		return blob.Key, nil, errNoSource
+	}
+
+	// hinted volumes missed the write and get it first. after them, walk
+	// the ring's preference list for the key until we have enough good
+	// copies. a volume holding a bad copy is as good a target as any; the
+	// fresh copy replaces it. read-only and draining volumes get nothing,
+	// nor does the leaving volume if its drain is called off meanwhile.
+	var targets []string
+	for _, rep := range replicas {
+		if rep.State == db.ReplicaPending {
+			targets = append(targets, rep.VolumeID)
+		}
+	}
+	targets = append(targets, r.cluster.Ring().GetNodes(blob.Key, len(up))...)
+
+	// each target is copied to from the first source that works. a source
+	// whose copy hashes wrong is corrupt, and isn't tried again.
+	need := r.replicas - len(good)
+	repaired := make(map[string]bool)
+	corrupt := make(map[string]bool)
+	var strays []stray
+	var lastErr error
+	for _, target := range targets {
+		if need <= 0 {
+			break
+		}
+		if good[target] || repaired[target] || !writable[target] || target == leaving {
+			continue
+		}
+		err := errNoSource
+		for _, source := range sources {
+			if corrupt[source] {
+				continue
+			}
+			var got string
+			if got, err = r.copy(ctx, blob, source, target); err == nil {
+				break
+			}
+			if got != "" {
+				corrupt[source] = true
+				strays = append(strays, stray{volume: target, hash: got})
+				if good[source] {
+					delete(good, source)
+					need++
+				}
+			}
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err := r.store.AddReplica(hash, target, db.ReplicaOK); err != nil {
+			return blob.Key, strays, err
+		}
+		repaired[target] = true
+		need--
+	}
+
+	// bad copies on volumes that are up but didn't get a fresh copy
+	// aren't coming back; forget them. copies on down volumes stay in
+	// case the volume returns. the leaving volume's copy goes either way.
+	if need <= 0 {
+		for _, rep := range replicas {
+			if (rep.State != db.ReplicaOK && up[rep.VolumeID] && !repaired[rep.VolumeID]) || rep.VolumeID == leaving {
+				if err := r.store.RemoveReplica(hash, rep.VolumeID); err != nil {
+					return blob.Key, strays, err
+				}
+			}
+		}
+	}
+
+	if len(repaired) > 0 {
+		r.mu.Lock()
+		r.status.Repaired++
+		r.mu.Unlock()
+		logging.FromContext(ctx).Info("repair: copied blob", "hash", hash, "copies", len(repaired))
+	}
+	if need > 0 {
+		if lastErr != nil {
+			return blob.Key, strays, fmt.Errorf("still %d copies short: %w", need, lastErr)
+		}
+		return blob.Key, strays, fmt.Errorf("still %d copies short: not enough volumes", need)
+	}
+	return blob.Key, strays, nil
+}
+
+// drop_stray deletes a stray unless its content belongs on the volume. key
+// is what it was copied as, so the volume's journal forgets it.
+func (r *Repairer) dropStray(ctx context.Context, key string, st stray) {
+	unlock := r.opts.HashLocks.Lock(st.hash)
+	defer unlock()
+
+	replicas, err := r.store.GetReplicas(st.hash)
+	if err != nil {
+		return
+	}
+	for _, rep := range replicas {
+		if rep.VolumeID == st.volume {
+			return
+		}
+	}
+
+	defer r.opts.HashLocks.Purged()
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, volume.URL(r.cluster.URL(st.volume), st.hash), nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set(keyHeader, url.PathEscape(key))
+	resp, err := r.client.Do(req)
+	if err != nil {
+		logging.FromContext(ctx).Warn("repair: failed to delete stray copy", "hash", st.hash, "volume", st.volume, "err", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// copy streams blob's content from one volume to another. if the source's
+// copy turns out corrupt, it is marked so and copy returns what the target
+// stored instead.
+func (r *Repairer) copy(ctx context.Context, blob *db.Blob, from, to string) (string, error) {
+	get, err := http.NewRequestWithContext(ctx, http.MethodGet, volume.SignURL(volume.URL(r.cluster.URL(from), blob.Hash), r.opts.URLSecret, time.Minute), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := r.client.Do(get)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("read from %s: status %d", from, resp.StatusCode)
+	}
+
+	counted := &countingReader{r: ratelimit.Reader(resp.Body, r.limiter)}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, r.cluster.URL(to), counted)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = resp.ContentLength
+	// journal the key and its headers on the new volume so a rebuild finds
+	// it there as it was written
+	req.Header.Set(keyHeader, url.PathEscape(blob.Key))
+	volume.SetMeta(req.Header, blob.Meta)
+	if blob.ContentType != "" {
+		req.Header.Set("Content-Type", blob.ContentType)
+	}
+
+	put, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer put.Body.Close()
+
+	r.mu.Lock()
+	r.status.Bytes += counted.n
+	r.mu.Unlock()
+
+	if put.StatusCode >= 300 {
+		return "", fmt.Errorf("write to %s: status %d", to, put.StatusCode)
+	}
+	b, err := io.ReadAll(put.Body)
+	if err != nil {
+		return "", err
+	}
+	hash := string(b)
+	if !volume.ValidHash(hash) {
+		return "", fmt.Errorf("write to %s: unexpected answer", to)
+	}
+	if hash != blob.Hash {
+		if err := r.store.SetReplicaState(blob.Hash, from, db.ReplicaCorrupt); err != nil {
+			logging.FromContext(ctx).Error("repair: failed to mark replica corrupt", "hash", blob.Hash, "volume", from, "err", err)
+		}
+		return hash, fmt.Errorf("copy from %s hashed to %s", from, hash)
+	}
+	return "", nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,330 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// every request is signed with aws signature version 4, either in the
+// Authorization header or in the query string of a presigned url. bodies
+// sent as aws-chunked carry a signature per chunk on top of that.
+
+const (
+	sigAlgorithm = "AWS4-HMAC-SHA256"
+	amzDate      = "20060102T150405Z"
+	scopeDate    = "20060102"
+	// how far a request's clock may be off from ours
+	maxSkew = 15 * time.Minute
+	// presigned urls live at most a week, as in s3
+	maxExpires = 7 * 24 * time.Hour
+
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	streamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	// the trailer variants end the body with checksum headers
+	streamingTrailer         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+)
+
+// signature is what a request was signed with
+type signature struct {
+	accessKey string
+	// date is the day of the scope, yyyymmdd
+	date    string
+	region  string
+	service string
+	headers []string
+	sig     string
+	time    time.Time
+}
+
+func (s *signature) scope() string {
+	return s.date + "/" + s.region + "/" + s.service + "/aws4_request"
+}
+
+// authenticate checks the signature of r and returns the access key it was
+// signed with and the body to read, which for aws-chunked uploads is the
+// decoded content
+func (g *Gateway) authenticate(r *http.Request) (string, io.ReadCloser, error) {
+	q := r.URL.Query()
+	var sig *signature
+	var err error
+	presigned := q.Get("X-Amz-Algorithm") != ""
+	switch {
+	case presigned:
+		sig, err = parsePresigned(q)
+	case strings.HasPrefix(r.Header.Get("Authorization"), sigAlgorithm+" "):
+		sig, err = parseAuthorization(r)
+	default:
+		return "", nil, errMissingAuth
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	// the signature has to cover the host, so it can't be replayed against
+	// another endpoint, and its scope is the day it was made
+	if !slices.Contains(sig.headers, "host") || sig.date != sig.time.UTC().Format(scopeDate) {
+		return "", nil, errAuthMalformed
+	}
+
+	secret, ok := g.keys.Secret(sig.accessKey)
+	if !ok {
+		return "", nil, errInvalidAccessKey
+	}
+
+	payload := r.Header.Get("X-Amz-Content-Sha256")
+	switch {
+	case presigned:
+		payload = unsignedPayload
+	case payload == "" && r.ContentLength == 0:
+		// some clients leave the header out when there is no body
+		payload = emptySHA256
+	case payload == "":
+		return "", nil, errAuthMalformed
+	}
+
+	key := signingKey(secret, sig)
+	expected := hex.EncodeToString(hmacSHA256(key, []byte(stringToSign(sig, canonicalRequest(r, sig.headers, payload, presigned)))))
+	if !hmac.Equal([]byte(expected), []byte(sig.sig)) {
+		return "", nil, errSignatureMismatch
+	}
+
+	switch payload {
+	case streamingPayload, streamingTrailer:
+		return sig.accessKey, newChunkedReader(r.Body, key, sig, payload == streamingTrailer), nil
+	case streamingUnsignedTrailer:
+		return sig.accessKey, newChunkedReader(r.Body, nil, sig, true), nil
+	case unsignedPayload:
+		return sig.accessKey, r.Body, nil
+	}
+	return sig.accessKey, newDigestReader(r.Body, payload), nil
+}
+
+// decoder is a body checked as it is read. decode_err is why it stopped,
+// once it has.
+type decoder interface {
+	decodeErr() error
+}
+
+// digest_reader checks a body against the sha256 it was signed with. its
+// last read fails if they differ, so the api never records the body.
+type digestReader struct {
+	body io.ReadCloser
+	want string
+	hash hash.Hash
+	err  error
+}
+
+func newDigestReader(body io.ReadCloser, want string) *digestReader {
+	return &digestReader{body: body, want: want, hash: sha256.New()}
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	n, err := d.body.Read(p)
+	d.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(d.hash.Sum(nil)) != d.want {
+		err = errBadDigest
+	}
+	d.err = err
+	return n, err
+}
+
+func (d *digestReader) Close() error {
+	return d.body.Close()
+}
+
+func (d *digestReader) decodeErr() error {
+	return d.err
+}
+
+// parse_authorization reads the Authorization header, e.g.
+// AWS4-HMAC-SHA256 Credential=AKID/20130524/us-east-1/s3/aws4_request,
+// SignedHeaders=host;x-amz-date, Signature=abcd
+func parseAuthorization(r *http.Request) (*signature, error) {
+	fields := make(map[string]string)
+	for _, part := range strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), sigAlgorithm+" "), ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, errAuthMalformed
+		}
+		fields[k] = v
+	}
+
+	sig, err := parseCredential(fields["Credential"])
+	if err != nil {
+		return nil, err
+	}
+	sig.headers = strings.Split(fields["SignedHeaders"], ";")
+	sig.sig = fields["Signature"]
+
+	date := r.Header.Get("X-Amz-Date")
+	if date == "" {
+		date = r.Header.Get("Date")
+	}
+	if sig.time, err = parseDate(date); err != nil {
+		return nil, err
+	}
+	if d := time.Since(sig.time); d > maxSkew || d < -maxSkew {
+		return nil, errTimeSkewed
+	}
+	return sig, nil
+}
+
+// parse_presigned reads the X-Amz-* parameters of a presigned url
+func parsePresigned(q map[string][]string) (*signature, error) {
+	get := func(k string) string {
+		if v := q[k]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	if get("X-Amz-Algorithm") != sigAlgorithm {
+		return nil, errAuthMalformed
+	}
+
+	sig, err := parseCredential(get("X-Amz-Credential"))
+	if err != nil {
+		return nil, err
+	}
+	sig.headers = strings.Split(get("X-Amz-SignedHeaders"), ";")
+	sig.sig = get("X-Amz-Signature")
+	if sig.time, err = parseDate(get("X-Amz-Date")); err != nil {
+		return nil, err
+	}
+
+	secs, err := strconv.Atoi(get("X-Amz-Expires"))
+	expires := time.Duration(secs) * time.Second
+	if err != nil || secs < 1 || expires > maxExpires {
+		return nil, errAuthMalformed
+	}
+	if time.Since(sig.time) > expires {
+		return nil, errRequestExpired
+	}
+	if time.Until(sig.time) > maxSkew {
+		return nil, errTimeSkewed
+	}
+	return sig, nil
+}
+
+// parse_credential splits AKID/20130524/us-east-1/s3/aws4_request
+func parseCredential(cred string) (*signature, error) {
+	parts := strings.Split(cred, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return nil, errAuthMalformed
+	}
+	return &signature{accessKey: parts[0], date: parts[1], region: parts[2], service: parts[3]}, nil
+}
+
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.Parse(amzDate, s); err == nil {
+		return t, nil
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, errAuthMalformed
+}
+
+// canonical_request is the request as sigv4 sees it
+func canonicalRequest(r *http.Request, signed []string, payload string, presigned bool) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte('\n')
+	b.WriteString(uriEncode(r.URL.Path, false))
+	b.WriteByte('\n')
+
+	// query parameters sorted by name, the signature itself left out
+	type param struct{ k, v string }
+	var params []param
+	for k, vs := range r.URL.Query() {
+		if presigned && k == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range vs {
+			params = append(params, param{uriEncode(k, true), uriEncode(v, true)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i].k != params[j].k {
+			return params[i].k < params[j].k
+		}
+		return params[i].v < params[j].v
+	})
+	for i, p := range params {
+		if i > 0 {
+			b.WriteByte('&')
+		}
+		b.WriteString(p.k + "=" + p.v)
+	}
+	b.WriteByte('\n')
+
+	for _, name := range signed {
+		var value string
+		if name == "host" {
+			value = r.Host
+		} else {
+			values := r.Header.Values(name)
+			for i, v := range values {
+				values[i] = strings.Join(strings.Fields(v), " ")
+			}
+			value = strings.Join(values, ",")
+		}
+		b.WriteString(name + ":" + value + "\n")
+	}
+	b.WriteByte('\n')
+	b.WriteString(strings.Join(signed, ";"))
+	b.WriteByte('\n')
+	b.WriteString(payload)
+	return b.String()
+}
+
+func stringToSign(sig *signature, canonical string) string {
+	sum := sha256.Sum256([]byte(canonical))
+	return sigAlgorithm + "\n" + sig.time.UTC().Format(amzDate) + "\n" + sig.scope() + "\n" + hex.EncodeToString(sum[:])
+}
+
+func signingKey(secret string, sig *signature) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), []byte(sig.date))
+	key = hmacSHA256(key, []byte(sig.region))
+	key = hmacSHA256(key, []byte(sig.service))
+	return hmacSHA256(key, []byte("aws4_request"))
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// uri_encode escapes s the way sigv4 does: everything but unreserved
+// characters, and slashes too unless they separate path segments
+func uriEncode(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&15])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,210 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/afonp/microvault/internal/auth"
+)
+
+const (
+	testKey    = "test"
+	testSecret = "testsecret"
+)
+
+func testGateway(t *testing.T) *Gateway {
+	t.Helper()
+	keys, err := auth.New(auth.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Add(auth.Key{ID: testKey, Secret: testSecret, Policies: []auth.Policy{{Permissions: []auth.Permission{auth.Read}}}}); err != nil {
+		t.Fatal(err)
+	}
+	return &Gateway{keys: keys}
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// sign_request signs r the way an sdk would, made at at with scope date
+// and the given signed headers
+func signRequest(r *http.Request, at time.Time, date string, headers []string, payload string) *signature {
+	r.Header.Set("X-Amz-Date", at.UTC().Format(amzDate))
+	r.Header.Set("X-Amz-Content-Sha256", payload)
+	sig := &signature{accessKey: testKey, date: date, region: "us-east-1", service: "s3", headers: headers, time: at}
+	key := signingKey(testSecret, sig)
+	sig.sig = hex.EncodeToString(hmacSHA256(key, []byte(stringToSign(sig, canonicalRequest(r, headers, payload, false)))))
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigAlgorithm, testKey, sig.scope(), strings.Join(headers, ";"), sig.sig))
+	return sig
+}
+
+func TestAuthenticate(t *testing.T) {
+	g := testGateway(t)
+	now := time.Now()
+	today := now.UTC().Format(scopeDate)
+	body := []byte("some content")
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+
+	tests := []struct {
+		name    string
+		at      time.Time
+		date    string
+		headers []string
+		payload string
+		// after changes the request once it is signed
+		after func(r *http.Request)
+		want  error
+		// read_err is what reading the body ends with
+		readErr error
+	}{
+		{name: "signed body", at: now, date: today, headers: signed, payload: sha256Hex(body)},
+		{name: "unsigned payload", at: now, date: today, headers: signed, payload: unsignedPayload},
+		{name: "wrong body", at: now, date: today, headers: signed, payload: sha256Hex([]byte("other")), readErr: errBadDigest},
+		{name: "host not signed", at: now, date: today, headers: []string{"x-amz-content-sha256", "x-amz-date"}, payload: sha256Hex(body), want: errAuthMalformed},
+		{name: "scope from another day", at: now, date: now.Add(-48 * time.Hour).UTC().Format(scopeDate), headers: signed, payload: sha256Hex(body), want: errAuthMalformed},
+		{name: "skewed clock", at: now.Add(-time.Hour), date: now.Add(-time.Hour).UTC().Format(scopeDate), headers: signed, payload: sha256Hex(body), want: errTimeSkewed},
+		{
+			name: "other host", at: now, date: today, headers: signed, payload: sha256Hex(body),
+			after: func(r *http.Request) { r.Host = "elsewhere.example.com" },
+			want:  errSignatureMismatch,
+		},
+		{
+			name: "unknown key", at: now, date: today, headers: signed, payload: sha256Hex(body),
+			after: func(r *http.Request) {
+				r.Header.Set("Authorization", strings.Replace(r.Header.Get("Authorization"), "Credential="+testKey, "Credential=nobody", 1))
+			},
+			want: errInvalidAccessKey,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("PUT", "http://gateway.example.com/bucket/key", bytes.NewReader(body))
+			signRequest(r, tt.at, tt.date, tt.headers, tt.payload)
+			if tt.after != nil {
+				tt.after(r)
+			}
+
+			id, got, err := g.authenticate(r)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			if id != testKey {
+				t.Errorf("access key = %q", id)
+			}
+			read, err := io.ReadAll(got)
+			if !errors.Is(err, tt.readErr) {
+				t.Fatalf("read err = %v, want %v", err, tt.readErr)
+			}
+			if err == nil && !bytes.Equal(read, body) {
+				t.Errorf("body = %q", read)
+			}
+		})
+	}
+}
+
+// chunked encodes data as aws-chunked in chunks of size, signing each
+// chunk unless sig is nil
+func chunked(key []byte, sig *signature, data []byte, size int, trailer string) []byte {
+	c := &chunkedReader{key: key, sig: sig}
+	if sig != nil {
+		c.prevSig = sig.sig
+	}
+	var b bytes.Buffer
+	for {
+		n := min(size, len(data))
+		chunk := data[:n]
+		data = data[n:]
+		fmt.Fprintf(&b, "%x", n)
+		if key != nil {
+			c.prevSig = c.chunkSignature(sha256Hex(chunk))
+			b.WriteString(";chunk-signature=" + c.prevSig)
+		}
+		b.WriteString("\r\n")
+		if n == 0 {
+			break
+		}
+		b.Write(chunk)
+		b.WriteString("\r\n")
+	}
+	b.WriteString(trailer)
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+func TestChunkedReader(t *testing.T) {
+	sig := &signature{accessKey: testKey, date: "20240101", region: "us-east-1", service: "s3", time: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC), sig: strings.Repeat("ab", 32)}
+	key := signingKey(testSecret, sig)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	body := chunked(key, sig, data, 4096, "")
+
+	tests := []struct {
+		name    string
+		body    []byte
+		key     []byte
+		trailer bool
+		want    error
+		// out is what the body decodes to, data if nil
+		out []byte
+	}{
+		{name: "signed chunks", body: body, key: key},
+		{name: "one chunk", body: chunked(key, sig, data, len(data), ""), key: key},
+		{name: "empty", body: chunked(key, sig, nil, 1, ""), key: key, out: []byte{}},
+		{name: "unsigned with trailer", body: chunked(nil, nil, data, 1000, "x-amz-checksum-crc32:AAAAAA==\r\n"), trailer: true},
+		{name: "trailer not announced", body: chunked(nil, nil, data, 1000, "x-amz-checksum-crc32:AAAAAA==\r\n"), want: errIncompleteBody},
+		{name: "truncated", body: body[:len(body)/2], key: key, want: errIncompleteBody},
+		{name: "data changed", body: flip(body, bytes.Index(body, []byte("\r\n"))+10), key: key, want: errChunkSignatureError},
+		{name: "chunks reordered", body: reorder(body), key: key, want: errChunkSignatureError},
+		{name: "signed with another key", body: chunked(signingKey("other", sig), sig, data, 4096, ""), key: key, want: errChunkSignatureError},
+		{name: "bad size", body: []byte("zz;chunk-signature=00\r\n"), key: key, want: errIncompleteBody},
+		{name: "missing crlf after data", body: bytes.Replace(body, []byte("\r\n1000;"), []byte("xx1000;"), 1), key: key, want: errIncompleteBody},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newChunkedReader(io.NopCloser(bytes.NewReader(tt.body)), tt.key, sig, tt.trailer)
+			got, err := io.ReadAll(r)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			if !errors.Is(r.decodeErr(), tt.want) && !(tt.want == nil && r.decodeErr() == io.EOF) {
+				t.Errorf("decode err = %v, want %v", r.decodeErr(), tt.want)
+			}
+			if tt.out == nil {
+				tt.out = data
+			}
+			if err == nil && !bytes.Equal(got, tt.out) {
+				t.Errorf("decoded %d bytes, want %d", len(got), len(tt.out))
+			}
+		})
+	}
+}
+
+// flip returns body with the byte at i changed
+func flip(body []byte, i int) []byte {
+	b := bytes.Clone(body)
+	b[i] ^= 1
+	return b
+}
+
+// reorder swaps the first two chunks of an aws-chunked body
+func reorder(body []byte) []byte {
+	parts := bytes.SplitAfterN(body, []byte("\r\n"), 5)
+	first := append(append([]byte{}, parts[0]...), parts[1]...)
+	second := append(append([]byte{}, parts[2]...), parts[3]...)
+	return append(append(second, first...), parts[4]...)
+}
@@ -0,0 +1,377 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+
+	"github.com/afonp/microvault/internal/api"
+	"github.com/afonp/microvault/internal/auth"
+	"github.com/afonp/microvault/internal/cluster"
+	"github.com/afonp/microvault/internal/db"
+	"github.com/afonp/microvault/internal/repair"
+	"github.com/afonp/microvault/internal/volume"
+)
+
+// fake_volume keeps blobs and upload parts in memory and answers the way
+// a volume does
+type fakeVolume struct {
+	mu      sync.Mutex
+	blobs   map[string][]byte
+	uploads map[string]map[int][]byte
+}
+
+func newFakeVolume() *fakeVolume {
+	return &fakeVolume{
+		blobs:   make(map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+	}
+}
+
+func (v *fakeVolume) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case path == "_journal":
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(path, "_uploads/"):
+		v.upload(w, r, strings.TrimPrefix(path, "_uploads/"))
+	case r.Method == http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+		v.store(w, body)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		hash := filepath.Base(path)
+		body, ok := v.blobs[hash]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		ct := volume.ContentType(r)
+		if ct == "" {
+			ct = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", ct)
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(body)
+		}
+	case r.Method == http.MethodDelete:
+		delete(v.blobs, filepath.Base(path))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (v *fakeVolume) upload(w http.ResponseWriter, r *http.Request, path string) {
+	id, part, _ := strings.Cut(path, "/")
+	switch r.Method {
+	case http.MethodPut:
+		n, _ := strconv.Atoi(part)
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+		if v.uploads[id] == nil {
+			v.uploads[id] = make(map[int][]byte)
+		}
+		v.uploads[id][n] = body
+		sum := sha256.Sum256(body)
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, hex.EncodeToString(sum[:]))
+	case http.MethodPost:
+		var parts []int
+		json.NewDecoder(r.Body).Decode(&parts)
+		if len(parts) == 0 {
+			for n := range v.uploads[id] {
+				parts = append(parts, n)
+			}
+			sort.Ints(parts)
+		}
+		var blob []byte
+		for _, n := range parts {
+			part, ok := v.uploads[id][n]
+			if !ok {
+				http.Error(w, "missing part", http.StatusBadRequest)
+				return
+			}
+			blob = append(blob, part...)
+		}
+		v.store(w, blob)
+	case http.MethodDelete:
+		delete(v.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (v *fakeVolume) store(w http.ResponseWriter, body []byte) {
+	sum := sha256.Sum256(body)
+	hash := hex.EncodeToString(sum[:])
+	v.blobs[hash] = body
+	w.Header().Set("X-Content-Hash", hash)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, hash)
+}
+
+// new_test_gateway runs a gateway over a master with one in-memory volume
+// and returns an sdk client for it
+func newTestGateway(t *testing.T) *awss3.Client {
+	t.Helper()
+
+	vol := httptest.NewServer(newFakeVolume())
+	t.Cleanup(vol.Close)
+
+	store, err := db.NewStore(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	registry, err := cluster.NewRegistry(store, cluster.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.AddStatic(vol.URL)
+
+	repairer := repair.New(store, registry, 1, repair.Options{})
+	handler := api.NewHandler(store, registry, repairer, api.Options{Replicas: 1})
+
+	keys, err := auth.New(auth.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = keys.Add(auth.Key{
+		ID:       "test",
+		Secret:   "testsecret",
+		Policies: []auth.Policy{{Permissions: []auth.Permission{auth.Read, auth.Write, auth.Delete}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gw := httptest.NewServer(New(handler, store, keys))
+	t.Cleanup(gw.Close)
+
+	return awss3.New(awss3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(gw.URL),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("test", "testsecret", ""),
+	})
+}
+
+func TestSDKObjects(t *testing.T) {
+	client := newTestGateway(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		key  string
+		body []byte
+		// unsigned sends the body as a plain reader, which the sdk can't
+		// rewind to hash, so it goes out as UNSIGNED-PAYLOAD
+		unsigned bool
+	}{
+		{name: "empty", key: "a/empty", body: []byte{}},
+		{name: "small", key: "a/small.txt", body: []byte("hello world")},
+		{name: "escaped key", key: "a/with space+plus", body: []byte("escaped")},
+		{name: "large", key: "a/large", body: randomBytes(t, 1<<20+17)},
+		{name: "unsigned", key: "a/unsigned", body: randomBytes(t, 200<<10), unsigned: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader = bytes.NewReader(tt.body)
+			var opts []func(*awss3.Options)
+			if tt.unsigned {
+				body = struct{ io.Reader }{body}
+				opts = append(opts, awss3.WithAPIOptions(v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware))
+			}
+			_, err := client.PutObject(ctx, &awss3.PutObjectInput{
+				Bucket:        aws.String("bucket"),
+				Key:           aws.String(tt.key),
+				Body:          body,
+				ContentLength: aws.Int64(int64(len(tt.body))),
+				ContentType:   aws.String("text/plain"),
+			}, opts...)
+			if err != nil {
+				t.Fatalf("put: %v", err)
+			}
+
+			out, err := client.GetObject(ctx, &awss3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String(tt.key)})
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			got, err := io.ReadAll(out.Body)
+			out.Body.Close()
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if !bytes.Equal(got, tt.body) {
+				t.Fatalf("got %d bytes back, want %d", len(got), len(tt.body))
+			}
+			if ct := aws.ToString(out.ContentType); ct != "text/plain" {
+				t.Errorf("content type = %q, want text/plain", ct)
+			}
+		})
+	}
+
+	list, err := client.ListObjectsV2(ctx, &awss3.ListObjectsV2Input{Bucket: aws.String("bucket"), Prefix: aws.String("a/")})
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(list.Contents) != len(tests) {
+		t.Errorf("listed %d objects, want %d", len(list.Contents), len(tests))
+	}
+
+	for _, tt := range tests {
+		if _, err := client.DeleteObject(ctx, &awss3.DeleteObjectInput{Bucket: aws.String("bucket"), Key: aws.String(tt.key)}); err != nil {
+			t.Fatalf("delete %s: %v", tt.key, err)
+		}
+	}
+	_, err = client.HeadObject(ctx, &awss3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String("a/small.txt")})
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode() != "NotFound" {
+		t.Errorf("head after delete: %v, want NotFound", err)
+	}
+}
+
+func TestSDKMultipart(t *testing.T) {
+	client := newTestGateway(t)
+	ctx := context.Background()
+
+	created, err := client.CreateMultipartUpload(ctx, &awss3.CreateMultipartUploadInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("big"),
+	})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	var want []byte
+	var parts []types.CompletedPart
+	for n := int32(1); n <= 3; n++ {
+		part := randomBytes(t, 5<<20)
+		if n == 3 {
+			part = part[:1000]
+		}
+		want = append(want, part...)
+		out, err := client.UploadPart(ctx, &awss3.UploadPartInput{
+			Bucket:     aws.String("bucket"),
+			Key:        aws.String("big"),
+			UploadId:   created.UploadId,
+			PartNumber: aws.Int32(n),
+			Body:       bytes.NewReader(part),
+		})
+		if err != nil {
+			t.Fatalf("upload part %d: %v", n, err)
+		}
+		parts = append(parts, types.CompletedPart{ETag: out.ETag, PartNumber: aws.Int32(n)})
+	}
+
+	_, err = client.CompleteMultipartUpload(ctx, &awss3.CompleteMultipartUploadInput{
+		Bucket:          aws.String("bucket"),
+		Key:             aws.String("big"),
+		UploadId:        created.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+
+	out, err := client.GetObject(ctx, &awss3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String("big")})
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	got, err := io.ReadAll(out.Body)
+	out.Body.Close()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %d bytes back, want %d", len(got), len(want))
+	}
+}
+
+func TestSDKPresigned(t *testing.T) {
+	client := newTestGateway(t)
+	ctx := context.Background()
+
+	_, err := client.PutObject(ctx, &awss3.PutObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("shared"),
+		Body:   strings.NewReader("shared content"),
+	})
+	if err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	req, err := awss3.NewPresignClient(client).PresignGetObject(ctx, &awss3.GetObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("shared"),
+	})
+	if err != nil {
+		t.Fatalf("presign: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		url    string
+		status int
+	}{
+		{"signed", req.URL, http.StatusOK},
+		{"tampered", strings.Replace(req.URL, "/shared?", "/other?", 1), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.status, body)
+			}
+			if tt.status == http.StatusOK && string(body) != "shared content" {
+				t.Errorf("body = %q", body)
+			}
+		})
+	}
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
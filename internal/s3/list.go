@@ -0,0 +1,219 @@
+package s3
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/afonp/microvault/internal/auth"
+	"github.com/afonp/microvault/internal/db"
+)
+
+// s3 never returns more than this many keys per page
+const maxKeys = 1000
+
+type listBucketsResult struct {
+	XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Owner   owner    `xml:"Owner"`
+	Buckets []bucket `xml:"Buckets>Bucket"`
+}
+
+type owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+// list_buckets handles GET /. every first key segment that makes a valid
+// bucket name is a bucket, dated by the oldest key in it. only buckets the
+// caller may read are listed.
+func (g *Gateway) listBuckets(w http.ResponseWriter, r *http.Request, id string) {
+	res := listBucketsResult{Xmlns: xmlns, Owner: owner{ID: "microvault", DisplayName: "microvault"}}
+	opts := db.ListOptions{Delimiter: "/", Limit: maxKeys}
+	for {
+		l, err := g.store.List(opts)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		for _, p := range l.Prefixes {
+			name := strings.TrimSuffix(p, "/")
+			if !bucketName.MatchString(name) || !g.keys.Allowed(id, auth.Read, p) {
+				continue
+			}
+			created, err := g.bucketCreated(p)
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			res.Buckets = append(res.Buckets, bucket{Name: name, CreationDate: formatTime(created)})
+		}
+		if l.Next == "" {
+			break
+		}
+		opts.StartAfter = l.Next
+	}
+	writeXML(w, http.StatusOK, res)
+}
+
+// bucket_created is when the first key of a bucket was created
+func (g *Gateway) bucketCreated(prefix string) (time.Time, error) {
+	l, err := g.store.List(db.ListOptions{Prefix: prefix, Limit: 1})
+	if err != nil || len(l.Blobs) == 0 {
+		return time.Time{}, err
+	}
+	return l.Blobs[0].CreatedAt, nil
+}
+
+type listObjectsResult struct {
+	XMLName      xml.Name `xml:"ListBucketResult"`
+	Xmlns        string   `xml:"xmlns,attr"`
+	Name         string   `xml:"Name"`
+	Prefix       string   `xml:"Prefix"`
+	Delimiter    string   `xml:"Delimiter,omitempty"`
+	EncodingType string   `xml:"EncodingType,omitempty"`
+	MaxKeys      int      `xml:"MaxKeys"`
+	IsTruncated  bool     `xml:"IsTruncated"`
+
+	// version 1
+	Marker     *string `xml:"Marker"`
+	NextMarker string  `xml:"NextMarker,omitempty"`
+
+	// version 2
+	KeyCount              *int   `xml:"KeyCount"`
+	StartAfter            string `xml:"StartAfter,omitempty"`
+	ContinuationToken     string `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string `xml:"NextContinuationToken,omitempty"`
+
+	Contents       []object       `xml:"Contents"`
+	CommonPrefixes []commonPrefix `xml:"CommonPrefixes"`
+}
+
+type object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// list_objects handles GET /{bucket}, both ListObjects and ListObjectsV2.
+// v2 continuation tokens are the key to start after, base64 encoded.
+func (g *Gateway) listObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	q := r.URL.Query()
+	v2 := q.Get("list-type") == "2"
+
+	limit := maxKeys
+	if s := q.Get("max-keys"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeError(w, r, errInvalidArgument)
+			return
+		}
+		limit = min(n, maxKeys)
+	}
+
+	encode := func(s string) string { return s }
+	switch q.Get("encoding-type") {
+	case "":
+	case "url":
+		encode = url.QueryEscape
+	default:
+		writeError(w, r, errInvalidArgument)
+		return
+	}
+
+	root := bucket + "/"
+	res := listObjectsResult{
+		Xmlns:        xmlns,
+		Name:         bucket,
+		Prefix:       encode(q.Get("prefix")),
+		Delimiter:    encode(q.Get("delimiter")),
+		EncodingType: q.Get("encoding-type"),
+		MaxKeys:      limit,
+	}
+	opts := db.ListOptions{Prefix: root + q.Get("prefix"), Delimiter: q.Get("delimiter"), Limit: limit}
+
+	if v2 {
+		res.StartAfter = encode(q.Get("start-after"))
+		if s := q.Get("start-after"); s != "" {
+			opts.StartAfter = root + s
+		}
+		if token := q.Get("continuation-token"); token != "" {
+			after, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil || !strings.HasPrefix(string(after), root) {
+				writeError(w, r, newError(http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect."))
+				return
+			}
+			res.ContinuationToken = token
+			opts.StartAfter = string(after)
+		}
+	} else {
+		marker := q.Get("marker")
+		res.Marker = &marker
+		if marker != "" {
+			opts.StartAfter = root + marker
+		}
+	}
+
+	l, err := g.store.List(opts)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	for _, b := range l.Blobs {
+		res.Contents = append(res.Contents, object{
+			Key:          encode(strings.TrimPrefix(b.Key, root)),
+			LastModified: formatTime(b.UpdatedAt),
+			ETag:         `"` + b.Hash + `"`,
+			Size:         b.Size,
+			StorageClass: "STANDARD",
+		})
+	}
+	for _, p := range l.Prefixes {
+		res.CommonPrefixes = append(res.CommonPrefixes, commonPrefix{Prefix: encode(strings.TrimPrefix(p, root))})
+	}
+
+	if l.Next != "" {
+		res.IsTruncated = true
+		if v2 {
+			res.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(l.Next))
+		} else {
+			res.NextMarker = encode(strings.TrimPrefix(l.Next, root))
+		}
+	}
+	if v2 {
+		count := len(res.Contents) + len(res.CommonPrefixes)
+		res.KeyCount = &count
+	}
+	writeXML(w, http.StatusOK, res)
+}
+
+// delete_bucket handles DELETE /{bucket}. a bucket with keys in it can't
+// go, an empty one never really existed.
+func (g *Gateway) deleteBucket(w http.ResponseWriter, r *http.Request, bucket string) {
+	l, err := g.store.List(db.ListOptions{Prefix: bucket + "/", Limit: 1})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if len(l.Blobs) > 0 {
+		writeError(w, r, errBucketNotEmpty)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,208 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// multipart uploads map one to one onto the api's, which already use the
+// s3 names for their query parameters
+
+type initiateResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+// create_upload handles POST /{bucket}/{key}?uploads
+func (g *Gateway) createUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	rec := record(g.api.CreateUpload, native(r.Context(), http.MethodPost, bucket+"/"+key, "uploads", nativeHeader(r), nil))
+	if rec.status != http.StatusOK {
+		writeError(w, r, nativeError(rec, nil))
+		return
+	}
+
+	var resp struct {
+		UploadID string `json:"upload_id"`
+	}
+	if err := json.Unmarshal(rec.body.Bytes(), &resp); err != nil {
+		writeError(w, r, errInternal)
+		return
+	}
+	writeXML(w, http.StatusOK, initiateResult{Xmlns: xmlns, Bucket: bucket, Key: key, UploadID: resp.UploadID})
+}
+
+// upload_query is the api query for an upload, with the part number if any
+func uploadQuery(r *http.Request) string {
+	q := url.Values{"uploadId": {r.URL.Query().Get("uploadId")}}
+	if n := r.URL.Query().Get("partNumber"); n != "" {
+		q.Set("partNumber", n)
+	}
+	return q.Encode()
+}
+
+// upload_error is native_error for requests naming an upload, where a 404
+// means the upload is gone
+func uploadError(rec *recorder, body io.Reader) error {
+	if rec.status == http.StatusNotFound {
+		return errNoSuchUpload
+	}
+	return nativeError(rec, body)
+}
+
+// upload_part handles PUT /{bucket}/{key}?partNumber=N&uploadId=X
+func (g *Gateway) uploadPart(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		writeError(w, r, errNotImplemented)
+		return
+	}
+
+	req := native(r.Context(), http.MethodPut, bucket+"/"+key, uploadQuery(r), nil, r.Body)
+	req.ContentLength = contentLength(r)
+	rec := record(g.api.UploadPart, req)
+	if rec.status != http.StatusOK {
+		writeError(w, r, uploadError(rec, r.Body))
+		return
+	}
+
+	// the api reports the part's sha256, s3 clients only echo it back
+	w.Header().Set("ETag", rec.header.Get("Etag"))
+	w.WriteHeader(http.StatusOK)
+}
+
+type listPartsResult struct {
+	XMLName     xml.Name     `xml:"ListPartsResult"`
+	Xmlns       string       `xml:"xmlns,attr"`
+	Bucket      string       `xml:"Bucket"`
+	Key         string       `xml:"Key"`
+	UploadID    string       `xml:"UploadId"`
+	IsTruncated bool         `xml:"IsTruncated"`
+	Parts       []partResult `xml:"Part"`
+}
+
+type partResult struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+	Size       int64  `xml:"Size"`
+}
+
+// list_parts handles GET /{bucket}/{key}?uploadId=X. every part is listed
+// in one go, uploads have at most 10000.
+func (g *Gateway) listParts(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	rec := record(g.api.ListParts, native(r.Context(), http.MethodGet, bucket+"/"+key, uploadQuery(r), nil, nil))
+	if rec.status != http.StatusOK {
+		writeError(w, r, uploadError(rec, nil))
+		return
+	}
+
+	var resp struct {
+		UploadID string `json:"upload_id"`
+		Parts    []struct {
+			Number int    `json:"number"`
+			Size   int64  `json:"size"`
+			ETag   string `json:"etag"`
+		} `json:"parts"`
+	}
+	if err := json.Unmarshal(rec.body.Bytes(), &resp); err != nil {
+		writeError(w, r, errInternal)
+		return
+	}
+
+	res := listPartsResult{Xmlns: xmlns, Bucket: bucket, Key: key, UploadID: resp.UploadID}
+	for _, p := range resp.Parts {
+		res.Parts = append(res.Parts, partResult{PartNumber: p.Number, ETag: `"` + p.ETag + `"`, Size: p.Size})
+	}
+	writeXML(w, http.StatusOK, res)
+}
+
+type completeRequest struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+// complete_upload handles POST /{bucket}/{key}?uploadId=X. the parts named
+// in the body have to match the ones uploaded, etags and all.
+func (g *Gateway) completeUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	var req completeRequest
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 4<<20)).Decode(&req); err != nil || len(req.Parts) == 0 {
+		writeError(w, r, errMalformedXML)
+		return
+	}
+
+	id := r.URL.Query().Get("uploadId")
+	upload, err := g.store.GetUpload(id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if upload == nil || upload.Key != bucket+"/"+key {
+		writeError(w, r, errNoSuchUpload)
+		return
+	}
+	uploaded, err := g.store.ListParts(id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	etags := make(map[int]string)
+	for _, p := range uploaded {
+		etags[p.Number] = p.ETag
+	}
+
+	numbers := make([]int, len(req.Parts))
+	for i, p := range req.Parts {
+		if i > 0 && p.PartNumber <= numbers[i-1] {
+			writeError(w, r, errInvalidPartOrder)
+			return
+		}
+		etag, ok := etags[p.PartNumber]
+		if !ok || strings.Trim(p.ETag, `"`) != etag {
+			writeError(w, r, errInvalidPart)
+			return
+		}
+		numbers[i] = p.PartNumber
+	}
+
+	body, _ := json.Marshal(numbers)
+	rec := record(g.api.CompleteUpload, native(r.Context(), http.MethodPost, bucket+"/"+key, uploadQuery(r), nil, bytes.NewReader(body)))
+	if rec.status != http.StatusCreated {
+		writeError(w, r, uploadError(rec, nil))
+		return
+	}
+
+	writeXML(w, http.StatusOK, completeResult{
+		Xmlns:    xmlns,
+		Location: "/" + bucket + "/" + uriEncode(key, false),
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     rec.header.Get("Etag"),
+	})
+}
+
+// abort_upload handles DELETE /{bucket}/{key}?uploadId=X
+func (g *Gateway) abortUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	rec := record(g.api.AbortUpload, native(r.Context(), http.MethodDelete, bucket+"/"+key, uploadQuery(r), nil, nil))
+	if rec.status != http.StatusNoContent {
+		writeError(w, r, uploadError(rec, nil))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,337 @@
+package s3
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/afonp/microvault/internal/auth"
+	"github.com/afonp/microvault/internal/volume"
+)
+
+// headers stored with an object that s3 and microvault name the same
+var passedHeaders = []string{
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Language",
+	"Content-Type",
+	"Expires",
+}
+
+const amzMetaPrefix = "X-Amz-Meta-"
+
+// native_header translates the headers of an s3 write into microvault's
+func nativeHeader(r *http.Request) http.Header {
+	h := make(http.Header)
+	for _, name := range passedHeaders {
+		if v := r.Header.Get(name); v != "" {
+			h.Set(name, v)
+		}
+	}
+	// aws-chunked describes the upload, not the object
+	if enc := r.Header.Get("Content-Encoding"); enc != "" {
+		var kept []string
+		for _, e := range strings.Split(enc, ",") {
+			if e = strings.TrimSpace(e); e != "" && e != "aws-chunked" {
+				kept = append(kept, e)
+			}
+		}
+		h.Del("Content-Encoding")
+		if len(kept) > 0 {
+			h.Set("Content-Encoding", strings.Join(kept, ","))
+		}
+	}
+	for name, values := range r.Header {
+		if rest, ok := strings.CutPrefix(name, amzMetaPrefix); ok && rest != "" {
+			h[volume.MetaPrefix+rest] = values
+		}
+	}
+	return h
+}
+
+// copy_header translates the headers of a microvault response into s3's
+func copyHeader(dst, src http.Header) {
+	for _, name := range append(passedHeaders, "Etag", "Last-Modified", "Content-Length", "Accept-Ranges", "Content-Range") {
+		if v := src.Get(name); v != "" {
+			dst.Set(name, v)
+		}
+	}
+	for name, values := range src {
+		if rest, ok := strings.CutPrefix(name, volume.MetaPrefix); ok {
+			dst[strings.ToLower(amzMetaPrefix+rest)] = values
+		}
+	}
+}
+
+// content_length is the size of the object being uploaded
+func contentLength(r *http.Request) int64 {
+	if s := r.Header.Get("X-Amz-Decoded-Content-Length"); s != "" {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n
+		}
+		return -1
+	}
+	return r.ContentLength
+}
+
+// native_error turns a failed api response into an s3 error. a failure to
+// decode the body wins, since the api only sees it as a broken read.
+func nativeError(rec *recorder, body io.Reader) error {
+	if d, ok := body.(decoder); ok {
+		var e *s3Error
+		if errors.As(d.decodeErr(), &e) {
+			return e
+		}
+	}
+	msg := strings.TrimSpace(rec.body.String())
+	switch rec.status {
+	case http.StatusBadRequest:
+		return newError(http.StatusBadRequest, "InvalidArgument", msg)
+	case http.StatusNotFound:
+		return errNoSuchKey
+	case http.StatusRequestHeaderFieldsTooLarge:
+		return errEntityTooLarge
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return errUnavailable
+	}
+	return errInternal
+}
+
+// put_object handles PUT /{bucket}/{key}. a signed payload hash is checked
+// as the body is read (see digest_reader), and isn't passed on: the api
+// would link existing content by it without reading the body at all.
+func (g *Gateway) putObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	req := native(r.Context(), http.MethodPut, bucket+"/"+key, "", nativeHeader(r), r.Body)
+	req.ContentLength = contentLength(r)
+	rec := record(g.api.PutBlob, req)
+	if rec.status != http.StatusCreated {
+		writeError(w, r, nativeError(rec, r.Body))
+		return
+	}
+
+	w.Header().Set("ETag", rec.header.Get("Etag"))
+	w.WriteHeader(http.StatusOK)
+}
+
+type copyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	ETag         string   `xml:"ETag"`
+	LastModified string   `xml:"LastModified"`
+}
+
+// copy_object handles PUT /{bucket}/{key} with X-Amz-Copy-Source. content
+// is never copied, the new key just points at it.
+func (g *Gateway) copyObject(w http.ResponseWriter, r *http.Request, id, bucket, key string) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	source = strings.TrimPrefix(source, "/")
+	if err != nil || strings.Contains(source, "?") || !strings.Contains(source, "/") {
+		writeError(w, r, errInvalidCopySource)
+		return
+	}
+	if !g.allow(w, r, id, auth.Read, source) {
+		return
+	}
+
+	src, err := g.store.GetBlob(source)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if src == nil {
+		writeError(w, r, errNoSuchKey)
+		return
+	}
+
+	header := nativeHeader(r)
+	if r.Header.Get("X-Amz-Metadata-Directive") != "REPLACE" {
+		header = make(http.Header)
+		volume.SetMeta(header, src.Meta)
+		if src.ContentType != "" {
+			header.Set("Content-Type", src.ContentType)
+		}
+	}
+	header.Set("X-Mv-Content-Sha256", src.Hash)
+
+	rec := record(g.api.PutBlob, native(r.Context(), http.MethodPut, bucket+"/"+key, "", header, nil))
+	switch rec.status {
+	case http.StatusCreated:
+	case http.StatusPreconditionFailed:
+		// the source went away in the meantime
+		writeError(w, r, errNoSuchKey)
+		return
+	default:
+		writeError(w, r, nativeError(rec, nil))
+		return
+	}
+
+	blob, err := g.store.GetBlob(bucket + "/" + key)
+	if err != nil || blob == nil {
+		writeError(w, r, errInternal)
+		return
+	}
+	writeXML(w, http.StatusOK, copyObjectResult{ETag: `"` + blob.Hash + `"`, LastModified: formatTime(blob.UpdatedAt)})
+}
+
+// get_object handles GET and HEAD /{bucket}/{key}. the api redirects to a
+// volume, which we fetch from on the client's behalf.
+func (g *Gateway) getObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	conditional := make(http.Header)
+	for _, name := range []string{"If-None-Match", "If-Modified-Since"} {
+		if v := r.Header.Get(name); v != "" {
+			conditional.Set(name, v)
+		}
+	}
+
+	// a replica that fails gets another go at a different one
+	var lastErr error = errUnavailable
+	for attempt := 0; attempt < 3; attempt++ {
+		rec := record(g.api.ServeBlob, native(r.Context(), r.Method, bucket+"/"+key, "", conditional.Clone(), nil))
+
+		switch rec.status {
+		case http.StatusFound, http.StatusOK, http.StatusNotModified:
+		default:
+			writeError(w, r, nativeError(rec, nil))
+			return
+		}
+		if !preconditionsHold(r, rec.header) {
+			writeError(w, r, errPreconditionFailed)
+			return
+		}
+		if rec.status != http.StatusFound {
+			// answered from the index
+			copyHeader(w.Header(), rec.header)
+			w.WriteHeader(rec.status)
+			return
+		}
+
+		resp, err := g.fetch(r, rec.header.Get("Location"))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			writeError(w, r, errInvalidRange)
+			return
+		}
+		copyHeader(w.Header(), resp.Header)
+		// what the index knows about the key wins over the volume's file
+		copyHeader(w.Header(), rec.header)
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+	writeError(w, r, lastErr)
+}
+
+// fetch gets a blob from a volume with the client's range
+func (g *Gateway) fetch(r *http.Request, location string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"Range", "If-Range"} {
+		if v := r.Header.Get(name); v != "" {
+			req.Header.Set(name, v)
+		}
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, errUnavailable
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		return resp, nil
+	}
+	resp.Body.Close()
+	return nil, errUnavailable
+}
+
+// preconditions_hold checks If-Match and If-Unmodified-Since, which the api
+// leaves to us, against the object's headers
+func preconditionsHold(r *http.Request, h http.Header) bool {
+	if im := r.Header.Get("If-Match"); im != "" {
+		etag := h.Get("Etag")
+		for _, t := range strings.Split(im, ",") {
+			if t = textproto.TrimString(t); t == "*" || t == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ius, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil {
+		modified, err := http.ParseTime(h.Get("Last-Modified"))
+		return err != nil || !modified.After(ius)
+	}
+	return true
+}
+
+// delete_object handles DELETE /{bucket}/{key}. s3 answers 204 whether or
+// not the key existed.
+func (g *Gateway) deleteObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	rec := record(g.api.DeleteBlob, native(r.Context(), http.MethodDelete, bucket+"/"+key, "", nil, nil))
+	if rec.status != http.StatusNoContent && rec.status != http.StatusNotFound {
+		writeError(w, r, nativeError(rec, nil))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type deleteRequest struct {
+	Quiet   bool `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type deleteResult struct {
+	XMLName xml.Name        `xml:"DeleteResult"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Deleted []deletedObject `xml:"Deleted"`
+	Errors  []deleteError   `xml:"Error"`
+}
+
+type deletedObject struct {
+	Key string `xml:"Key"`
+}
+
+type deleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// delete_objects handles POST /{bucket}?delete
+func (g *Gateway) deleteObjects(w http.ResponseWriter, r *http.Request, id, bucket string) {
+	var req deleteRequest
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 2<<20)).Decode(&req); err != nil || len(req.Objects) > 1000 {
+		writeError(w, r, errMalformedXML)
+		return
+	}
+
+	res := deleteResult{Xmlns: xmlns}
+	for _, obj := range req.Objects {
+		if !g.keys.Allowed(id, auth.Delete, bucket+"/"+obj.Key) {
+			res.Errors = append(res.Errors, deleteError{Key: obj.Key, Code: errAccessDenied.code, Message: errAccessDenied.message})
+			continue
+		}
+		rec := record(g.api.DeleteBlob, native(r.Context(), http.MethodDelete, bucket+"/"+obj.Key, "", nil, nil))
+		if rec.status != http.StatusNoContent && rec.status != http.StatusNotFound {
+			e, _ := nativeError(rec, nil).(*s3Error)
+			res.Errors = append(res.Errors, deleteError{Key: obj.Key, Code: e.code, Message: e.message})
+			continue
+		}
+		if !req.Quiet {
+			res.Deleted = append(res.Deleted, deletedObject{Key: obj.Key})
+		}
+	}
+	writeXML(w, http.StatusOK, res)
+}
@@ -0,0 +1,203 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/afonp/microvault/internal/api"
+	"github.com/afonp/microvault/internal/auth"
+	"github.com/afonp/microvault/internal/db"
+	"github.com/afonp/microvault/internal/logging"
+)
+
+// the gateway speaks enough of the s3 rest api for the aws cli and sdks:
+// objects, listing, multipart uploads and sigv4. requests are path style
+// (/{bucket}/{key}) and a bucket is nothing but the first segment of the
+// keys in it, so bucket/key in s3 is the key "bucket/key" in microvault.
+// object requests are translated into calls on the api handler, so they
+// behave exactly like the native api. access keys and their policies are
+// the same as the native api's.
+
+// gateway serves the s3 api
+type Gateway struct {
+	api   *api.Handler
+	store *db.Store
+	// keys are the access keys and what they may do
+	keys *auth.Keys
+	// client fetches objects from the volumes the api redirects to
+	client *http.Client
+}
+
+// new builds a gateway that accepts requests signed with any of keys
+func New(handler *api.Handler, store *db.Store, keys *auth.Keys) *Gateway {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ResponseHeaderTimeout = 30 * time.Second
+	return &Gateway{
+		api:   handler,
+		store: store,
+		keys:  keys,
+		client: &http.Client{
+			Transport: logging.NewTransport(t),
+			// redirects are the api's answer, not something to follow
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}
+}
+
+var bucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, body, err := g.authenticate(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	r.Body = body
+	// the api links stored content only for callers that may read it
+	r = r.WithContext(auth.WithCaller(r.Context(), g.keys, id))
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	q := r.URL.Query()
+
+	if bucket == "" {
+		if r.Method != http.MethodGet {
+			writeError(w, r, errMethodNotAllowed)
+			return
+		}
+		g.listBuckets(w, r, id)
+		return
+	}
+	if !bucketName.MatchString(bucket) {
+		writeError(w, r, errInvalidBucketName)
+		return
+	}
+
+	root := bucket + "/"
+	if key == "" {
+		switch {
+		case r.Method == http.MethodGet && q.Has("uploads"):
+			writeError(w, r, errNotImplemented)
+		case r.Method == http.MethodGet:
+			if g.allow(w, r, id, auth.Read, root+q.Get("prefix")) {
+				g.listObjects(w, r, bucket)
+			}
+		case r.Method == http.MethodHead:
+			// buckets exist as long as their name is valid
+			if g.allow(w, r, id, auth.Read, root) {
+				w.WriteHeader(http.StatusOK)
+			}
+		case r.Method == http.MethodPut:
+			if g.allow(w, r, id, auth.Write, root) {
+				w.WriteHeader(http.StatusOK)
+			}
+		case r.Method == http.MethodDelete:
+			if g.allow(w, r, id, auth.Delete, root) {
+				g.deleteBucket(w, r, bucket)
+			}
+		case r.Method == http.MethodPost && q.Has("delete"):
+			// checked key by key
+			g.deleteObjects(w, r, id, bucket)
+		default:
+			writeError(w, r, errMethodNotAllowed)
+		}
+		return
+	}
+
+	upload := q.Has("uploadId")
+	// everything on an object is a write but reading and deleting it
+	perm := auth.Write
+	switch {
+	case (r.Method == http.MethodGet || r.Method == http.MethodHead) && !upload:
+		perm = auth.Read
+	case r.Method == http.MethodDelete && !upload:
+		perm = auth.Delete
+	}
+	if !g.allow(w, r, id, perm, root+key) {
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && upload:
+		g.listParts(w, r, bucket, key)
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		g.getObject(w, r, bucket, key)
+	case r.Method == http.MethodPut && upload:
+		g.uploadPart(w, r, bucket, key)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		g.copyObject(w, r, id, bucket, key)
+	case r.Method == http.MethodPut:
+		g.putObject(w, r, bucket, key)
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		g.createUpload(w, r, bucket, key)
+	case r.Method == http.MethodPost && upload:
+		g.completeUpload(w, r, bucket, key)
+	case r.Method == http.MethodDelete && upload:
+		g.abortUpload(w, r, bucket, key)
+	case r.Method == http.MethodDelete:
+		g.deleteObject(w, r, bucket, key)
+	default:
+		writeError(w, r, errMethodNotAllowed)
+	}
+}
+
+// allow checks the access key id may do perm on resource, and answers
+// AccessDenied if not
+func (g *Gateway) allow(w http.ResponseWriter, r *http.Request, id string, perm auth.Permission, resource string) bool {
+	if g.keys.Allowed(id, perm, resource) {
+		return true
+	}
+	writeError(w, r, errAccessDenied)
+	return false
+}
+
+// recorder holds the response of an api call
+type recorder struct {
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (rec *recorder) Header() http.Header { return rec.header }
+
+func (rec *recorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(p)
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+// native builds the microvault api request for key
+func native(ctx context.Context, method, key, query string, header http.Header, body io.Reader) *http.Request {
+	req, _ := http.NewRequestWithContext(ctx, method, "/blob/", body)
+	// keys can hold anything, so set the decoded path directly
+	req.URL.Path = "/blob/" + key
+	req.URL.RawQuery = query
+	if header != nil {
+		req.Header = header
+	}
+	if body == nil {
+		req.Body = http.NoBody
+	}
+	return req
+}
+
+// record runs an api handler method and returns its response
+func record(fn http.HandlerFunc, req *http.Request) *recorder {
+	rec := &recorder{header: make(http.Header)}
+	fn(rec, req)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec
+}
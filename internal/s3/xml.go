@@ -0,0 +1,87 @@
+package s3
+
+import (
+	"encoding/xml"
+	"net/http"
+	"time"
+)
+
+const xmlns = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// s3 wants timestamps with milliseconds
+const timeFormat = "2006-01-02T15:04:05.000Z"
+
+// s3_error is an error as s3 reports it
+type s3Error struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *s3Error) Error() string { return e.code + ": " + e.message }
+
+func newError(status int, code, message string) *s3Error {
+	return &s3Error{status: status, code: code, message: message}
+}
+
+var (
+	errAccessDenied        = newError(http.StatusForbidden, "AccessDenied", "Access Denied")
+	errBadDigest           = newError(http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed.")
+	errBucketNotEmpty      = newError(http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty.")
+	errEntityTooLarge      = newError(http.StatusBadRequest, "MetadataTooLarge", "Your metadata headers exceed the maximum allowed metadata size.")
+	errInternal            = newError(http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.")
+	errInvalidAccessKey    = newError(http.StatusForbidden, "InvalidAccessKeyId", "The AWS access key Id you provided does not exist in our records.")
+	errInvalidBucketName   = newError(http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid.")
+	errInvalidPart         = newError(http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found or did not match.")
+	errInvalidPartOrder    = newError(http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order.")
+	errInvalidRange        = newError(http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable.")
+	errMalformedXML        = newError(http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed.")
+	errMethodNotAllowed    = newError(http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+	errMissingAuth         = newError(http.StatusForbidden, "AccessDenied", "Requests must be signed with AWS Signature Version 4.")
+	errNoSuchKey           = newError(http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+	errNoSuchUpload        = newError(http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+	errNotImplemented      = newError(http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented.")
+	errRequestExpired      = newError(http.StatusForbidden, "AccessDenied", "Request has expired.")
+	errSignatureMismatch   = newError(http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.")
+	errTimeSkewed          = newError(http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large.")
+	errUnavailable         = newError(http.StatusServiceUnavailable, "ServiceUnavailable", "Please reduce your request rate.")
+	errAuthMalformed       = newError(http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed.")
+	errIncompleteBody      = newError(http.StatusBadRequest, "IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header.")
+	errInvalidArgument     = newError(http.StatusBadRequest, "InvalidArgument", "Invalid argument.")
+	errInvalidCopySource   = newError(http.StatusBadRequest, "InvalidArgument", "Copy Source must mention the source bucket and key: sourcebucket/sourcekey.")
+	errPreconditionFailed  = newError(http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold.")
+	errChunkSignatureError = newError(http.StatusForbidden, "SignatureDoesNotMatch", "The chunk signature we calculated does not match the signature you provided.")
+)
+
+type errorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+// write_error answers with err, which is turned into an internal error
+// unless it is an s3_error
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	e, ok := err.(*s3Error)
+	if !ok {
+		e = errInternal
+	}
+	if r.Method == http.MethodHead {
+		// no body to put the details in
+		w.WriteHeader(e.status)
+		return
+	}
+	writeXML(w, e.status, errorResponse{Code: e.code, Message: e.message, Resource: r.URL.Path})
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(timeFormat)
+}
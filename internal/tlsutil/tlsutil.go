@@ -0,0 +1,254 @@
+package tlsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// master, volumes and mkv share the same tls flags. a certificate and key
+// turn on https for the servers and are presented as the client
+// certificate when they talk to each other; the ca bundle is what peers
+// are checked against. both are re-read when they change on disk, so
+// certificates can be rotated without a restart.
+
+// client auth modes
+const (
+	// client certificates are neither asked for nor checked
+	ClientAuthNone = "none"
+	// client certificates are checked if sent. volumes then require one for
+	// anything but reads of blobs, and the master for heartbeats.
+	ClientAuthRequest = "request"
+	// every client must send a certificate signed by the ca
+	ClientAuthRequire = "require"
+)
+
+// how often the files are checked for changes, at most
+const reloadInterval = time.Second
+
+// options are the tls flags
+type Options struct {
+	CertFile   string
+	KeyFile    string
+	CAFile     string
+	ClientAuth string
+}
+
+// client_flags registers the flags a client needs on the command line
+func ClientFlags() *Options {
+	o := &Options{ClientAuth: ClientAuthNone}
+	flag.StringVar(&o.CertFile, "tls-cert", "", "tls certificate (pem), served and presented to peers")
+	flag.StringVar(&o.KeyFile, "tls-key", "", "key for -tls-cert")
+	flag.StringVar(&o.CAFile, "tls-ca", "", "ca bundle (pem) to check peers against (default: the system roots)")
+	return o
+}
+
+// flags registers the flags of a server on the command line
+func Flags() *Options {
+	o := ClientFlags()
+	flag.StringVar(&o.ClientAuth, "tls-client-auth", ClientAuthNone, "client certificates: none, request (checked if sent, required for internal requests) or require")
+	return o
+}
+
+// loader holds the current certificate and ca pool, reloading them when
+// their files change
+type Loader struct {
+	opts Options
+
+	mu      sync.Mutex
+	checked time.Time
+	certMod time.Time
+	caMod   time.Time
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+}
+
+// load checks the options and loads the files. it returns nil if tls
+// isn't configured at all.
+func Load(opts *Options) (*Loader, error) {
+	if opts.CertFile == "" && opts.KeyFile == "" && opts.CAFile == "" {
+		if opts.ClientAuth != "" && opts.ClientAuth != ClientAuthNone {
+			return nil, errors.New("-tls-client-auth needs -tls-cert, -tls-key and -tls-ca")
+		}
+		return nil, nil
+	}
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return nil, errors.New("-tls-cert and -tls-key go together")
+	}
+	switch opts.ClientAuth {
+	case "", ClientAuthNone:
+	case ClientAuthRequest, ClientAuthRequire:
+		if opts.CAFile == "" || opts.CertFile == "" {
+			return nil, errors.New("-tls-client-auth needs -tls-cert, -tls-key and -tls-ca")
+		}
+	default:
+		return nil, fmt.Errorf("unknown -tls-client-auth %q", opts.ClientAuth)
+	}
+
+	l := &Loader{opts: *opts}
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// reload re-reads whichever files changed since they were last read
+func (l *Loader) reload() error {
+	if l.opts.CertFile != "" {
+		mod, err := lastModified(l.opts.CertFile, l.opts.KeyFile)
+		if err != nil {
+			return err
+		}
+		if !mod.Equal(l.certMod) {
+			cert, err := tls.LoadX509KeyPair(l.opts.CertFile, l.opts.KeyFile)
+			if err != nil {
+				return err
+			}
+			l.cert, l.certMod = &cert, mod
+		}
+	}
+	if l.opts.CAFile != "" {
+		mod, err := lastModified(l.opts.CAFile)
+		if err != nil {
+			return err
+		}
+		if !mod.Equal(l.caMod) {
+			pem, err := os.ReadFile(l.opts.CAFile)
+			if err != nil {
+				return err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("%s: no certificates", l.opts.CAFile)
+			}
+			l.pool, l.caMod = pool, mod
+		}
+	}
+	return nil
+}
+
+// current returns the certificate and ca pool, reloading them first if
+// it is time to look. a file that fails to load keeps the old one in use.
+func (l *Loader) current() (*tls.Certificate, *x509.CertPool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.checked) >= reloadInterval {
+		l.checked = time.Now()
+		certMod, caMod := l.certMod, l.caMod
+		if err := l.reload(); err != nil {
+			slog.Warn("tls: keeping the old certificates", "err", err)
+		} else if !certMod.Equal(l.certMod) || !caMod.Equal(l.caMod) {
+			slog.Info("tls: reloaded certificates")
+		}
+	}
+	return l.cert, l.pool
+}
+
+func lastModified(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// server_config is the config to serve with, or nil without a certificate
+func (l *Loader) ServerConfig() *tls.Config {
+	if l == nil || l.opts.CertFile == "" {
+		return nil
+	}
+	clientAuth := tls.NoClientCert
+	switch l.opts.ClientAuth {
+	case ClientAuthRequest:
+		clientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := l.current()
+			return cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := l.current()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    pool,
+				ClientAuth:   clientAuth,
+			}, nil
+		},
+	}
+}
+
+// client_config is the config to connect to host with, using the current
+// certificate and ca pool
+func (l *Loader) clientConfig(host string) *tls.Config {
+	cert, pool := l.current()
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: host,
+		RootCAs:    pool, // nil for the system roots
+	}
+	if cert != nil {
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+	return cfg
+}
+
+// dial_tls connects to addr with the config current at the time, so
+// reloaded files apply to new connections
+func (l *Loader) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	d := &tls.Dialer{Config: l.clientConfig(host)}
+	return d.DialContext(ctx, network, addr)
+}
+
+// set_default_transport makes http.DefaultTransport, and with it every
+// client built on it, connect to https urls with the certificate and ca
+func (l *Loader) SetDefaultTransport() {
+	if l == nil {
+		return
+	}
+	http.DefaultTransport.(*http.Transport).DialTLSContext = l.dialTLS
+}
+
+// listen_and_serve serves handler on addr, over tls if there is a
+// certificate
+func (l *Loader) ListenAndServe(addr string, handler http.Handler) error {
+	cfg := l.ServerConfig()
+	if cfg == nil {
+		return http.ListenAndServe(addr, handler)
+	}
+	srv := &http.Server{Addr: addr, Handler: handler, TLSConfig: cfg}
+	return srv.ListenAndServeTLS("", "")
+}
+
+// verified reports whether r came with a client certificate signed by the ca
+func Verified(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+// client_auth reports whether client certificates are checked
+func (l *Loader) ClientAuth() bool {
+	return l != nil && l.opts.ClientAuth != "" && l.opts.ClientAuth != ClientAuthNone
+}
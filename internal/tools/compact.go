@@ -2,9 +2,8 @@ package tools
 
 import (
 	"encoding/json"
-	"fmt"
+	"log/slog"
 	"net/http"
-	"strings"
 )
 
 func Compact(ctx *Context) error {
@@ -14,59 +13,59 @@ func Compact(ctx *Context) error {
 	}
 	defer store.Close()
 
-	fmt.Println("compacting (removing orphans)...")
+	slog.Info("compacting (removing orphans)")
 
 	// get all known hashes from DB
 	// this might be slow if DB is huge.
-	// for "simple", we load all keys.
-	keys, err := store.ListKeys()
+	// for "simple", we load them all.
+	hashes, err := store.ListHashes()
 	if err != nil {
 		return err
 	}
 
 	knownHashes := make(map[string]bool)
-	for _, k := range keys {
-		// if key is hash, add it.
-		// if key is user key, we need to know the hash.
-		// but we store full URL in DB: .../hash
-		// so we can extract hash from URL.
-		locs, _ := store.GetBlob(k)
-		for _, loc := range locs {
-			parts := strings.Split(loc, "/")
-			if len(parts) > 0 {
-				hash := parts[len(parts)-1]
-				knownHashes[hash] = true
-			}
-		}
+	for _, hash := range hashes {
+		knownHashes[hash] = true
 	}
 
-	volumes := strings.Split(ctx.Volumes, ",")
-	for _, vol := range volumes {
-		vol = strings.TrimSpace(vol)
-		fmt.Printf("scanning volume %s...\n", vol)
+	vols, err := ctx.GetVolumes(store)
+	if err != nil {
+		return err
+	}
+	for _, v := range vols {
+		vol := v.URL
+		slog.Info("scanning volume", "volume", vol)
 
 		resp, err := http.Get(vol + "/_list")
 		if err != nil {
-			fmt.Printf("failed to scan %s: %v\n", vol, err)
+			slog.Error("failed to scan volume", "volume", vol, "err", err)
+			ctx.record("errors", 1)
 			continue
 		}
 		defer resp.Body.Close()
 
 		var blobs []string
 		if err := json.NewDecoder(resp.Body).Decode(&blobs); err != nil {
+			ctx.record("errors", 1)
 			continue
 		}
 
 		for _, hash := range blobs {
 			if !knownHashes[hash] {
-				fmt.Printf("deleting orphan %s on %s\n", hash, vol)
+				slog.Info("deleting orphan", "hash", hash, "volume", vol)
 				// DELETE
 				req, _ := http.NewRequest(http.MethodDelete, vol+"/"+hash, nil) // volume wrapper handles DELETE /hash
-				http.DefaultClient.Do(req)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					ctx.record("errors", 1)
+					continue
+				}
+				resp.Body.Close()
+				ctx.record("orphans", 1)
 			}
 		}
 	}
 
-	fmt.Println("compaction complete.")
+	slog.Info("compaction complete", "orphans", ctx.Results["orphans"], "errors", ctx.Results["errors"])
 	return nil
 }
@@ -0,0 +1,131 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/afonp/microvault/internal/auth"
+	"github.com/afonp/microvault/internal/db"
+	"github.com/afonp/microvault/internal/repair"
+)
+
+// drain_options say which volume to drain, and how
+type DrainOptions struct {
+	// master is the url of the master, which does the draining
+	Master string
+	// key is an admin key as "id:secret", empty if the master has no keys
+	Key string
+	// volume is the id or url of the volume
+	Volume string
+	// detach returns once the drain has started instead of waiting for it
+	Detach bool
+	// cancel calls off draining the volume and puts it back in the ring
+	Cancel bool
+	// interval is how often to ask the master how far it has got
+	Interval time.Duration
+}
+
+// drain has the master move every blob off a volume and take it out of the
+// ring, and follows it until the volume is empty. the master does the
+// moving, so it goes on if this stops; running it again picks it up.
+func Drain(ctx *Context, opts DrainOptions) error {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	opts.Master = strings.TrimSuffix(opts.Master, "/")
+
+	id, err := opts.resolve()
+	if err != nil {
+		return err
+	}
+	path := "/_volumes/" + url.PathEscape(id) + "/drain"
+
+	if opts.Cancel {
+		if err := opts.call(http.MethodDelete, path, nil); err != nil {
+			return err
+		}
+		slog.Info("drain called off", "volume", id)
+		return nil
+	}
+
+	var st repair.DrainStatus
+	if err := opts.call(http.MethodPost, path, &st); err != nil {
+		return err
+	}
+	slog.Info("draining volume", "volume", id, "remaining", st.Remaining)
+	if opts.Detach {
+		return nil
+	}
+
+	last := st
+	for st.Running {
+		time.Sleep(opts.Interval)
+		if err := opts.call(http.MethodGet, path, &st); err != nil {
+			return err
+		}
+		if st.Moved != last.Moved || st.Failed != last.Failed {
+			slog.Info("draining", "volume", id, "moved", st.Moved, "failed", st.Failed, "remaining", st.Remaining)
+		}
+		last = st
+	}
+
+	ctx.record("moved", int(st.Moved))
+	ctx.record("failed", int(st.Failed))
+	ctx.record("remaining", st.Remaining)
+	if st.Drain != db.Drained {
+		return fmt.Errorf("drain stopped with %d blobs left: %s", st.Remaining, st.Error)
+	}
+	slog.Info("volume drained, it can be shut down", "volume", id, "moved", st.Moved)
+	return nil
+}
+
+// resolve returns the id of the volume, which may be given by url
+func (o DrainOptions) resolve() (string, error) {
+	var vols []struct {
+		ID  string `json:"id"`
+		URL string `json:"url"`
+	}
+	if err := o.call(http.MethodGet, "/_volumes", &vols); err != nil {
+		return "", err
+	}
+	want := strings.TrimSuffix(o.Volume, "/")
+	for _, v := range vols {
+		if v.ID == want || strings.TrimSuffix(v.URL, "/") == want {
+			return v.ID, nil
+		}
+	}
+	return "", fmt.Errorf("the master doesn't know volume %s", o.Volume)
+}
+
+// call sends a request to the master and decodes its json answer into out,
+// if given
+func (o DrainOptions) call(method, path string, out any) error {
+	req, err := http.NewRequest(method, o.Master+path, nil)
+	if err != nil {
+		return err
+	}
+	if o.Key != "" {
+		id, secret, _ := strings.Cut(o.Key, ":")
+		auth.Sign(req, id, secret)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,30 @@
+package tools
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/afonp/microvault/internal/metrics"
+)
+
+// write_textfile writes the results of a run of command to
+// dir/mkv_{command}.prom for node_exporter's textfile collector, so runs
+// from cron can be graphed and alerted on. err is what the run returned.
+func (c *Context) WriteTextfile(dir, command string, start time.Time, err error) error {
+	reg := metrics.NewRegistry()
+	results := reg.NewGauge("mv_mkv_result", "what the last run of the command counted", "command", "result")
+	for result, n := range c.Results {
+		results.Set(float64(n), command, result)
+	}
+	success := 1.0
+	if err != nil {
+		success = 0
+	}
+	reg.NewGauge("mv_mkv_last_run_success", "1 if the last run of the command finished", "command").
+		Set(success, command)
+	reg.NewGauge("mv_mkv_last_run_timestamp_seconds", "when the last run of the command finished", "command").
+		Set(float64(time.Now().Unix()), command)
+	reg.NewGauge("mv_mkv_last_run_duration_seconds", "how long the last run of the command took", "command").
+		Set(time.Since(start).Seconds(), command)
+	return reg.WriteTextfile(filepath.Join(dir, "mkv_"+command+".prom"))
+}
@@ -0,0 +1,185 @@
+package tools
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/afonp/microvault/internal/hashing"
+)
+
+// placement options tune the placement report
+type PlacementOptions struct {
+	// volumes is how many volumes to simulate
+	Volumes int
+	// keys is how many keys to place
+	Keys int
+	// strategies to compare, all of them if empty
+	Strategies []string
+	// weights are given to the volumes in turn, 1 each if empty
+	Weights []float64
+	// zones the volumes are put in, in turn
+	Zones int
+}
+
+// placement_report places made up keys on made up volumes with each
+// strategy and writes how evenly they spread for their weights and how
+// many copies move when a volume is added or removed, next to the ideal.
+// nothing in the cluster is touched.
+func PlacementReport(ctx *Context, opts PlacementOptions, w io.Writer) error {
+	if opts.Volumes < 2 || opts.Keys < 1 {
+		return fmt.Errorf("need at least 2 volumes and 1 key")
+	}
+	strategies := opts.Strategies
+	if len(strategies) == 0 {
+		strategies = hashing.Strategies
+	}
+	replicas := min(ctx.Replicas, opts.Volumes-1)
+	weights := opts.Weights
+	if len(weights) == 0 {
+		weights = []float64{1}
+	}
+
+	// ids look like the random ones volumes give themselves
+	vols := make([]string, opts.Volumes+1)
+	weight := make(map[string]float64)
+	domain := make(map[string]hashing.Domain)
+	var total float64
+	for i := range vols {
+		vols[i] = fmt.Sprintf("%016x", fnv64(fmt.Sprintf("volume-%d", i)))
+		weight[vols[i]] = weights[i%len(weights)]
+		domain[vols[i]] = hashing.Domain{Zone: fmt.Sprintf("zone-%d", i%max(opts.Zones, 1))}
+		if i < opts.Volumes {
+			total += weight[vols[i]]
+		}
+	}
+	base, added := vols[:opts.Volumes], vols
+	gone := base[opts.Volumes/2]
+
+	keys := make([]string, opts.Keys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("photos/%d/img-%d.jpg", i%97, i)
+	}
+
+	fmt.Fprintf(w, "%d keys, %d volumes in %d zones, %d replicas, %d vnodes\n", opts.Keys, opts.Volumes, max(opts.Zones, 1), replicas, ctx.Placement.VNodes)
+	fmt.Fprintf(w, "spread: copies per volume for its weight, as %% of the mean (stddev, min, max)\n")
+	fmt.Fprintf(w, "moved: copies that change volume when one is added or removed (ideal %.1f%% and %.1f%%)\n\n",
+		100*weight[vols[opts.Volumes]]/(total+weight[vols[opts.Volumes]]), 100*weight[gone]/total)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "strategy\tlookup\tstddev\tmin\tmax\tmoved (add)\tmoved (remove)\t")
+	for _, strategy := range strategies {
+		place := func(nodes []string) (hashing.Placement, error) {
+			p, err := hashing.New(hashing.Options{Strategy: strategy, VNodes: ctx.Placement.VNodes})
+			if err != nil {
+				return nil, err
+			}
+			for _, n := range nodes {
+				p.AddNode(hashing.Node{ID: n, Weight: weight[n], Domain: domain[n]})
+			}
+			return p, nil
+		}
+		before, err := place(base)
+		if err != nil {
+			return err
+		}
+		afterAdd, _ := place(added)
+		afterRemove, _ := place(base)
+		afterRemove.RemoveNode(gone)
+
+		counts := make(map[string]int)
+		var movedAdd, movedRemove int
+		start := time.Now()
+		for _, key := range keys {
+			nodes := before.GetNodes(key, replicas)
+			for _, n := range nodes {
+				counts[n]++
+			}
+			movedAdd += moved(nodes, afterAdd.GetNodes(key, replicas))
+			movedRemove += moved(nodes, afterRemove.GetNodes(key, replicas))
+		}
+		// three lookups per key
+		lookup := time.Since(start) / time.Duration(3*len(keys))
+
+		stddev, lo, hi := spread(counts, weight, base)
+		copies := float64(len(keys) * replicas)
+		fmt.Fprintf(tw, "%s\t%s\t%.1f%%\t%.1f%%\t%.1f%%\t%.1f%%\t%.1f%%\t\n", strategy, lookup,
+			stddev, lo, hi, 100*float64(movedAdd)/copies, 100*float64(movedRemove)/copies)
+	}
+	return tw.Flush()
+}
+
+// moved counts the volumes in after that weren't in before
+func moved(before, after []string) int {
+	n := 0
+	for _, a := range after {
+		found := false
+		for _, b := range before {
+			if a == b {
+				found = true
+				break
+			}
+		}
+		if !found {
+			n++
+		}
+	}
+	return n
+}
+
+// spread returns the standard deviation, minimum and maximum of the counts
+// of vols per unit of their weight, as percentages of their mean
+func spread(counts map[string]int, weight map[string]float64, vols []string) (float64, float64, float64) {
+	var sum float64
+	for _, v := range vols {
+		sum += float64(counts[v]) / weight[v]
+	}
+	mean := sum / float64(len(vols))
+	lo, hi := math.Inf(1), math.Inf(-1)
+	var sq float64
+	for _, v := range vols {
+		c := float64(counts[v]) / weight[v]
+		lo, hi = math.Min(lo, c), math.Max(hi, c)
+		sq += (c - mean) * (c - mean)
+	}
+	stddev := math.Sqrt(sq / float64(len(vols)))
+	return 100 * stddev / mean, 100 * lo / mean, 100 * hi / mean
+}
+
+// fnv64 is fnv-1a, to make up stable volume ids
+func fnv64(s string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// parse_strategies splits a comma separated list of strategies
+func ParseStrategies(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// parse_weights parses a comma separated list of positive weights
+func ParseWeights(s string) ([]float64, error) {
+	var out []float64
+	for _, part := range ParseStrategies(s) {
+		w, err := strconv.ParseFloat(part, 64)
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("invalid weight %q", part)
+		}
+		out = append(out, w)
+	}
+	return out, nil
+}
@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
-	"strings"
 	"sync"
+	"time"
+
+	"github.com/afonp/microvault/internal/db"
+	"github.com/afonp/microvault/internal/volume"
 )
 
 func Rebalance(ctx *Context) error {
@@ -16,9 +20,17 @@ func Rebalance(ctx *Context) error {
 	}
 	defer store.Close()
 
-	ring := ctx.GetRing()
+	vols, err := ctx.GetVolumes(store)
+	if err != nil {
+		return err
+	}
+	ring, err := ctx.GetRing(vols)
+	if err != nil {
+		return err
+	}
+	urls := newVolumeURLs(store, vols)
 
-	fmt.Println("starting rebalance...")
+	slog.Info("starting rebalance")
 
 	keys, err := store.ListKeys()
 	if err != nil {
@@ -30,43 +42,32 @@ func Rebalance(ctx *Context) error {
 
 	for _, key := range keys {
 		// get current locations
-		currentLocs, err := store.GetBlob(key)
+		blob, err := store.GetBlob(key)
+		if err != nil || blob == nil {
+			slog.Error("failed to get blob", "key", key, "err", err)
+			errorCount++
+			continue
+		}
+		replicas, err := store.GetReplicas(blob.Hash)
 		if err != nil {
-			fmt.Printf("error getting blob %s: %v\n", key, err)
+			slog.Error("failed to get replicas", "key", key, "err", err)
 			errorCount++
 			continue
 		}
 
 		// get desired locations from ring
 		desiredNodes := ring.GetNodes(key, ctx.Replicas)
-		desiredMap := make(map[string]bool)
-		for _, node := range desiredNodes {
-			desiredMap[node] = true
-		}
-
-		// check if we need to move
-		// currentLocs are full URLs: http://vol:8081/ab/cd/hash
-		// desiredNodes are base URLs: http://vol:8081
 
 		// map current nodes
-		currentNodes := make(map[string]string) // node -> fullURL
-		for _, loc := range currentLocs {
-			// extract base url
-			// assume loc starts with http://host:port
-			// simple hack: split by / and take first 3 parts?
-			// http://localhost:8081/ab/cd/hash -> http://localhost:8081
-			parts := strings.Split(loc, "/")
-			if len(parts) < 3 {
-				continue
-			}
-			base := strings.Join(parts[:3], "/")
-			currentNodes[base] = loc
+		currentNodes := make(map[string]bool)
+		for _, rep := range replicas {
+			currentNodes[rep.VolumeID] = true
 		}
 
 		// Find missing nodes
 		var missingNodes []string
-		for node := range desiredMap {
-			if _, ok := currentNodes[node]; !ok {
+		for _, node := range desiredNodes {
+			if !currentNodes[node] {
 				missingNodes = append(missingNodes, node)
 			}
 		}
@@ -77,24 +78,24 @@ func Rebalance(ctx *Context) error {
 
 		// we need to replicate to missing nodes
 		// pick a source node
-		if len(currentLocs) == 0 {
-			fmt.Printf("blob %s has no locations! data lost?\n", key)
+		if len(replicas) == 0 {
+			slog.Error("blob has no locations, data lost?", "key", key)
 			errorCount++
 			continue
 		}
-		sourceURL := currentLocs[0]
+		sourceURL := volume.URL(urls.get(replicas[0].VolumeID), blob.Hash)
 
 		// download blob
-		resp, err := http.Get(sourceURL)
+		resp, err := http.Get(volume.SignURL(sourceURL, ctx.URLSecret, time.Minute))
 		if err != nil {
-			fmt.Printf("failed to download %s from %s: %v\n", key, sourceURL, err)
+			slog.Error("failed to download blob", "key", key, "from", sourceURL, "err", err)
 			errorCount++
 			continue
 		}
 		data, err := io.ReadAll(resp.Body)
 		resp.Body.Close()
 		if err != nil {
-			fmt.Printf("failed to read %s: %v\n", key, err)
+			slog.Error("failed to read blob", "key", key, "err", err)
 			errorCount++
 			continue
 		}
@@ -102,48 +103,55 @@ func Rebalance(ctx *Context) error {
 		// upload to missing nodes
 		var wg sync.WaitGroup
 		var mu sync.Mutex
-		var newLocs []string
+		var newNodes []string
 
 		for _, targetNode := range missingNodes {
 			wg.Add(1)
 			go func(node string) {
 				defer wg.Done()
 				// PUT to node
-				req, _ := http.NewRequest(http.MethodPut, node, bytes.NewReader(data))
+				req, _ := http.NewRequest(http.MethodPut, urls.get(node), bytes.NewReader(data))
 				req.ContentLength = int64(len(data))
 
 				resp, err := http.DefaultClient.Do(req)
 				if err != nil || resp.StatusCode >= 300 {
-					fmt.Printf("failed to replicate %s to %s\n", key, node)
+					slog.Error("failed to replicate blob", "key", key, "volume", node)
 					return
 				}
 				defer resp.Body.Close()
 
 				hashBytes, _ := io.ReadAll(resp.Body)
-				hash := string(hashBytes)
-
-				u := fmt.Sprintf("%s/%s/%s/%s", node, hash[:2], hash[2:4], hash)
+				if string(hashBytes) != blob.Hash {
+					slog.Error("replica has the wrong hash", "key", key, "volume", node, "hash", string(hashBytes))
+					return
+				}
 
 				mu.Lock()
-				newLocs = append(newLocs, u)
+				newNodes = append(newNodes, node)
 				mu.Unlock()
 			}(targetNode)
 		}
 		wg.Wait()
 
-		if len(newLocs) > 0 {
+		if len(newNodes) > 0 {
 			// update DB
-			// append new locations
-			allLocs := append(currentLocs, newLocs...)
-			if err := store.PutBlob(key, allLocs); err != nil {
-				fmt.Printf("failed to update DB for %s: %v\n", key, err)
-			} else {
+			// add new locations
+			var failed bool
+			for _, node := range newNodes {
+				if err := store.AddReplica(blob.Hash, node, db.ReplicaOK); err != nil {
+					slog.Error("failed to update index", "key", key, "err", err)
+					failed = true
+				}
+			}
+			if !failed {
 				movedCount++
-				fmt.Printf("rebalanced %s (added %d replicas)\n", key, len(newLocs))
+				slog.Info("rebalanced blob", "key", key, "added", len(newNodes))
 			}
 		}
 	}
 
-	fmt.Printf("rebalance complete. moved: %d, errors: %d\n", movedCount, errorCount)
+	ctx.record("moved", movedCount)
+	ctx.record("errors", errorCount)
+	slog.Info("rebalance complete", "moved", movedCount, "errors", errorCount)
 	return nil
 }
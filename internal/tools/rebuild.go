@@ -3,8 +3,12 @@ package tools
 import (
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
-	"strings"
+	"sort"
+
+	"github.com/afonp/microvault/internal/db"
+	"github.com/afonp/microvault/internal/journal"
 )
 
 func Rebuild(ctx *Context) error {
@@ -14,64 +18,153 @@ func Rebuild(ctx *Context) error {
 	}
 	defer store.Close()
 
-	fmt.Println("rebuilding index...")
+	slog.Info("rebuilding index")
+
+	vols, err := ctx.GetVolumes(store)
+	if err != nil {
+		return err
+	}
+
+	// hash -> id of every volume that has it
+	holders := make(map[string][]string)
+	var records []journal.Record
 
-	volumes := strings.Split(ctx.Volumes, ",")
-	for _, vol := range volumes {
-		vol = strings.TrimSpace(vol)
-		fmt.Printf("scanning volume %s...\n", vol)
+	for _, v := range vols {
+		vol := v.URL
+		slog.Info("scanning volume", "volume", vol)
 
 		// fetch list of blobs from volume
 		// we assume volume has a /_list endpoint that returns JSON list of hashes
 		resp, err := http.Get(vol + "/_list")
 		if err != nil {
-			fmt.Printf("failed to scan volume %s: %v\n", vol, err)
+			slog.Error("failed to scan volume", "volume", vol, "err", err)
+			ctx.record("errors", 1)
 			continue
 		}
 		defer resp.Body.Close()
 
 		if resp.StatusCode != http.StatusOK {
-			fmt.Printf("volume %s returned status %d\n", vol, resp.StatusCode)
+			slog.Error("volume returned an error", "volume", vol, "status", resp.StatusCode)
+			ctx.record("errors", 1)
 			continue
 		}
 
 		var blobs []string
 		if err := json.NewDecoder(resp.Body).Decode(&blobs); err != nil {
-			fmt.Printf("failed to decode response from %s: %v\n", vol, err)
+			slog.Error("failed to decode response", "volume", vol, "err", err)
+			ctx.record("errors", 1)
 			continue
 		}
 
 		for _, hash := range blobs {
-			// if the db is gone, we only have the blob hashes from the files.
-			// custom user keys can't be recovered since the volume only stores `/ab/cd/hash`.
-			// a rebuild can only restore hash-based entries unless we start writing metadata,
-			// which we currently don't.
-
-			// during rebuild, register this volume as a location for the hash.
-			// don't overwrite blindly: check if the entry exists and update or create it.
-
-			currentLocs, _ := store.GetBlob(hash)
+			holders[hash] = append(holders[hash], v.ID)
+		}
 
-			// check if this volume is already in list
-			exists := false
-			targetURL := fmt.Sprintf("%s/%s/%s/%s", vol, hash[:2], hash[2:4], hash)
+		// the journal maps user keys onto those hashes
+		recs, err := fetchJournal(vol)
+		if err != nil {
+			slog.Error("failed to read journal", "volume", vol, "err", err)
+			ctx.record("errors", 1)
+			continue
+		}
+		records = append(records, recs...)
+	}
 
-			for _, loc := range currentLocs {
-				if loc == targetURL {
-					exists = true
-					break
-				}
+	// replay the journals of all volumes in time order. every replica
+	// journals the same write, so duplicates just repeat the same state.
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	keys := make(map[string]journal.Record) // key -> latest put
+	for _, rec := range records {
+		switch rec.Op {
+		case journal.OpPut:
+			keys[rec.Key] = rec
+		case journal.OpDelete:
+			if keys[rec.Key].Hash == rec.Hash {
+				delete(keys, rec.Key)
 			}
+		}
+	}
 
-			if !exists {
-				currentLocs = append(currentLocs, targetURL)
-				if err := store.PutBlob(hash, currentLocs); err != nil {
-					fmt.Printf("failed to update index for %s: %v\n", hash, err)
-				}
-			}
+	referenced := make(map[string]bool)
+	for _, key := range sortedKeys(keys) {
+		rec := keys[key]
+		vols := holders[rec.Hash]
+		if len(vols) == 0 {
+			slog.Warn("key points at content no volume has", "key", key, "hash", rec.Hash)
+			ctx.record("lost", 1)
+			continue
 		}
+		referenced[rec.Hash] = true
+		addLocations(store, db.Blob{Key: key, Hash: rec.Hash, Size: rec.Size, ContentType: rec.ContentType, Meta: rec.Meta}, vols)
 	}
 
-	fmt.Println("rebuild complete.")
+	// blobs no journal mentions (e.g. written before volumes kept one)
+	// can still be restored under their hash.
+	for _, hash := range sortedKeys(holders) {
+		if !referenced[hash] {
+			addLocations(store, db.Blob{Key: hash, Hash: hash}, holders[hash])
+		}
+	}
+
+	ctx.record("keys", len(referenced))
+	ctx.record("unnamed", len(holders)-len(referenced))
+	slog.Info("rebuild complete", "keys", len(referenced), "unnamed", len(holders)-len(referenced))
 	return nil
 }
+
+// fetch_journal downloads a volume's journal. volumes without one yield
+// no records.
+func fetchJournal(vol string) ([]journal.Record, error) {
+	resp, err := http.Get(vol + "/_journal")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return journal.Read(resp.Body)
+}
+
+// add_locations registers vols as holding b's content. it doesn't overwrite
+// blindly: a key the index already points elsewhere is left alone.
+func addLocations(store *db.Store, b db.Blob, vols []string) {
+	current, err := store.GetBlob(b.Key)
+	if err != nil {
+		slog.Error("failed to read index", "key", b.Key, "err", err)
+		return
+	}
+
+	if current == nil {
+		if _, err := store.PutBlob(b, vols); err != nil {
+			slog.Error("failed to update index", "key", b.Key, "err", err)
+		}
+		return
+	}
+
+	if current.Hash != b.Hash {
+		slog.Info("key already points elsewhere, keeping it", "key", b.Key, "hash", current.Hash)
+		return
+	}
+
+	for _, vol := range vols {
+		if err := store.AddReplica(b.Hash, vol, db.ReplicaOK); err != nil {
+			slog.Error("failed to update index", "key", b.Key, "err", err)
+		}
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,8 +1,10 @@
 package tools
 
 import (
+	"fmt"
 	"strings"
 
+	"github.com/afonp/microvault/internal/cluster"
 	"github.com/afonp/microvault/internal/db"
 	"github.com/afonp/microvault/internal/hashing"
 )
@@ -11,16 +13,103 @@ type Context struct {
 	DBPath   string
 	Volumes  string
 	Replicas int
+	// placement must match the master's
+	Placement hashing.Options
+	// url_secret signs the blob urls read from volumes
+	URLSecret string
+
+	// results counts what the run did, by what it counts, e.g. "errors"
+	Results map[string]int
+}
+
+// record adds n to one of the run's results
+func (c *Context) record(result string, n int) {
+	if c.Results == nil {
+		c.Results = make(map[string]int)
+	}
+	c.Results[result] += n
 }
 
-func (c *Context) GetRing() *hashing.Ring {
-	ring := hashing.NewRing(c.Replicas)
-	for _, v := range strings.Split(c.Volumes, ",") {
-		ring.AddNode(strings.TrimSpace(v))
+// get_volumes returns the volumes to work on: the ones named by -volumes,
+// or else every registered volume that is up. volumes named by url that
+// never registered are known by their url.
+func (c *Context) GetVolumes(store *db.Store) ([]db.Volume, error) {
+	registered, err := store.GetVolumes()
+	if err != nil {
+		return nil, err
+	}
+	byURL := make(map[string]db.Volume)
+	for _, v := range registered {
+		byURL[v.URL] = v
+	}
+
+	var vols []db.Volume
+	for _, u := range strings.Split(c.Volumes, ",") {
+		if u = strings.TrimSpace(u); u == "" {
+			continue
+		}
+		if v, ok := byURL[u]; ok {
+			vols = append(vols, v)
+		} else {
+			vols = append(vols, db.Volume{ID: u, URL: u, State: db.VolumeUp})
+		}
+	}
+	if len(vols) > 0 {
+		return vols, nil
+	}
+
+	for _, v := range registered {
+		if v.State == db.VolumeUp {
+			vols = append(vols, v)
+		}
+	}
+	if len(vols) == 0 {
+		return nil, fmt.Errorf("no volumes given and none registered")
 	}
-	return ring
+	return vols, nil
+}
+
+// get_ring returns the placement over vols, weighted and spread over
+// failure domains as on the master. like there, read-only and draining
+// volumes get no new keys.
+func (c *Context) GetRing(vols []db.Volume) (hashing.Placement, error) {
+	ring, err := hashing.New(c.Placement)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range vols {
+		if !v.ReadOnly && v.Drain == "" {
+			ring.AddNode(cluster.Node(v))
+		}
+	}
+	return ring, nil
 }
 
 func (c *Context) GetStore() (*db.Store, error) {
 	return db.NewStore(c.DBPath)
 }
+
+// volume_urls maps volume ids to urls. volumes referenced by a url from
+// before they registered resolve to themselves.
+type volumeURLs map[string]string
+
+func newVolumeURLs(store *db.Store, vols []db.Volume) volumeURLs {
+	urls := make(volumeURLs)
+	// registered volumes that aren't being worked on can still be a source
+	if registered, err := store.GetVolumes(); err == nil {
+		for _, v := range registered {
+			urls[v.ID] = v.URL
+		}
+	}
+	for _, v := range vols {
+		urls[v.ID] = v.URL
+	}
+	return urls
+}
+
+func (u volumeURLs) get(id string) string {
+	if url, ok := u[id]; ok {
+		return url
+	}
+	return id
+}
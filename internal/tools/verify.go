@@ -1,18 +1,49 @@
 package tools
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"time"
+
+	"github.com/afonp/microvault/internal/cluster"
+	"github.com/afonp/microvault/internal/db"
+	"github.com/afonp/microvault/internal/hashing"
+	"github.com/afonp/microvault/internal/volume"
 )
 
-func Verify(ctx *Context) error {
+// verify_options are the flags of mkv verify
+type VerifyOptions struct {
+	// deep has every volume re-hash its blobs instead of only checking
+	// they exist
+	Deep bool
+	// rate caps how fast each volume reads while scrubbing, in MB/s
+	Rate int
+}
+
+func Verify(ctx *Context, opts VerifyOptions) error {
 	store, err := ctx.GetStore()
 	if err != nil {
 		return err
 	}
 	defer store.Close()
 
-	fmt.Println("verifying consistency...")
+	vols, err := ctx.GetVolumes(store)
+	if err != nil {
+		return err
+	}
+	urls := newVolumeURLs(store, vols)
+
+	// copies should be spread over failure domains like the master places
+	// them
+	topology := hashing.NewTopology()
+	for _, v := range vols {
+		topology.Add(v.ID, cluster.Domain(v))
+	}
+
+	slog.Info("verifying consistency")
 
 	keys, err := store.ListKeys()
 	if err != nil {
@@ -21,37 +52,136 @@ func Verify(ctx *Context) error {
 
 	var errors int
 	for _, key := range keys {
-		locs, err := store.GetBlob(key)
+		blob, err := store.GetBlob(key)
+		if err == nil && blob == nil {
+			err = fmt.Errorf("deleted during verify")
+		}
 		if err != nil {
-			fmt.Printf("error getting %s: %v\n", key, err)
+			slog.Error("failed to get blob", "key", key, "err", err)
 			errors++
 			continue
 		}
+		replicas, err := store.GetReplicas(blob.Hash)
+		if err != nil {
+			slog.Error("failed to get blob", "key", key, "err", err)
+			errors++
+			continue
+		}
+
+		if len(replicas) < ctx.Replicas {
+			slog.Warn("under-replicated", "key", key, "replicas", len(replicas), "want", ctx.Replicas)
+			errors++
+			ctx.record("under_replicated", 1)
+		}
 
-		if len(locs) < ctx.Replicas {
-			fmt.Printf("under-replicated: %s (%d/%d)\n", key, len(locs), ctx.Replicas)
+		var held []string
+		for _, rep := range replicas {
+			if rep.State == db.ReplicaOK {
+				held = append(held, rep.VolumeID)
+			}
+		}
+		if err := topology.Check(held); err != nil {
+			slog.Warn("copies share a failure domain", "key", key, "err", err)
 			errors++
+			ctx.record("unspread", 1)
 		}
 
-		for _, loc := range locs {
+		for _, rep := range replicas {
+			loc := volume.URL(urls.get(rep.VolumeID), blob.Hash)
 			// check if file exists (HEAD request)
-			resp, err := http.Head(loc)
+			resp, err := http.Head(volume.SignURL(loc, ctx.URLSecret, time.Minute))
 			if err != nil {
-				fmt.Printf("error checking %s at %s: %v\n", key, loc, err)
+				slog.Error("failed to check replica", "key", key, "url", loc, "err", err)
 				errors++
 				continue
 			}
-			if resp.StatusCode != http.StatusOK {
-				fmt.Printf("missing: %s at %s (status %d)\n", key, loc, resp.StatusCode)
+			resp.Body.Close()
+			switch resp.StatusCode {
+			case http.StatusOK:
+			case http.StatusForbidden, http.StatusGone:
+				slog.Error("refused, check -url-secret", "key", key, "url", loc, "status", resp.StatusCode)
 				errors++
+			default:
+				slog.Warn("missing", "key", key, "url", loc, "status", resp.StatusCode)
+				errors++
+				ctx.record("missing", 1)
+			}
+			// let the master's repair loop put it back
+			if resp.StatusCode == http.StatusNotFound && rep.State == db.ReplicaOK {
+				store.SetReplicaState(blob.Hash, rep.VolumeID, db.ReplicaMissing)
 			}
 		}
 	}
 
+	if opts.Deep {
+		for _, v := range vols {
+			corrupt := deepVerify(store, v, opts.Rate)
+			errors += corrupt
+			ctx.record("corrupt", corrupt)
+		}
+	}
+
+	ctx.record("keys", len(keys))
+	ctx.record("errors", errors)
 	if errors == 0 {
-		fmt.Println("verification passed!")
+		slog.Info("verification passed", "keys", len(keys))
 	} else {
-		fmt.Printf("verification failed with %d errors.\n", errors)
+		slog.Error("verification failed", "keys", len(keys), "errors", errors)
 	}
 	return nil
 }
+
+// deep_verify scrubs a volume and returns how many corrupt blobs it has.
+// corrupt replicas are marked so the master re-replicates them.
+func deepVerify(store *db.Store, v db.Volume, rate int) int {
+	vol := v.URL
+	slog.Info("scrubbing volume", "volume", vol)
+
+	resp, err := http.Get(fmt.Sprintf("%s/_scrub?rate=%d", vol, rate))
+	if err != nil {
+		slog.Error("failed to scrub volume", "volume", vol, "err", err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		slog.Error("volume returned an error", "volume", vol, "status", resp.StatusCode)
+		return 1
+	}
+
+	var checked, corrupt int
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var res volume.ScrubResult
+		if err := dec.Decode(&res); err == io.EOF {
+			break
+		} else if err != nil {
+			slog.Error("scrub broke off", "volume", vol, "checked", checked, "err", err)
+			return corrupt + 1
+		}
+		checked++
+		if res.OK {
+			continue
+		}
+		if res.Skipped {
+			slog.Warn("skipped", "hash", res.Hash, "volume", vol, "reason", res.Error)
+			continue
+		}
+
+		corrupt++
+		store.SetReplicaState(res.Hash, v.ID, db.ReplicaCorrupt)
+		// one of the keys pointing at it, to know what's affected
+		var key string
+		if b, _ := store.FindHash(res.Hash); b != nil {
+			key = b.Key
+		}
+		if res.Error != "" {
+			slog.Error("unreadable", "hash", res.Hash, "volume", vol, "key", key, "reason", res.Error)
+		} else {
+			slog.Error("corrupt", "hash", res.Hash, "volume", vol, "key", key, "actual", res.Actual)
+		}
+	}
+
+	slog.Info("scrubbed volume", "volume", vol, "checked", checked, "corrupt", corrupt)
+	return corrupt
+}
@@ -0,0 +1,243 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// finished spans are batched and written once a second as otlp json, one
+// ExportTraceServiceRequest per line: the format of the opentelemetry
+// collector's file exporter, which its otlpjsonfile receiver reads back.
+
+const (
+	flushInterval = time.Second
+	// spans held for the next flush at most. beyond that they're dropped
+	// rather than slowing requests down.
+	maxPending = 8192
+)
+
+var exporter atomic.Pointer[Exporter]
+
+func current() *Exporter {
+	return exporter.Load()
+}
+
+// exporter writes finished spans to an output
+type Exporter struct {
+	service string
+	out     io.Writer
+	closer  io.Closer
+
+	mu      sync.Mutex
+	pending []*Span
+	dropped int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// setup starts exporting the spans of service as opts says. the returned
+// func flushes what's left and stops; call it before exiting.
+func Setup(opts *Options, service string) (func(), error) {
+	var out io.Writer
+	var closer io.Closer
+	switch opts.Output {
+	case "":
+		return func() {}, nil
+	case "stdout":
+		out = os.Stdout
+	default:
+		f, err := os.OpenFile(opts.Output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		out, closer = f, f
+	}
+
+	e := &Exporter{
+		service: service,
+		out:     out,
+		closer:  closer,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	exporter.Store(e)
+	go e.run()
+	return e.shutdown, nil
+}
+
+func (e *Exporter) add(s *Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.pending) >= maxPending {
+		e.dropped++
+		return
+	}
+	e.pending = append(e.pending, s)
+}
+
+func (e *Exporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.flush()
+		case <-e.stop:
+			e.flush()
+			return
+		}
+	}
+}
+
+func (e *Exporter) shutdown() {
+	exporter.CompareAndSwap(e, nil)
+	close(e.stop)
+	<-e.done
+	if e.closer != nil {
+		e.closer.Close()
+	}
+}
+
+func (e *Exporter) flush() {
+	e.mu.Lock()
+	spans, dropped := e.pending, e.dropped
+	e.pending, e.dropped = nil, 0
+	e.mu.Unlock()
+
+	if dropped > 0 {
+		slog.Warn("dropped spans, the exporter can't keep up", "spans", dropped)
+	}
+	if len(spans) == 0 {
+		return
+	}
+	w := bufio.NewWriter(e.out)
+	if err := json.NewEncoder(w).Encode(e.request(spans)); err != nil {
+		slog.Error("failed to encode spans", "err", err)
+		return
+	}
+	if err := w.Flush(); err != nil {
+		slog.Error("failed to write spans", "err", err)
+	}
+}
+
+// otlp json, as far as it's used here
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	// 0 unset, 2 error
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+func (e *Exporter) request(spans []*Span) otlpRequest {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.endsAt.UnixNano(), 10),
+		}
+		if s.parent != ([8]byte{}) {
+			o.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		for _, a := range s.attrs {
+			o.Attributes = append(o.Attributes, otlpAttr(a.key, a.value))
+		}
+		if s.err != "" {
+			o.Status = otlpStatus{Code: 2, Message: s.err}
+		}
+		s.mu.Unlock()
+		out = append(out, o)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{otlpAttr("service.name", e.service)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "microvault"}, Spans: out}},
+	}}}
+}
+
+func otlpAttr(key string, v any) otlpAttribute {
+	var value map[string]any
+	switch v := v.(type) {
+	case string:
+		value = map[string]any{"stringValue": v}
+	case bool:
+		value = map[string]any{"boolValue": v}
+	case int:
+		value = map[string]any{"intValue": strconv.Itoa(v)}
+	case int64:
+		value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		value = map[string]any{"doubleValue": v}
+	default:
+		value = map[string]any{"stringValue": fmt.Sprint(v)}
+	}
+	return otlpAttribute{Key: key, Value: value}
+}
+
+// stop_on_signal calls stop when the process is interrupted or terminated,
+// then exits, so servers that only ever stop that way flush their last
+// spans
+func StopOnSignal(stop func()) {
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		stop()
+		os.Exit(0)
+	}()
+}
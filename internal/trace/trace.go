@@ -0,0 +1,195 @@
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a small implementation of distributed tracing: spans are timed
+// operations that form a tree per request, carried between processes in
+// the w3c traceparent header and exported as otlp json. with no exporter
+// set up, spans cost next to nothing and nothing is propagated.
+
+// header the trace context travels in, as "00-{trace id}-{span id}-{flags}"
+const Header = "traceparent"
+
+// span kinds, as numbered by otlp
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// options are the tracing flags
+type Options struct {
+	// output is where spans go: "" for nowhere, "stdout", or a file that
+	// otlp json is appended to
+	Output string
+}
+
+// flags registers the tracing flags on the command line
+func Flags() *Options {
+	o := &Options{}
+	flag.StringVar(&o.Output, "trace", "", "export spans as otlp json to this file, or stdout (default: off)")
+	return o
+}
+
+// span is one timed operation
+type Span struct {
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	kind    int
+	start   time.Time
+
+	mu     sync.Mutex
+	name   string
+	attrs  []attribute
+	err    string
+	ended  bool
+	endsAt time.Time
+}
+
+type attribute struct {
+	key   string
+	value any
+}
+
+// span_context identifies a span across processes
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// start starts a span named name as a child of the span in ctx, or of a
+// remote parent extracted into it, or as the root of a new trace. end it
+// when the operation is done. without an exporter it returns a nil span,
+// which every method accepts.
+func Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if current() == nil {
+		return ctx, nil
+	}
+	s := &Span{name: name, kind: kind, start: time.Now()}
+	if parent := FromContext(ctx); parent != nil {
+		s.traceID, s.parent = parent.traceID, parent.spanID
+	} else if remote, ok := ctx.Value(remoteKey{}).(spanContext); ok {
+		s.traceID, s.parent = remote.traceID, remote.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// from_context returns the span in ctx, or nil
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// set records an attribute on the span. values are strings, bools,
+// integers or floats; anything else is recorded as its string form.
+func (s *Span) Set(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attribute{key, value})
+	s.mu.Unlock()
+}
+
+// set_name renames the span, e.g. once the route is known
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+}
+
+// fail marks the span as failed with err
+func (s *Span) Fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err.Error()
+	s.mu.Unlock()
+}
+
+// end finishes the span and hands it to the exporter. ending it twice
+// does nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended, s.endsAt = true, time.Now()
+	s.mu.Unlock()
+	if e := current(); e != nil {
+		e.add(s)
+	}
+}
+
+// trace_id is the hex id of the span's trace, or "" for a nil span
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// inject puts the trace context of ctx into h for the next hop
+func Inject(ctx context.Context, h http.Header) {
+	if s := FromContext(ctx); s != nil {
+		h.Set(Header, fmt.Sprintf("00-%x-%x-01", s.traceID, s.spanID))
+	}
+}
+
+// extract returns ctx carrying the remote parent from h, if h has a valid
+// trace context. spans started from it join the caller's trace.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	if current() == nil {
+		return ctx
+	}
+	parts := strings.Split(h.Get(Header), "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return ctx
+	}
+	var sc spanContext
+	if !decodeID(sc.traceID[:], parts[1]) || !decodeID(sc.spanID[:], parts[2]) {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// decode_id decodes a hex id into dst. all zero ids are invalid.
+func decodeID(dst []byte, s string) bool {
+	if len(s) != 2*len(dst) {
+		return false
+	}
+	if _, err := hex.Decode(dst, []byte(s)); err != nil {
+		return false
+	}
+	for _, b := range dst {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+package volume
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the master and volumes share a secret, and every request that changes a
+// volume (or reads its index) carries an hmac of the request made with
+// it. volumes sign their heartbeats the same way. blobs themselves can
+// still be read by anyone who can reach the volume.
+//
+// the hmac covers the method, path and query, the X-Mv-* headers and the
+// content type, a nonce and the sha256 of the body. each nonce is only
+// accepted once, so a request can't be replayed. small bodies are hashed
+// up front. streams, which are blobs and upload parts, go unsigned: the
+// volume names what it stores by its hash and answers with it, and the
+// master checks that against what it sent.
+
+// AuthHeader holds {unix time}:{nonce}:{body sha256}:{hex hmac}
+const AuthHeader = "X-Mv-Auth"
+
+// how old a signature may be, and how far ahead of our clock
+const maxAuthSkew = 5 * time.Minute
+
+const (
+	// unsigned_payload stands in for the hash of a body streamed unhashed
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	// bodies up to this size are hashed into the signature
+	maxSignedBody = 1 << 20
+)
+
+var (
+	ErrMissingAuth = errors.New("request is not signed")
+	ErrBadAuth     = errors.New("invalid request signature")
+	ErrReplayed    = errors.New("request was already seen")
+)
+
+// sign signs req with secret. it reads a small body to hash it, so req
+// must be able to give its body again.
+func Sign(req *http.Request, secret string) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := newNonce()
+	payload := payloadHash(req)
+	req.Header.Set(AuthHeader, ts+":"+nonce+":"+payload+":"+authMAC(req, secret, ts, nonce, payload))
+}
+
+// payload_hash is the sha256 of req's body, or unsigned_payload if it is
+// a stream or too big to hash up front
+func payloadHash(req *http.Request) string {
+	if req.Body == nil || req.Body == http.NoBody {
+		return hex.EncodeToString(sha256.New().Sum(nil))
+	}
+	if req.GetBody == nil || req.ContentLength < 0 || req.ContentLength > maxSignedBody {
+		return unsignedPayload
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return unsignedPayload
+	}
+	defer body.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return unsignedPayload
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// verify checks that r was signed with secret, recently, and wasn't seen
+// before. a signed body is read and checked here, and r.body replaced
+// with it.
+func Verify(r *http.Request, secret string) error {
+	v := r.Header.Get(AuthHeader)
+	if v == "" {
+		return ErrMissingAuth
+	}
+	fields := strings.Split(v, ":")
+	if len(fields) != 4 {
+		return ErrBadAuth
+	}
+	ts, nonce, payload, mac := fields[0], fields[1], fields[2], fields[3]
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || nonce == "" {
+		return ErrBadAuth
+	}
+	if d := time.Since(time.Unix(unix, 0)); d > maxAuthSkew || d < -maxAuthSkew {
+		return ErrBadAuth
+	}
+	if !hmac.Equal([]byte(mac), []byte(authMAC(r, secret, ts, nonce, payload))) {
+		return ErrBadAuth
+	}
+
+	if payload != unsignedPayload {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+		r.Body.Close()
+		if err != nil || len(body) > maxSignedBody {
+			return ErrBadAuth
+		}
+		sum := sha256.Sum256(body)
+		if !hmac.Equal([]byte(payload), []byte(hex.EncodeToString(sum[:]))) {
+			return ErrBadAuth
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	// only signatures that check out take up room in the cache
+	if !nonces.add(nonce, time.Unix(unix, 0).Add(maxAuthSkew)) {
+		return ErrReplayed
+	}
+	return nil
+}
+
+func authMAC(r *http.Request, secret, ts, nonce, payload string) string {
+	// an empty path goes over the wire as /
+	path := r.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(r.Method + "\n" + path + "\n" + r.URL.RawQuery + "\n" + ts + "\n" + nonce + "\n" + payload + "\n"))
+	m.Write([]byte(signedHeaders(r.Header)))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// signed_headers lists the X-Mv-* headers and the content type, sorted,
+// one name:value line each
+func signedHeaders(h http.Header) string {
+	var names []string
+	for name := range h {
+		if name == "Content-Type" || (strings.HasPrefix(name, "X-Mv-") && name != AuthHeader) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(strings.ToLower(name) + ":" + strings.Join(h[name], ",") + "\n")
+	}
+	return b.String()
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// nonce_cache remembers the nonces of requests until they are too old to
+// be accepted anyway
+type nonceCache struct {
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	swept time.Time
+}
+
+var nonces = &nonceCache{seen: make(map[string]time.Time)}
+
+// add records a nonce until expires, and reports false if it was already
+// there
+func (c *nonceCache) add(nonce string, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.swept) > time.Minute {
+		for n, exp := range c.seen {
+			if now.After(exp) {
+				delete(c.seen, n)
+			}
+		}
+		c.swept = now
+	}
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+	c.seen[nonce] = expires
+	return true
+}
+
+// signer is a transport that signs every request
+type signer struct {
+	secret string
+	base   http.RoundTripper
+}
+
+// new_transport returns a transport that signs requests with secret
+// before handing them to base (the default transport if nil). with no
+// secret it is base itself.
+func NewTransport(secret string, base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if secret == "" {
+		return base
+	}
+	return &signer{secret: secret, base: base}
+}
+
+func (s *signer) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a round tripper must not change the request it was given
+	req = req.Clone(req.Context())
+	Sign(req, s.secret)
+	return s.base.RoundTrip(req)
+}
@@ -0,0 +1,135 @@
+package volume
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	const secret = "volume-secret"
+	body := []byte(`{"op":"put","key":"a"}`)
+
+	tests := []struct {
+		name string
+		// stream sends the body without a way to read it again, so it
+		// goes unsigned
+		stream bool
+		// before changes the request before it is signed, after once it is
+		before, after func(r *http.Request)
+		// secret is what the request is signed with, the volume's if empty
+		secret string
+		want   error
+	}{
+		{name: "signed"},
+		{name: "stream", stream: true},
+		{name: "no signature", after: func(r *http.Request) { r.Header.Del(AuthHeader) }, want: ErrMissingAuth},
+		{name: "other secret", secret: "other", want: ErrBadAuth},
+		{name: "body changed", after: func(r *http.Request) { r.Body = io.NopCloser(strings.NewReader(`{"op":"delete","key":"a"}`)) }, want: ErrBadAuth},
+		{name: "path changed", after: func(r *http.Request) { r.URL.Path = "/_other" }, want: ErrBadAuth},
+		{name: "query changed", after: func(r *http.Request) { r.URL.RawQuery = "x=1" }, want: ErrBadAuth},
+		{
+			name:   "key header changed",
+			before: func(r *http.Request) { r.Header.Set("X-Mv-Key", "a") },
+			after:  func(r *http.Request) { r.Header.Set("X-Mv-Key", "b") },
+			want:   ErrBadAuth,
+		},
+		{name: "meta header added", after: func(r *http.Request) { r.Header.Set(MetaPrefix+"Owner", "someone") }, want: ErrBadAuth},
+		{name: "content type changed", after: func(r *http.Request) { r.Header.Set("Content-Type", "text/html") }, want: ErrBadAuth},
+		{name: "other headers ignored", after: func(r *http.Request) { r.Header.Set("User-Agent", "curl") }},
+		{
+			name: "stale",
+			after: func(r *http.Request) {
+				_, rest, _ := strings.Cut(r.Header.Get(AuthHeader), ":")
+				old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+				r.Header.Set(AuthHeader, old+":"+rest)
+			},
+			want: ErrBadAuth,
+		},
+		{name: "malformed", after: func(r *http.Request) { r.Header.Set(AuthHeader, "1:2") }, want: ErrBadAuth},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reader io.Reader = bytes.NewReader(body)
+			if tt.stream {
+				reader = struct{ io.Reader }{reader}
+			}
+			r := httptest.NewRequest(http.MethodPost, "http://volume/_journal", nil)
+			req, err := http.NewRequest(http.MethodPost, "http://volume/_journal", reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if tt.before != nil {
+				tt.before(req)
+			}
+			key := tt.secret
+			if key == "" {
+				key = secret
+			}
+			Sign(req, key)
+
+			// what the volume gets
+			r.Header = req.Header
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			if tt.after != nil {
+				tt.after(r)
+			}
+
+			if err := Verify(r, secret); !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			if tt.want != nil {
+				return
+			}
+			got, err := io.ReadAll(r.Body)
+			if err != nil || !bytes.Equal(got, body) {
+				t.Errorf("body after verify = %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+	const secret = "volume-secret"
+	req, _ := http.NewRequest(http.MethodDelete, "http://volume/ab/cd/abcd", nil)
+	Sign(req, secret)
+
+	for i, want := range []error{nil, ErrReplayed, ErrReplayed} {
+		r := httptest.NewRequest(http.MethodDelete, "http://volume/ab/cd/abcd", nil)
+		r.Header = req.Header.Clone()
+		if err := Verify(r, secret); !errors.Is(err, want) {
+			t.Fatalf("attempt %d: err = %v, want %v", i+1, err, want)
+		}
+	}
+
+	// a fresh signature of the same request is fine
+	Sign(req, secret)
+	r := httptest.NewRequest(http.MethodDelete, "http://volume/ab/cd/abcd", nil)
+	r.Header = req.Header
+	if err := Verify(r, secret); err != nil {
+		t.Fatalf("resigned: %v", err)
+	}
+}
+
+func TestSignLargeBody(t *testing.T) {
+	const secret = "volume-secret"
+	body := bytes.Repeat([]byte("x"), maxSignedBody+1)
+	req, _ := http.NewRequest(http.MethodPut, "http://volume/", bytes.NewReader(body))
+	Sign(req, secret)
+	if fields := strings.Split(req.Header.Get(AuthHeader), ":"); len(fields) != 4 || fields[2] != unsignedPayload {
+		t.Fatalf("auth header = %q, want an unsigned payload", req.Header.Get(AuthHeader))
+	}
+
+	r := httptest.NewRequest(http.MethodPut, "http://volume/", bytes.NewReader(body))
+	r.Header = req.Header
+	if err := Verify(r, secret); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,25 @@
+package volume
+
+// heartbeat is what a volume periodically sends the master. the first one
+// registers the volume.
+type Heartbeat struct {
+	// id is generated once and kept in the volume's root, so the volume
+	// keeps its identity (and its blobs) when its address changes
+	ID string `json:"id"`
+	// url is where the master and clients can reach the volume
+	URL string `json:"url"`
+	// total and free disk space of the volume's root, in bytes
+	Total uint64 `json:"total"`
+	Free  uint64 `json:"free"`
+	// weight is the volume's share of new keys, if set on the volume.
+	// otherwise the master weighs it as it's configured to.
+	Weight float64 `json:"weight,omitempty"`
+	// the failure domains the volume is in, so the master can keep copies
+	// of a blob apart
+	Zone string `json:"zone,omitempty"`
+	Rack string `json:"rack,omitempty"`
+	Host string `json:"host,omitempty"`
+	// quarantined lists blobs the scrubber found corrupt since the last
+	// heartbeat that got through
+	Quarantined []string `json:"quarantined,omitempty"`
+}
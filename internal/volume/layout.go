@@ -0,0 +1,29 @@
+package volume
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// blobs live on a volume at /ab/cd/{hash}, where ab and cd are the first
+// two bytes of the sha256. these helpers are the only place that layout is
+// spelled out on the master side.
+
+// path returns where a blob lives relative to a volume's root
+func Path(hash string) string {
+	return hash[:2] + "/" + hash[2:4] + "/" + hash
+}
+
+// url returns the address of a blob on the volume at base
+func URL(base, hash string) string {
+	return strings.TrimRight(base, "/") + "/" + Path(hash)
+}
+
+// valid_hash reports whether s looks like a sha256 hex digest
+func ValidHash(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
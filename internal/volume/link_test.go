@@ -0,0 +1,121 @@
+package volume
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifyURL(t *testing.T) {
+	const (
+		secret = "link-secret"
+		blob   = "http://localhost:3001/ab/cd/abcd1234"
+	)
+
+	tests := []struct {
+		name        string
+		contentType string
+		ttl         time.Duration
+		// secret is what the url is signed with, the volume's if empty
+		secret string
+		// change is done to the signed url before it is used
+		change func(u *url.URL)
+		want   error
+	}{
+		{name: "signed", ttl: time.Hour},
+		{name: "with a type", contentType: "image/jpeg", ttl: time.Hour},
+		{name: "with a type needing escapes", contentType: `text/plain; charset="utf-8"`, ttl: time.Hour},
+		{name: "expired", ttl: -2 * time.Minute, want: ErrLinkExpired},
+		{name: "other secret", ttl: time.Hour, secret: "other", want: ErrLinkInvalid},
+		{name: "other blob", ttl: time.Hour, change: func(u *url.URL) { u.Path = "/ab/cd/abcd5678" }, want: ErrLinkInvalid},
+		{name: "expiry moved", ttl: time.Hour, change: setArg("expires", "99999999999"), want: ErrLinkInvalid},
+		{name: "expiry not a number", ttl: time.Hour, change: setArg("expires", "soon"), want: ErrLinkInvalid},
+		{name: "type added", ttl: time.Hour, change: setArg(typeParam, "text/html"), want: ErrLinkInvalid},
+		{name: "type changed", contentType: "image/jpeg", ttl: time.Hour, change: setArg(typeParam, "text/html"), want: ErrLinkInvalid},
+		{name: "type dropped", contentType: "image/jpeg", ttl: time.Hour, change: delArg(typeParam), want: ErrLinkInvalid},
+		{name: "no signature", ttl: time.Hour, change: delArg("md5"), want: ErrLinkMissing},
+		{name: "no expiry", ttl: time.Hour, change: delArg("expires"), want: ErrLinkMissing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.secret
+			if s == "" {
+				s = secret
+			}
+			u, err := url.Parse(SignURL(WithType(blob, tt.contentType), s, tt.ttl))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.change != nil {
+				tt.change(u)
+			}
+			r := httptest.NewRequest(http.MethodGet, u.String(), nil)
+			if err := VerifyURL(r, secret); !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			if got := ContentType(r); tt.want == nil && got != tt.contentType {
+				t.Errorf("content type = %q, want %q", got, tt.contentType)
+			}
+		})
+	}
+}
+
+func setArg(name, value string) func(u *url.URL) {
+	return func(u *url.URL) {
+		q := u.Query()
+		q.Set(name, value)
+		u.RawQuery = q.Encode()
+	}
+}
+
+func delArg(name string) func(u *url.URL) {
+	return func(u *url.URL) {
+		q := u.Query()
+		q.Del(name)
+		u.RawQuery = q.Encode()
+	}
+}
+
+// expiries are rounded up to the minute, so the urls signed for a blob
+// within a minute are the same and can be cached
+func TestSignURLRounds(t *testing.T) {
+	now := time.Now().Unix()
+	signed := SignURL("http://v/ab/cd/abcd", "s", time.Hour)
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires, err := strconv.ParseInt(u.Query().Get("expires"), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expires%60 != 0 || expires < now+3600 || expires > now+3600+60 {
+		t.Errorf("expires %d for an hour from %d", expires, now)
+	}
+	if got := SignURL("http://v/ab/cd/abcd", "", time.Hour); got != "http://v/ab/cd/abcd" {
+		t.Errorf("without a secret: %s", got)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", ""},
+		{"type=image%2Fpng", "image/png"},
+		{"type=text%2Fplain%3B+charset%3Dutf-8", "text/plain; charset=utf-8"},
+		{"type=not+a+type", ""},
+		{"type=%3B%3B", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/ab/cd/abcd?"+tt.query, nil)
+		if got := ContentType(r); got != tt.want {
+			t.Errorf("%q: content type = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package volume
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// besides the content type, a blob keeps a few standard headers and any
+// X-Mv-Meta-* ones. the master stores them and sends them back on reads;
+// volumes get them on writes so their journal can restore them.
+
+// meta_prefix starts the names of user metadata headers
+const MetaPrefix = "X-Mv-Meta-"
+
+// content_type_header carries the blob's content type on volume requests
+// whose own Content-Type describes something else, like completing a
+// multipart upload
+const ContentTypeHeader = "X-Mv-Content-Type"
+
+// max_meta_size caps the total size of the headers stored with a blob
+const MaxMetaSize = 8 << 10
+
+// standard headers stored with a blob
+var storedHeaders = []string{
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Language",
+	"Expires",
+}
+
+// meta returns the headers in h that are stored with a blob, or nil if
+// there are none
+func Meta(h http.Header) map[string]string {
+	var meta map[string]string
+	add := func(name, value string) {
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[name] = value
+	}
+
+	for _, name := range storedHeaders {
+		if v := h.Get(name); v != "" {
+			add(name, v)
+		}
+	}
+	for name, values := range h {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if strings.HasPrefix(name, MetaPrefix) && len(name) > len(MetaPrefix) {
+			add(name, strings.Join(values, ", "))
+		}
+	}
+	return meta
+}
+
+// meta_size is how much room meta takes up, counted like header lines
+func MetaSize(meta map[string]string) int {
+	n := 0
+	for name, value := range meta {
+		n += len(name) + len(value)
+	}
+	return n
+}
+
+// set_meta adds meta to h
+func SetMeta(h http.Header, meta map[string]string) {
+	for name, value := range meta {
+		h.Set(name, value)
+	}
+}
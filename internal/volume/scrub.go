@@ -0,0 +1,13 @@
+package volume
+
+// scrub_result is one line of a volume's /_scrub stream
+type ScrubResult struct {
+	Hash string `json:"hash"`
+	OK   bool   `json:"ok"`
+	// actual is the sha256 of what is on disk, if it could be read
+	Actual string `json:"actual,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// skipped blobs couldn't be checked (e.g. their master key is
+	// missing) and aren't known to be corrupt
+	Skipped bool `json:"skipped,omitempty"`
+}
@@ -2,32 +2,136 @@ package client
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/afonp/microvault/internal/auth"
 )
 
 type Client struct {
 	masterURL string
 	client    *http.Client
+	keys      KeyProvider // nil unless encrypting
+
+	// set by options, for building the transport
+	keyID, secret string
+	tlsConfig     *tls.Config
+}
+
+// option configures a client
+type Option func(*Client)
+
+// with_key signs every request with the given key id and secret, for
+// masters that require authentication
+func WithKey(id, secret string) Option {
+	return func(c *Client) {
+		c.keyID, c.secret = id, secret
+	}
+}
+
+// with_tls connects to https masters and volumes with cfg, e.g. to trust a
+// private ca or present a client certificate. see LoadTLSConfig.
+func WithTLS(cfg *tls.Config) Option {
+	return func(c *Client) {
+		c.tlsConfig = cfg
+	}
 }
 
-func NewClient(masterURL string) *Client {
-	return &Client{
+// load_tls_config builds a tls config that trusts the cas in caFile (the
+// system roots if empty) and presents the certificate in certFile and
+// keyFile (none if empty)
+func LoadTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func NewClient(masterURL string, opts ...Option) *Client {
+	c := &Client{
 		masterURL: strings.TrimRight(masterURL, "/"),
 		client:    &http.Client{}, // default client follows redirects
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.tlsConfig != nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = c.tlsConfig
+		c.client.Transport = t
+	}
+	if c.keyID != "" {
+		c.client.Transport = auth.NewTransport(c.keyID, c.secret, c.client.Transport)
+	}
+	return c
 }
 
-// put uploads a blob with the given key
+// header carrying the sha256 of an upload, which lets the master link
+// content it already has instead of storing it again
+const contentHashHeader = "X-Mv-Content-Sha256"
+
+// put uploads a blob with the given key. if the cluster already stores the
+// same content, the key is pointed at it and the data isn't sent.
 func (c *Client) Put(key string, data []byte) error {
+	var encryption string
+	if c.keys != nil {
+		var err error
+		if data, encryption, err = c.encrypt(data); err != nil {
+			return err
+		}
+	}
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	// fresh ciphertext is never stored already
+	if encryption == "" {
+		linked, err := c.link(key, hash)
+		if err != nil {
+			return err
+		}
+		if linked {
+			return nil
+		}
+	}
+
 	url := fmt.Sprintf("%s/blob/%s", c.masterURL, key)
 	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(data))
 	if err != nil {
 		return err
 	}
 	req.ContentLength = int64(len(data))
+	req.Header.Set(contentHashHeader, hash)
+	if encryption != "" {
+		req.Header.Set(encryptionHeader, encryption)
+	}
 
 	resp, err := c.client.Do(req)
 	if err != nil {
@@ -43,6 +147,34 @@ func (c *Client) Put(key string, data []byte) error {
 	return nil
 }
 
+// link points key at already stored content. it reports false if the
+// content has to be uploaded.
+func (c *Client) link(key, hash string) (bool, error) {
+	url := fmt.Sprintf("%s/blob/%s", c.masterURL, key)
+	req, err := http.NewRequest(http.MethodPut, url, http.NoBody)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set(contentHashHeader, hash)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return true, nil
+	case http.StatusPreconditionFailed:
+		// not stored, or not by anyone we may read
+		return false, nil
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		return false, fmt.Errorf("put failed: %s (status: %d)", string(body), resp.StatusCode)
+	}
+}
+
 // get retrieves a blob
 func (c *Client) Get(key string) ([]byte, error) {
 	url := fmt.Sprintf("%s/blob/%s", c.masterURL, key)
@@ -59,7 +191,11 @@ func (c *Client) Get(key string) ([]byte, error) {
 		return nil, fmt.Errorf("get failed: status %d", resp.StatusCode)
 	}
 
-	return io.ReadAll(resp.Body)
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return c.decrypt(resp, data)
 }
 
 // delete removes a blob
@@ -82,3 +218,31 @@ func (c *Client) Delete(key string) error {
 
 	return nil
 }
+
+// presign asks the master for a url anyone can use to make one method
+// request on key, until ttl has passed
+func (c *Client) Presign(method, key string, ttl time.Duration) (string, error) {
+	q := url.Values{}
+	q.Set("method", method)
+	q.Set("key", key)
+	q.Set("expires_in", strconv.Itoa(int(ttl.Seconds())))
+
+	resp, err := c.client.Get(c.masterURL + "/_presign?" + q.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("presign failed: %s (status: %d)", strings.TrimSpace(string(body)), resp.StatusCode)
+	}
+
+	var out struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", err
+	}
+	return out.URL, nil
+}
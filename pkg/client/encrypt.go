@@ -0,0 +1,94 @@
+package client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/afonp/microvault/internal/crypt"
+)
+
+// with encryption on, blobs are sealed before they leave the client, in the
+// same chunked aes-256-gcm format volumes use at rest, and the master and
+// volumes only ever see ciphertext. the parameters needed to read a blob
+// (its wrapped data key, nonce prefix and chunk size) go in its metadata,
+// so any client with the master key can read it.
+
+// key provider wraps and unwraps the per-blob data keys with a master key
+// the caller holds. LoadKeyfile returns one; a kms can be wired in by
+// implementing it.
+type KeyProvider interface {
+	// wrap encrypts a data key and names the master key it used
+	Wrap(dataKey []byte) (keyID string, wrapped []byte, err error)
+	// unwrap decrypts a data key wrapped with the named master key
+	Unwrap(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// load_keyfile reads master keys from a file of "{key id} {64 hex}" lines.
+// the first key wraps new blobs, the others are only used to read.
+func LoadKeyfile(path string) (KeyProvider, error) {
+	return crypt.LoadKeyfile(path)
+}
+
+// with_encryption encrypts blobs on put and decrypts them on get with
+// master keys from keys. encrypted blobs never share storage, since the
+// same content encrypts differently every time.
+func WithEncryption(keys KeyProvider) Option {
+	return func(c *Client) {
+		c.keys = keys
+	}
+}
+
+// metadata header holding the base64 stream header of an encrypted blob
+const encryptionHeader = "X-Mv-Meta-Encryption"
+
+var ErrEncrypted = errors.New("blob is encrypted and the client has no keys")
+
+// encrypt seals data and returns it with the value for encryptionHeader
+func (c *Client) encrypt(data []byte) ([]byte, string, error) {
+	var buf bytes.Buffer
+	w, err := crypt.NewDetachedWriter(&buf, c.keys)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, "", err
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), base64.StdEncoding.EncodeToString(w.Header()), nil
+}
+
+// decrypt opens a blob fetched with resp, if it was encrypted
+func (c *Client) decrypt(resp *http.Response, data []byte) ([]byte, error) {
+	header := blobHeader(resp).Get(encryptionHeader)
+	if header == "" {
+		return data, nil
+	}
+	if c.keys == nil {
+		return nil, ErrEncrypted
+	}
+	raw, err := base64.StdEncoding.DecodeString(header)
+	if err != nil {
+		return nil, crypt.ErrCorrupt
+	}
+	r, err := crypt.NewDetachedReader(bytes.NewReader(data), int64(len(data)), raw, c.keys)
+	if err != nil {
+		return nil, err
+	}
+	// reading to the end checks the last chunk, even with no content
+	return io.ReadAll(r)
+}
+
+// blob_header returns the headers the master sent for a blob. they come on
+// its redirect to the volume, not on the volume's response.
+func blobHeader(resp *http.Response) http.Header {
+	h := resp.Header
+	for req := resp.Request; req != nil && req.Response != nil; req = req.Response.Request {
+		h = req.Response.Header
+	}
+	return h
+}
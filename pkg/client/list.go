@@ -0,0 +1,97 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// entry is a key, or a common prefix when listing with a delimiter
+type Entry struct {
+	Key          string
+	Size         int64
+	Hash         string
+	ContentType  string
+	LastModified time.Time
+	// is_prefix marks a common prefix, which only has a key
+	IsPrefix bool
+}
+
+type listPage struct {
+	Keys []struct {
+		Key          string    `json:"key"`
+		Size         int64     `json:"size"`
+		Hash         string    `json:"hash"`
+		ContentType  string    `json:"content_type"`
+		LastModified time.Time `json:"last_modified"`
+	} `json:"keys"`
+	CommonPrefixes []string `json:"common_prefixes"`
+	NextStartAfter string   `json:"next_start_after"`
+}
+
+// list iterates over the keys starting with prefix in order, fetching them
+// a page at a time. with a delimiter, keys that contain it after the
+// prefix are rolled up into one prefix entry, like directories. the
+// iteration stops after the first error.
+func (c *Client) List(prefix, delimiter string) iter.Seq2[Entry, error] {
+	return func(yield func(Entry, error) bool) {
+		startAfter := ""
+		for {
+			page, err := c.listPage(prefix, delimiter, startAfter)
+			if err != nil {
+				yield(Entry{}, err)
+				return
+			}
+
+			// keys and prefixes are each sorted; merge them
+			keys, prefixes := page.Keys, page.CommonPrefixes
+			for len(keys) > 0 || len(prefixes) > 0 {
+				var e Entry
+				if len(prefixes) == 0 || (len(keys) > 0 && keys[0].Key < prefixes[0]) {
+					k := keys[0]
+					keys = keys[1:]
+					e = Entry{Key: k.Key, Size: k.Size, Hash: k.Hash, ContentType: k.ContentType, LastModified: k.LastModified}
+				} else {
+					e = Entry{Key: prefixes[0], IsPrefix: true}
+					prefixes = prefixes[1:]
+				}
+				if !yield(e, nil) {
+					return
+				}
+			}
+
+			if page.NextStartAfter == "" {
+				return
+			}
+			startAfter = page.NextStartAfter
+		}
+	}
+}
+
+func (c *Client) listPage(prefix, delimiter, startAfter string) (*listPage, error) {
+	q := url.Values{}
+	q.Set("prefix", prefix)
+	q.Set("delimiter", delimiter)
+	q.Set("start_after", startAfter)
+
+	resp, err := c.client.Get(fmt.Sprintf("%s/blob/?%s", c.masterURL, q.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("list failed: %s (status: %d)", string(body), resp.StatusCode)
+	}
+
+	var page listPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
@@ -7,9 +7,9 @@ cleanup() {
 }
 trap cleanup EXIT
 
-go build -o ../bin/master ../cmd/master/main.go
-go build -o ../bin/volume ../cmd/volume/main.go
-go build -o ../bin/mkv ../cmd/mkv/main.go
+go build -o ../bin/master ../cmd/master
+go build -o ../bin/volume ../cmd/volume
+go build -o ../bin/mkv ../cmd/mkv
 
 rm -rf data1 data2 data3 data4 metadata.db
 mkdir -p data1 data2 data3 data4
@@ -40,11 +40,13 @@ rm metadata.db
 
 ../bin/mkv -volumes "http://localhost:8081,http://localhost:8082,http://localhost:8083" rebuild
 
-../bin/mkv -volumes "http://localhost:8081,http://localhost:8082,http://localhost:8083" -replicas 1 verify
-# rebuild only restores hash->hash entries; original keys are gone.
-# verify only checks keys that exist in the db.
-# after rebuild, the db keys are hashes, and disk files are named by hash.
-# so verify should pass.
+../bin/mkv -volumes "http://localhost:8081,http://localhost:8082,http://localhost:8083" -replicas 3 verify
+# rebuild replays the volume journals, so the original keys come back
+# with all of their replicas.
+if ! sqlite3 metadata.db "SELECT key FROM blobs" | grep -q '^key-1$'; then
+    echo "error: rebuild did not restore key-1"
+    exit 1
+fi
 
 echo "testing rebalance..."
 ../bin/volume -port 8084 -root ./data4 &
@@ -52,7 +54,7 @@ sleep 1
 
 ../bin/mkv -volumes "http://localhost:8081,http://localhost:8082,http://localhost:8083,http://localhost:8084" -replicas 3 rebalance
 
-COUNT4=$(find data4 -type f | wc -l)
+COUNT4=$(find data4 -path "data4/??/??/*" -type f | wc -l)
 echo "volume 4 has $COUNT4 files"
 if [ "$COUNT4" -eq "0" ]; then  
     echo "warning: volume 4 has 0 files. might be normal if hash ring didn't assign any, but with 5 files and 3 replicas, likely some should move."
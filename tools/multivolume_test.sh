@@ -7,8 +7,8 @@ cleanup() {
 }
 trap cleanup EXIT
 
-go build -o ../bin/master ../cmd/master/main.go
-go build -o ../bin/volume ../cmd/volume/main.go
+go build -o ../bin/master ../cmd/master
+go build -o ../bin/volume ../cmd/volume
 
 rm -rf data1 data2 data3 metadata.db
 mkdir -p data1 data2 data3
@@ -19,7 +19,8 @@ mkdir -p data1 data2 data3
 
 sleep 2
 
-../bin/master -port 8080 -volumes "http://localhost:8081,http://localhost:8082,http://localhost:8083" &
+# one copy per blob, so the files show how keys are spread
+../bin/master -port 8080 -replicas 1 -volumes "http://localhost:8081,http://localhost:8082,http://localhost:8083" &
 
 sleep 2
 
@@ -29,9 +30,9 @@ for i in {1..10}; do
 done
 
 echo "verifying distribution..."
-COUNT1=$(find data1 -type f | wc -l)
-COUNT2=$(find data2 -type f | wc -l)
-COUNT3=$(find data3 -type f | wc -l)
+COUNT1=$(find data1 -path "data1/??/??/*" -type f | wc -l)
+COUNT2=$(find data2 -path "data2/??/??/*" -type f | wc -l)
+COUNT3=$(find data3 -path "data3/??/??/*" -type f | wc -l)
 
 echo "volume 1: $COUNT1 files"
 echo "volume 2: $COUNT2 files"
@@ -50,7 +51,8 @@ fi
 
 echo "reading blobs..."
 for i in {1..10}; do
-    HEADERS=$(curl -s -I http://localhost:8080/blob/key-$i)
+    # HEAD is answered from the index, only GET redirects
+    HEADERS=$(curl -s -D - -o /dev/null http://localhost:8080/blob/key-$i)
     LOCATION=$(echo "$HEADERS" | grep -i "Location:" | awk '{print $2}' | tr -d '\r')
     
     if [ -z "$LOCATION" ]; then
@@ -0,0 +1,100 @@
+#!/bin/bash
+set -e
+
+cleanup() {
+    echo "cleaning up..."
+    pkill -P $$ # kill child processes (volumes, master)
+}
+trap cleanup EXIT
+
+go build -o ../bin/master ../cmd/master
+go build -o ../bin/volume ../cmd/volume
+
+rm -rf data1 data2 metadata.db body headers
+mkdir -p data1 data2
+
+../bin/volume -port 8081 -root ./data1 &
+../bin/volume -port 8082 -root ./data2 &
+
+sleep 2
+
+../bin/master -port 8080 -volumes "http://localhost:8081,http://localhost:8082" -replicas 2 &
+
+sleep 2
+
+echo "putting blob..."
+printf '0123456789abcdefghij' > body
+curl -s -X PUT --data-binary @body http://localhost:8080/blob/media
+HASH=$(sha256sum body | cut -d' ' -f1)
+
+echo "testing range across the redirect..."
+STATUS=$(curl -s -L -r 5-9 -o part -w "%{http_code}" http://localhost:8080/blob/media)
+if [ "$STATUS" != "206" ] || [ "$(cat part)" != "56789" ]; then
+    echo "error: expected 206 with 56789, got $STATUS with $(cat part)"
+    exit 1
+fi
+
+echo "testing suffix range..."
+STATUS=$(curl -s -L -H "Range: bytes=-3" -o part -w "%{http_code}" http://localhost:8080/blob/media)
+if [ "$STATUS" != "206" ] || [ "$(cat part)" != "hij" ]; then
+    echo "error: expected 206 with hij, got $STATUS with $(cat part)"
+    exit 1
+fi
+
+echo "testing unsatisfiable range..."
+STATUS=$(curl -s -L -r 100-200 -o /dev/null -w "%{http_code}" http://localhost:8080/blob/media)
+if [ "$STATUS" != "416" ]; then
+    echo "error: expected 416, got $STATUS"
+    exit 1
+fi
+
+echo "testing etags..."
+curl -s -D headers -o /dev/null http://localhost:8080/blob/media
+if ! grep -qi "^etag: \"$HASH\"" headers; then
+    echo "error: master did not send the sha256 etag"
+    exit 1
+fi
+curl -s -L -D headers -o /dev/null http://localhost:8080/blob/media
+if [ "$(grep -ci "^etag: \"$HASH\"" headers)" != "2" ]; then
+    echo "error: volume did not send the sha256 etag"
+    exit 1
+fi
+
+echo "testing If-Range across the redirect..."
+STATUS=$(curl -s -L -r 0-3 -H "If-Range: \"$HASH\"" -o part -w "%{http_code}" http://localhost:8080/blob/media)
+if [ "$STATUS" != "206" ] || [ "$(cat part)" != "0123" ]; then
+    echo "error: expected 206 with 0123, got $STATUS"
+    exit 1
+fi
+STATUS=$(curl -s -L -r 0-3 -H 'If-Range: "stale"' -o part -w "%{http_code}" http://localhost:8080/blob/media)
+if [ "$STATUS" != "200" ] || [ "$(cat part)" != "$(cat body)" ]; then
+    echo "error: expected the whole blob for a stale If-Range, got $STATUS"
+    exit 1
+fi
+
+echo "testing If-None-Match..."
+STATUS=$(curl -s -H "If-None-Match: \"$HASH\"" -o /dev/null -w "%{http_code}" http://localhost:8080/blob/media)
+if [ "$STATUS" != "304" ]; then
+    echo "error: expected 304 from the master, got $STATUS"
+    exit 1
+fi
+STATUS=$(curl -s -H 'If-None-Match: "other"' -o /dev/null -w "%{http_code}" http://localhost:8080/blob/media)
+if [ "$STATUS" != "302" ]; then
+    echo "error: expected a redirect for a stale etag, got $STATUS"
+    exit 1
+fi
+
+echo "testing If-Modified-Since..."
+STATUS=$(curl -s -H "If-Modified-Since: $(date -u -d '+1 hour' '+%a, %d %b %Y %H:%M:%S GMT')" -o /dev/null -w "%{http_code}" http://localhost:8080/blob/media)
+if [ "$STATUS" != "304" ]; then
+    echo "error: expected 304 from the master, got $STATUS"
+    exit 1
+fi
+STATUS=$(curl -s -H "If-Modified-Since: Mon, 01 Jan 2001 00:00:00 GMT" -o /dev/null -w "%{http_code}" http://localhost:8080/blob/media)
+if [ "$STATUS" != "302" ]; then
+    echo "error: expected a redirect for an old copy, got $STATUS"
+    exit 1
+fi
+
+rm -f body part headers
+echo "success!"
@@ -7,8 +7,8 @@ cleanup() {
 }
 trap cleanup EXIT
 
-go build -o ../bin/master ../cmd/master/main.go
-go build -o ../bin/volume ../cmd/volume/main.go
+go build -o ../bin/master ../cmd/master
+go build -o ../bin/volume ../cmd/volume
 
 rm -rf data1 data2 data3 metadata.db
 mkdir -p data1 data2 data3
@@ -27,9 +27,9 @@ echo "putting blob..."
 curl -v -X PUT -d "replication-test" http://localhost:8080/blob/rep-key
 
 echo "verifying replication..."
-COUNT1=$(find data1 -type f | wc -l)
-COUNT2=$(find data2 -type f | wc -l)
-COUNT3=$(find data3 -type f | wc -l)
+COUNT1=$(find data1 -path "data1/??/??/*" -type f | wc -l)
+COUNT2=$(find data2 -path "data2/??/??/*" -type f | wc -l)
+COUNT3=$(find data3 -path "data3/??/??/*" -type f | wc -l)
 
 echo "volume 1: $COUNT1 files"
 echo "volume 2: $COUNT2 files"
@@ -49,9 +49,9 @@ echo "testing DELETE..."
 curl -v -X DELETE http://localhost:8080/blob/rep-key
 
 echo "verifying deletion..."
-COUNT1=$(find data1 -type f | wc -l)
-COUNT2=$(find data2 -type f | wc -l)
-COUNT3=$(find data3 -type f | wc -l)
+COUNT1=$(find data1 -path "data1/??/??/*" -type f | wc -l)
+COUNT2=$(find data2 -path "data2/??/??/*" -type f | wc -l)
+COUNT3=$(find data3 -path "data3/??/??/*" -type f | wc -l)
 
 if [ "$COUNT1" -ne "0" ] || [ "$COUNT2" -ne "0" ] || [ "$COUNT3" -ne "0" ]; then
     echo "error: blob not deleted from all volumes"
@@ -1,8 +1,8 @@
 #!/bin/bash
 set -e
 
-go build -o bin/master cmd/master/main.go
-go build -o bin/volume cmd/volume/main.go
+go build -o bin/master ./cmd/master
+go build -o bin/volume ./cmd/volume
 
 cleanup() {
     echo "cleaning up..."
@@ -28,7 +28,7 @@ echo "testing PUT..."
 curl -v -X PUT -d "hello world" http://localhost:8080/blob/testkey
 
 echo "checking file existence..."
-FOUND=$(find data -type f | wc -l)
+FOUND=$(find data -path "data/??/??/*" -type f | wc -l)
 if [ "$FOUND" -ne "1" ]; then
     echo "error: file not found in data/"
     exit 1
@@ -50,7 +50,7 @@ echo "testing delete..."
 curl -v -X DELETE http://localhost:8080/blob/testkey
 
 echo "checking file deletion..."
-FOUND_AFTER=$(find data -type f | wc -l)
+FOUND_AFTER=$(find data -path "data/??/??/*" -type f | wc -l)
 if [ "$FOUND_AFTER" -ne "0" ]; then
     echo "error: file still exists after delete"
     exit 1